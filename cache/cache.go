@@ -23,9 +23,11 @@
 package cache
 
 import (
+	"regexp"
 	"time"
 	"unsafe"
 
+	"github.com/dustin/go-humanize"
 	"github.com/vicanso/pike/config"
 )
 
@@ -41,19 +43,53 @@ func GetDispatcher(name string) *dispatcher {
 	return defaultDispatchers.Get(name)
 }
 
+// GetDispatcherStats get the stats of default dispatchers
+func GetDispatcherStats() []DispatcherStats {
+	return defaultDispatchers.GetStats()
+}
+
 // RemoveHTTPCache remove http cache form default dispatchers
 func RemoveHTTPCache(name string, key []byte) {
 	defaultDispatchers.RemoveHTTPCache(name, key)
 }
 
+// SoftRemoveHTTPCache set the http cache expired but keep the response form default dispatchers
+func SoftRemoveHTTPCache(name string, key []byte) {
+	defaultDispatchers.SoftRemoveHTTPCache(name, key)
+}
+
+// PurgeByPrefix purge the http caches which key has the prefix from default dispatchers
+func PurgeByPrefix(name, prefix string, soft bool) int {
+	return defaultDispatchers.PurgeByPrefix(name, prefix, soft)
+}
+
+// PurgeByRegexp purge the http caches which key matches the regexp from default dispatchers
+func PurgeByRegexp(name string, reg *regexp.Regexp, soft bool) int {
+	return defaultDispatchers.PurgeByRegexp(name, reg, soft)
+}
+
+// PurgeByTag purge the http caches which has the tag from default dispatchers
+func PurgeByTag(name, tag string, soft bool) int {
+	return defaultDispatchers.PurgeByTag(name, tag, soft)
+}
+
 func convertConfigs(configs []config.CacheConfig) []DispatcherOption {
 	opts := make([]DispatcherOption, 0)
 	for _, item := range configs {
 		d, _ := time.ParseDuration(item.HitForPass)
+		maxDiskSize, _ := humanize.ParseBytes(item.MaxDiskSize)
+		maxMemory, _ := humanize.ParseBytes(item.MaxMemory)
+		maxObjectSize, _ := humanize.ParseBytes(item.MaxObjectSize)
 		opts = append(opts, DispatcherOption{
-			Name:       item.Name,
-			Size:       item.Size,
-			HitForPass: int(d.Seconds()),
+			Name:          item.Name,
+			Size:          item.Size,
+			HitForPass:    int(d.Seconds()),
+			Store:         item.Store,
+			Path:          item.Path,
+			MaxDiskSize:   maxDiskSize,
+			MaxMemory:     maxMemory,
+			MaxObjectSize: int(maxObjectSize),
+			MaxVariants:   item.MaxVariants,
 		})
 	}
 	return opts
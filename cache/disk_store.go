@@ -0,0 +1,418 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 磁盘缓存，作为内存缓存的二级存储。可缓存的响应在生成时同时写入磁盘，
+// 内存中的lru淘汰或程序重启之后，缓存仍可从磁盘中读取并重新加载至内存，
+// 避免因重启或配置更新导致的大量请求转发至upstream
+
+package cache
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StoreMemory memory store
+	StoreMemory = "memory"
+	// StoreDisk disk store
+	StoreDisk = "disk"
+)
+
+// defaultMaxDiskSize default max disk size: 1GB
+const defaultMaxDiskSize = 1024 * 1024 * 1024
+
+// diskFileExt the ext of disk cache file
+const diskFileExt = ".cache"
+
+type (
+	// diskHTTPCache the http cache save to disk
+	diskHTTPCache struct {
+		Key                       string
+		CreatedAt                 int
+		ExpiredAt                 int
+		StaleWhileRevalidateUntil int
+		StaleIfErrorUntil         int
+		StatusCode                int
+		Header                    http.Header
+		CompressSrv               string
+		CompressMinLength         int
+		CompressContentTypeFilter string
+		GzipBody                  []byte
+		BrBody                    []byte
+		RawBody                   []byte
+	}
+	// diskFile disk file info
+	diskFile struct {
+		size uint64
+		// 最近访问时间，读取时会同时更新文件的修改时间，重启后仍能按lru淘汰
+		modTime time.Time
+		// 缓存的key与tag，启动时加载的文件为空，在读取时才设置
+		key  string
+		tags []string
+	}
+	// diskStore disk store of http cache
+	diskStore struct {
+		mu      *sync.Mutex
+		path    string
+		maxSize uint64
+		size    uint64
+		files   map[string]*diskFile
+	}
+)
+
+// expiredUntil get the time until the http cache can't be used
+func (dhc *diskHTTPCache) expiredUntil() int {
+	until := dhc.ExpiredAt
+	if dhc.StaleWhileRevalidateUntil > until {
+		until = dhc.StaleWhileRevalidateUntil
+	}
+	if dhc.StaleIfErrorUntil > until {
+		until = dhc.StaleIfErrorUntil
+	}
+	return until
+}
+
+// newDiskStore create a disk store, the files of path will be loaded as cache
+func newDiskStore(path string, maxSize uint64) (*diskStore, error) {
+	if maxSize == 0 {
+		maxSize = defaultMaxDiskSize
+	}
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	ds := &diskStore{
+		mu:      &sync.Mutex{},
+		path:    path,
+		maxSize: maxSize,
+		files:   make(map[string]*diskFile),
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+		// 非缓存文件（如写入中途程序退出的临时文件）则删除
+		if !strings.HasSuffix(name, diskFileExt) {
+			_ = os.Remove(filepath.Join(path, name))
+			continue
+		}
+		size := uint64(info.Size())
+		ds.files[name] = &diskFile{
+			size:    size,
+			modTime: info.ModTime(),
+		}
+		ds.size += size
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.evict()
+	return ds, nil
+}
+
+// getFileName get the file name of key
+func (ds *diskStore) getFileName(key []byte) string {
+	// MemHash每次启动的seed不一致，因此使用sha1生成文件名
+	sum := sha1.Sum(key)
+	return hex.EncodeToString(sum[:]) + diskFileExt
+}
+
+// evict remove the least recently used files until the size is less than max size
+func (ds *diskStore) evict() {
+	if ds.size <= ds.maxSize {
+		return
+	}
+	names := make([]string, 0, len(ds.files))
+	for name := range ds.files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return ds.files[names[i]].modTime.Before(ds.files[names[j]].modTime)
+	})
+	for _, name := range names {
+		if ds.size <= ds.maxSize {
+			break
+		}
+		ds.remove(name)
+	}
+}
+
+// remove remove the file
+func (ds *diskStore) remove(name string) {
+	file, ok := ds.files[name]
+	if !ok {
+		return
+	}
+	delete(ds.files, name)
+	ds.size -= file.size
+	_ = os.Remove(filepath.Join(ds.path, name))
+}
+
+// read read the http cache from file
+func (ds *diskStore) read(name string) (*diskHTTPCache, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(ds.path, name))
+	if err != nil {
+		return nil, err
+	}
+	dhc := &diskHTTPCache{}
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(dhc)
+	if err != nil {
+		return nil, err
+	}
+	return dhc, nil
+}
+
+// Get get http cache from disk, if not exists or expired, nil will be return
+func (ds *diskStore) Get(key []byte) (*httpCache, error) {
+	name := ds.getFileName(key)
+	ds.mu.Lock()
+	_, ok := ds.files[name]
+	ds.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	dhc, err := ds.read(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	// 数据有误或已过期（且过期数据不可再使用）则删除
+	if err != nil || dhc.expiredUntil() < nowUnix() {
+		ds.mu.Lock()
+		ds.remove(name)
+		ds.mu.Unlock()
+		return nil, err
+	}
+	// hash冲突
+	if dhc.Key != string(key) {
+		return nil, nil
+	}
+	resp := &HTTPResponse{
+		CompressSrv:       dhc.CompressSrv,
+		CompressMinLength: dhc.CompressMinLength,
+		Header:            dhc.Header,
+		StatusCode:        dhc.StatusCode,
+		GzipBody:          dhc.GzipBody,
+		BrBody:            dhc.BrBody,
+		RawBody:           dhc.RawBody,
+	}
+	if dhc.CompressContentTypeFilter != "" {
+		resp.CompressContentTypeFilter, _ = regexp.Compile(dhc.CompressContentTypeFilter)
+	}
+	now := time.Now()
+	ds.mu.Lock()
+	if file, ok := ds.files[name]; ok {
+		file.key = dhc.Key
+		file.tags = resp.Tags()
+		file.modTime = now
+		_ = os.Chtimes(filepath.Join(ds.path, name), now, now)
+	}
+	ds.mu.Unlock()
+	hc := NewHTTPCache()
+	hc.status = StatusHit
+	hc.response = resp
+	hc.createdAt = dhc.CreatedAt
+	hc.expiredAt = dhc.ExpiredAt
+	hc.staleWhileRevalidateUntil = dhc.StaleWhileRevalidateUntil
+	hc.staleIfErrorUntil = dhc.StaleIfErrorUntil
+	return hc, nil
+}
+
+// Set save the http cache to disk, only hit cache will be saved
+func (ds *diskStore) Set(key []byte, hc *httpCache) error {
+	hc.mu.RLock()
+	status := hc.status
+	resp := hc.response
+	dhc := diskHTTPCache{
+		Key:                       string(key),
+		CreatedAt:                 hc.createdAt,
+		ExpiredAt:                 hc.expiredAt,
+		StaleWhileRevalidateUntil: hc.staleWhileRevalidateUntil,
+		StaleIfErrorUntil:         hc.staleIfErrorUntil,
+	}
+	hc.mu.RUnlock()
+	if (status != StatusHit && status != StatusStale) || resp == nil {
+		return nil
+	}
+	// 可缓存的响应在压缩后不再修改，因此可直接读取
+	dhc.StatusCode = resp.StatusCode
+	dhc.Header = resp.Header
+	dhc.CompressSrv = resp.CompressSrv
+	dhc.CompressMinLength = resp.CompressMinLength
+	if resp.CompressContentTypeFilter != nil {
+		dhc.CompressContentTypeFilter = resp.CompressContentTypeFilter.String()
+	}
+	dhc.GzipBody = resp.GzipBody
+	dhc.BrBody = resp.BrBody
+	dhc.RawBody = resp.RawBody
+
+	return ds.write(ds.getFileName(key), &dhc, resp.Tags())
+}
+
+// write write the http cache to file
+func (ds *diskStore) write(name string, dhc *diskHTTPCache, tags []string) error {
+	buffer := &bytes.Buffer{}
+	err := gob.NewEncoder(buffer).Encode(dhc)
+	if err != nil {
+		return err
+	}
+	// 先写入临时文件再重命名，避免读取到写入中的数据
+	f, err := ioutil.TempFile(ds.path, "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buffer.Bytes())
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	err = os.Rename(f.Name(), filepath.Join(ds.path, name))
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if file, ok := ds.files[name]; ok {
+		ds.size -= file.size
+	}
+	size := uint64(buffer.Len())
+	ds.files[name] = &diskFile{
+		size:    size,
+		modTime: time.Now(),
+		key:     dhc.Key,
+		tags:    tags,
+	}
+	ds.size += size
+	ds.evict()
+	return nil
+}
+
+// expire set the http cache of file expired, the response can be used as stale data
+func (ds *diskStore) expire(name string) error {
+	dhc, err := ds.read(name)
+	if err != nil {
+		return err
+	}
+	dhc.ExpiredAt, dhc.StaleWhileRevalidateUntil, dhc.StaleIfErrorUntil = softExpire(
+		nowUnix(),
+		dhc.ExpiredAt,
+		dhc.StaleWhileRevalidateUntil,
+		dhc.StaleIfErrorUntil,
+	)
+	tags := (&HTTPResponse{
+		Header: dhc.Header,
+	}).Tags()
+	return ds.write(name, dhc, tags)
+}
+
+// Purge remove the http caches which match the function, it returns the keys of purged caches.
+// If soft is true, the http caches will be set expired instead of removed.
+func (ds *diskStore) Purge(match func(key string, tags []string) bool, soft bool) []string {
+	ds.mu.Lock()
+	names := make([]string, 0, len(ds.files))
+	for name := range ds.files {
+		names = append(names, name)
+	}
+	ds.mu.Unlock()
+
+	keys := make([]string, 0)
+	for _, name := range names {
+		ds.mu.Lock()
+		file, ok := ds.files[name]
+		var key string
+		var tags []string
+		if ok {
+			key = file.key
+			tags = file.tags
+		}
+		ds.mu.Unlock()
+		if !ok {
+			continue
+		}
+		// 启动时加载的文件未记录key，需要读取文件
+		if key == "" {
+			dhc, err := ds.read(name)
+			if err != nil {
+				continue
+			}
+			key = dhc.Key
+			tags = (&HTTPResponse{
+				Header: dhc.Header,
+			}).Tags()
+			ds.mu.Lock()
+			if file, ok := ds.files[name]; ok {
+				file.key = key
+				file.tags = tags
+			}
+			ds.mu.Unlock()
+		}
+		if !match(key, tags) {
+			continue
+		}
+		if soft {
+			if err := ds.expire(name); err == nil {
+				keys = append(keys, key)
+			}
+			continue
+		}
+		ds.mu.Lock()
+		ds.remove(name)
+		ds.mu.Unlock()
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Remove remove the http cache from disk
+func (ds *diskStore) Remove(key []byte) {
+	name := ds.getFileName(key)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.remove(name)
+}
+
+// Size get the total size of disk store
+func (ds *diskStore) Size() uint64 {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.size
+}
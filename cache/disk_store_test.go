@@ -0,0 +1,162 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCacheableHTTPCache(data []byte, ttl int) *httpCache {
+	hc := NewHTTPCache()
+	hc.Cacheable(&HTTPResponse{
+		StatusCode: 200,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain"},
+		},
+		CompressMinLength: 1024,
+		RawBody:           data,
+	}, ttl)
+	return hc
+}
+
+func TestDiskStore(t *testing.T) {
+	assert := assert.New(t)
+	path, err := ioutil.TempDir("", "pike")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	ds, err := newDiskStore(path, 0)
+	assert.Nil(err)
+	key := []byte("GET test.com /users/me")
+
+	// 不存在
+	hc, err := ds.Get(key)
+	assert.Nil(err)
+	assert.Nil(hc)
+
+	// 非可缓存的不保存
+	err = ds.Set(key, NewHTTPCache())
+	assert.Nil(err)
+	assert.Equal(uint64(0), ds.Size())
+
+	data := []byte("Hello world!")
+	cacheHC := newCacheableHTTPCache(data, 300)
+	err = ds.Set(key, cacheHC)
+	assert.Nil(err)
+	assert.NotEqual(uint64(0), ds.Size())
+
+	hc, err = ds.Get(key)
+	assert.Nil(err)
+	assert.NotNil(hc)
+	assert.Equal(StatusHit, hc.status)
+	assert.Equal(cacheHC.createdAt, hc.createdAt)
+	assert.Equal(cacheHC.expiredAt, hc.expiredAt)
+	assert.Equal(200, hc.response.StatusCode)
+	assert.Equal("text/plain", hc.response.Header.Get("Content-Type"))
+	assert.Equal(data, hc.response.RawBody)
+
+	// 重新加载磁盘缓存
+	ds, err = newDiskStore(path, 0)
+	assert.Nil(err)
+	hc, err = ds.Get(key)
+	assert.Nil(err)
+	assert.NotNil(hc)
+	assert.Equal(data, hc.response.RawBody)
+
+	ds.Remove(key)
+	assert.Equal(uint64(0), ds.Size())
+	hc, err = ds.Get(key)
+	assert.Nil(err)
+	assert.Nil(hc)
+
+	// 已过期的数据
+	err = ds.Set(key, newCacheableHTTPCache(data, -1))
+	assert.Nil(err)
+	hc, err = ds.Get(key)
+	assert.Nil(err)
+	assert.Nil(hc)
+	assert.Equal(uint64(0), ds.Size())
+}
+
+func TestDiskStoreEvict(t *testing.T) {
+	assert := assert.New(t)
+	path, err := ioutil.TempDir("", "pike")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	ds, err := newDiskStore(path, 1)
+	assert.Nil(err)
+	key1 := []byte("key1")
+	key2 := []byte("key2")
+	err = ds.Set(key1, newCacheableHTTPCache([]byte("abc"), 300))
+	assert.Nil(err)
+	// 超出尺寸，最旧的文件被删除
+	assert.Empty(ds.files)
+
+	ds.maxSize = defaultMaxDiskSize
+	err = ds.Set(key1, newCacheableHTTPCache([]byte("abc"), 300))
+	assert.Nil(err)
+	err = ds.Set(key2, newCacheableHTTPCache([]byte("abc"), 300))
+	assert.Nil(err)
+	assert.Equal(2, len(ds.files))
+	ds.maxSize = ds.size - 1
+	ds.evict()
+	assert.Equal(1, len(ds.files))
+	_, ok := ds.files[ds.getFileName(key2)]
+	assert.True(ok)
+}
+
+func TestDiskStoreEvictLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+	path, err := ioutil.TempDir("", "pike")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	ds, err := newDiskStore(path, 0)
+	assert.Nil(err)
+	key1 := []byte("key1")
+	key2 := []byte("key2")
+	err = ds.Set(key1, newCacheableHTTPCache([]byte("abc"), 300))
+	assert.Nil(err)
+	err = ds.Set(key2, newCacheableHTTPCache([]byte("abc"), 300))
+	assert.Nil(err)
+
+	// 读取后key1为最近使用，淘汰时删除key2
+	hc, err := ds.Get(key1)
+	assert.Nil(err)
+	assert.NotNil(hc)
+
+	// 重新加载后仍按访问时间淘汰
+	ds, err = newDiskStore(path, 0)
+	assert.Nil(err)
+	ds.maxSize = ds.size - 1
+	ds.evict()
+	assert.Equal(1, len(ds.files))
+	_, ok := ds.files[ds.getFileName(key1)]
+	assert.True(ok)
+}
@@ -21,52 +21,144 @@
 // SOFTWARE.
 
 // 创建缓存分发组件，初始化时创建128长度的lru缓存数组，每次根据缓存的key生成hash，
-// 根据hash的值判断使用对应的lru，减少锁的冲突，提升性能
+// 根据hash的值判断使用对应的lru，减少锁的冲突，提升性能。
+// 如果设置了最大内存，则每个lru根据缓存数据的字节数淘汰，而非根据缓存数量
 
 package cache
 
 import (
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/golang/groupcache/lru"
+	"github.com/vicanso/pike/config"
+	"github.com/vicanso/pike/log"
 	"github.com/vicanso/pike/util"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 // defaultZoneSize default zone size
-const defaultZoneSize = 128
+const defaultZoneSize = config.CacheZoneSize
+
+// defaultMaxVariants default max variants of url
+const defaultMaxVariants = 10
 
 type (
 	// httpLRUCache http lru cache
 	httpLRUCache struct {
 		cache *lru.Cache
 		mu    *sync.Mutex
+		// 当前缓存占用的字节数
+		bytes uint64
+		// 最大的字节数，0表示不限制
+		maxBytes uint64
+		// 缓存的key列表，用于遍历缓存（不影响lru的顺序）
+		keys map[string]*httpCache
+		// tag对应的缓存key列表
+		tags map[string]map[string]struct{}
 	}
 	// dispatcher http cache dispatcher
 	dispatcher struct {
-		zoneSize   uint64
-		hitForPass int
-		list       []*httpLRUCache
+		zoneSize      uint64
+		hitForPass    int
+		maxObjectSize int
+		maxVariants   int
+		list          []*httpLRUCache
+		// 二级缓存存储（磁盘），为空表示仅使用内存缓存
+		store *diskStore
+		// 合并相同key并发的磁盘加载
+		loading *singleflight.Group
+	}
+	// httpCacheEntry the key and http cache
+	httpCacheEntry struct {
+		key string
+		hc  *httpCache
 	}
 	// dispatchers http cache dispatchers
 	dispatchers struct {
 		m *sync.Map
 	}
+	// DispatcherStats the stats of dispatcher
+	DispatcherStats struct {
+		Name string
+		// 内存中的缓存数量
+		Len int
+		// 内存中缓存占用的字节数
+		Bytes uint64
+	}
 	// DispatcherOption dispatcher option
 	DispatcherOption struct {
 		Name       string
 		Size       int
 		HitForPass int
+		// 缓存存储方式，memory或disk
+		Store string
+		// 磁盘缓存的目录
+		Path string
+		// 磁盘缓存最大尺寸
+		MaxDiskSize uint64
+		// 最大内存
+		MaxMemory uint64
+		// 单个缓存的最大尺寸，超过则不缓存，设置了最大内存时不超过每个zone的最大内存
+		MaxObjectSize int
+		// 每个url根据Vary生成的最大缓存数
+		MaxVariants int
 	}
 )
 
-func newHTTPLRUCache(size int) *httpLRUCache {
+func newHTTPLRUCache(size int, maxBytes uint64) *httpLRUCache {
 	c := &httpLRUCache{
-		cache: lru.New(size),
-		mu:    &sync.Mutex{},
+		cache:    lru.New(size),
+		mu:       &sync.Mutex{},
+		maxBytes: maxBytes,
+		keys:     make(map[string]*httpCache),
+		tags:     make(map[string]map[string]struct{}),
+	}
+	// 淘汰或删除时，减去其占用的字节数并删除索引
+	c.cache.OnEvicted = func(k lru.Key, value interface{}) {
+		key, _ := k.(string)
+		delete(c.keys, key)
+		if hc, ok := value.(*httpCache); ok {
+			c.bytes -= hc.bytes
+			c.removeTags(key, hc.tags)
+			// Vary缓存被淘汰时，从基础缓存中删除，避免超出最大数量后一直pass
+			if base := hc.getBase(); base != nil {
+				base.RemoveVariant(key)
+			}
+		}
 	}
 	return c
 }
 
+// addTags add the tags of key to index
+func (lru *httpLRUCache) addTags(key string, tags []string) {
+	for _, tag := range tags {
+		keys, ok := lru.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			lru.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// removeTags remove the tags of key from index
+func (lru *httpLRUCache) removeTags(key string, tags []string) {
+	for _, tag := range tags {
+		keys, ok := lru.tags[tag]
+		if !ok {
+			continue
+		}
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(lru.tags, tag)
+		}
+	}
+}
+
 // getCache get http cache by key
 func (lru *httpLRUCache) getCache(key []byte) (*httpCache, bool) {
 	value, ok := lru.cache.Get(byteSliceToString(key))
@@ -81,7 +173,74 @@ func (lru *httpLRUCache) getCache(key []byte) (*httpCache, bool) {
 
 // addCache add http cache by key
 func (lru *httpLRUCache) addCache(key []byte, hc *httpCache) {
-	lru.cache.Add(byteSliceToString(key), hc)
+	k := byteSliceToString(key)
+	lru.cache.Add(k, hc)
+	lru.keys[k] = hc
+	hc.bytes = uint64(len(key) + hc.responseSize())
+	lru.bytes += hc.bytes
+	hc.tags = hc.responseTags()
+	lru.addTags(k, hc.tags)
+	lru.evict()
+}
+
+// update update the bytes and tags of http cache, it should be called after the response of http cache changed
+func (lru *httpLRUCache) update(key []byte, hc *httpCache) {
+	k := byteSliceToString(key)
+	value, ok := lru.cache.Get(k)
+	// 如果已被淘汰或者已替换为新的缓存，则忽略
+	if !ok || value != hc {
+		return
+	}
+	lru.bytes -= hc.bytes
+	hc.bytes = uint64(len(key) + hc.responseSize())
+	lru.bytes += hc.bytes
+	lru.removeTags(k, hc.tags)
+	hc.tags = hc.responseTags()
+	lru.addTags(k, hc.tags)
+	lru.evict()
+}
+
+// getKeys get the keys which match the function
+func (lru *httpLRUCache) getKeys(match func(key string) bool) []string {
+	keys := make([]string, 0)
+	for key := range lru.keys {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// getEntries get all the http caches of lru
+func (lru *httpLRUCache) getEntries() []httpCacheEntry {
+	entries := make([]httpCacheEntry, 0, len(lru.keys))
+	for key, hc := range lru.keys {
+		entries = append(entries, httpCacheEntry{
+			key: key,
+			hc:  hc,
+		})
+	}
+	return entries
+}
+
+// getTagKeys get the keys of tag
+func (lru *httpLRUCache) getTagKeys(tag string) []string {
+	keys := make([]string, 0, len(lru.tags[tag]))
+	for key := range lru.tags[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// evict remove the oldest http cache until the bytes is less than max bytes
+func (lru *httpLRUCache) evict() {
+	if lru.maxBytes == 0 {
+		return
+	}
+	// 至少保留最新的缓存
+	for lru.bytes > lru.maxBytes && lru.cache.Len() > 1 {
+		lru.cache.RemoveOldest()
+	}
 }
 
 // removeCache remove http cache by key
@@ -91,25 +250,107 @@ func (lru *httpLRUCache) removeCache(key []byte) {
 
 // NewDispatcher new a http cache dispatcher
 func NewDispatcher(size, hitForPass int) *dispatcher {
+	return newDispatcher(DispatcherOption{
+		Size:       size,
+		HitForPass: hitForPass,
+	})
+}
+
+// newDispatcher new a http cache dispatcher by option
+func newDispatcher(opt DispatcherOption) *dispatcher {
 	zoneSize := defaultZoneSize
-	if size <= 0 {
+	size := opt.Size
+	// 如果未设置最大内存，则根据缓存数量淘汰
+	if size <= 0 && opt.MaxMemory == 0 {
 		size = zoneSize * 100
 	}
 
 	// 按zoneSize与size创建二维缓存，存放的是LRU缓存实例
 	lruSize := size / zoneSize
+	maxBytes := opt.MaxMemory / uint64(zoneSize)
+	if opt.MaxMemory != 0 && maxBytes == 0 {
+		maxBytes = 1
+	}
 	list := make([]*httpLRUCache, zoneSize)
 	// 根据zone size生成一个缓存对列
 	for i := 0; i < zoneSize; i++ {
-		list[i] = newHTTPLRUCache(lruSize)
+		list[i] = newHTTPLRUCache(lruSize, maxBytes)
+	}
+	// 最大内存平均分配至各个zone，单个缓存的尺寸不能超过zone的最大内存
+	maxObjectSize := opt.MaxObjectSize
+	if maxBytes != 0 && (maxObjectSize <= 0 || uint64(maxObjectSize) > maxBytes) {
+		maxObjectSize = int(maxBytes)
 	}
-	return &dispatcher{
-		zoneSize:   uint64(zoneSize),
-		list:       list,
-		hitForPass: hitForPass,
+	maxVariants := opt.MaxVariants
+	if maxVariants <= 0 {
+		maxVariants = defaultMaxVariants
+	}
+	d := &dispatcher{
+		zoneSize:      uint64(zoneSize),
+		list:          list,
+		hitForPass:    opt.HitForPass,
+		maxObjectSize: maxObjectSize,
+		maxVariants:   maxVariants,
+		loading:       &singleflight.Group{},
+	}
+	if opt.Store != StoreDisk {
+		return d
+	}
+	store, err := newDiskStore(opt.Path, opt.MaxDiskSize)
+	// 如果磁盘缓存初始化失败，则仅使用内存缓存
+	if err != nil {
+		log.Default().Error("new disk store fail",
+			zap.String("name", opt.Name),
+			zap.String("path", opt.Path),
+			zap.Error(err),
+		)
+		return d
+	}
+	d.store = store
+	return d
+}
+
+// bind update the bytes of lru and save the http cache to store when it's cacheable
+func (d *dispatcher) bind(key []byte, hc *httpCache) {
+	// key有可能被复用，因此复制一份
+	k := make([]byte, len(key))
+	copy(k, key)
+	hc.onCacheable = func(hc *httpCache) {
+		lru := d.getLRU(k)
+		lru.mu.Lock()
+		lru.update(k, hc)
+		lru.mu.Unlock()
+		if d.store == nil {
+			return
+		}
+		go func() {
+			err := d.store.Set(k, hc)
+			if err != nil {
+				log.Default().Error("save http cache to disk fail",
+					zap.String("key", string(k)),
+					zap.Error(err),
+				)
+			}
+		}()
 	}
 }
 
+// loadFromStore load http cache from store
+func (d *dispatcher) loadFromStore(key []byte) *httpCache {
+	if d.store == nil {
+		return nil
+	}
+	hc, err := d.store.Get(key)
+	if err != nil {
+		log.Default().Error("load http cache from disk fail",
+			zap.String("key", string(key)),
+			zap.Error(err),
+		)
+		return nil
+	}
+	return hc
+}
+
 func (d *dispatcher) getLRU(key []byte) *httpLRUCache {
 	// 计算hash值
 	index := MemHash(key) % d.zoneSize
@@ -122,22 +363,140 @@ func (d *dispatcher) GetHTTPCache(key []byte) *httpCache {
 	// 锁只在public的方法在使用，public方法之间不互相调用
 	lru := d.getLRU(key)
 	lru.mu.Lock()
-	defer lru.mu.Unlock()
 	hc, ok := lru.getCache(key)
+	if ok || d.store == nil {
+		if !ok {
+			hc = NewHTTPCache()
+			d.bind(key, hc)
+			lru.addCache(key, hc)
+		}
+		lru.mu.Unlock()
+		return hc
+	}
+	lru.mu.Unlock()
+
+	// 内存中不存在时，尝试从磁盘中加载
+	// 加载时不持有锁，避免阻塞同一lru的其它请求，相同key的并发加载只执行一次
+	value, _, _ := d.loading.Do(string(key), func() (interface{}, error) {
+		return d.loadFromStore(key), nil
+	})
+
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	// 加载期间有可能其它请求已添加
+	hc, ok = lru.getCache(key)
 	if ok {
 		return hc
 	}
-	hc = NewHTTPCache()
+	hc, _ = value.(*httpCache)
+	if hc == nil {
+		hc = NewHTTPCache()
+	}
+	d.bind(key, hc)
 	lru.addCache(key, hc)
 	return hc
 }
 
+// GetVariantHTTPCache get the http cache of variant, the key of variant will be
+// removed from base http cache when it's evicted
+func (d *dispatcher) GetVariantHTTPCache(base *httpCache, key []byte) *httpCache {
+	hc := d.GetHTTPCache(key)
+	hc.setBase(base)
+	return hc
+}
+
 // RemoveHTTPCache remove http cache
 func (d *dispatcher) RemoveHTTPCache(key []byte) {
 	lru := d.getLRU(key)
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
 	lru.removeCache(key)
+	if d.store != nil {
+		d.store.Remove(key)
+	}
+}
+
+// purge remove the http caches of keys which get from function, it returns the purged keys.
+// If soft is true, the http caches will be set expired instead of removed.
+func (d *dispatcher) purge(getKeys func(lru *httpLRUCache) []string, soft bool) map[string]struct{} {
+	result := make(map[string]struct{})
+	// 每次只锁一个lru，避免长时间锁住所有缓存
+	for _, lru := range d.list {
+		lru.mu.Lock()
+		keys := getKeys(lru)
+		for _, key := range keys {
+			if !soft {
+				lru.cache.Remove(key)
+				result[key] = struct{}{}
+				continue
+			}
+			// 软删除只设置有缓存数据的为过期，其它状态的不处理
+			if hc := lru.keys[key]; hc != nil && hc.SoftPurge() {
+				result[key] = struct{}{}
+			}
+		}
+		lru.mu.Unlock()
+	}
+	return result
+}
+
+// purgeStore remove the http caches of store which match the function, and add the keys to result
+func (d *dispatcher) purgeStore(result map[string]struct{}, match func(key string, tags []string) bool, soft bool) {
+	if d.store == nil {
+		return
+	}
+	for _, key := range d.store.Purge(match, soft) {
+		result[key] = struct{}{}
+	}
+}
+
+// SoftRemoveHTTPCache set the http cache expired but keep the response for stale serving
+func (d *dispatcher) SoftRemoveHTTPCache(key []byte) {
+	lru := d.getLRU(key)
+	lru.mu.Lock()
+	if hc := lru.keys[byteSliceToString(key)]; hc != nil {
+		hc.SoftPurge()
+	}
+	lru.mu.Unlock()
+	if d.store != nil {
+		_ = d.store.expire(d.store.getFileName(key))
+	}
+}
+
+// PurgeByPrefix purge the http caches which key has the prefix, it returns the count of purged caches
+func (d *dispatcher) PurgeByPrefix(prefix string, soft bool) int {
+	match := func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}
+	result := d.purge(func(lru *httpLRUCache) []string {
+		return lru.getKeys(match)
+	}, soft)
+	d.purgeStore(result, func(key string, _ []string) bool {
+		return match(key)
+	}, soft)
+	return len(result)
+}
+
+// PurgeByRegexp purge the http caches which key matches the regexp, it returns the count of purged caches
+func (d *dispatcher) PurgeByRegexp(reg *regexp.Regexp, soft bool) int {
+	result := d.purge(func(lru *httpLRUCache) []string {
+		return lru.getKeys(reg.MatchString)
+	}, soft)
+	d.purgeStore(result, func(key string, _ []string) bool {
+		return reg.MatchString(key)
+	}, soft)
+	return len(result)
+}
+
+// PurgeByTag purge the http caches which has the tag, it returns the count of purged caches
+func (d *dispatcher) PurgeByTag(tag string, soft bool) int {
+	result := d.purge(func(lru *httpLRUCache) []string {
+		return lru.getTagKeys(tag)
+	}, soft)
+	d.purgeStore(result, func(_ string, tags []string) bool {
+		return containsString(tags, tag)
+	}, soft)
+	return len(result)
 }
 
 // GetHitForPass get hit for pass
@@ -145,13 +504,109 @@ func (d *dispatcher) GetHitForPass() int {
 	return d.hitForPass
 }
 
+// GetMaxVariants get max variants of url
+func (d *dispatcher) GetMaxVariants() int {
+	return d.maxVariants
+}
+
+// IsStorable check the http response is storable, it will return false if the size of response is bigger than max object size
+func (d *dispatcher) IsStorable(resp *HTTPResponse) bool {
+	if d.maxObjectSize <= 0 {
+		return true
+	}
+	return resp.Size() <= d.maxObjectSize
+}
+
+// getEntries get all the http caches of dispatcher, sorted by key
+func (d *dispatcher) getEntries() []httpCacheEntry {
+	entries := make([]httpCacheEntry, 0)
+	// 每次只锁一个lru，复制后再处理，避免长时间锁住所有缓存
+	for _, lru := range d.list {
+		lru.mu.Lock()
+		entries = append(entries, lru.getEntries()...)
+		lru.mu.Unlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
+
+// GetHTTPCacheInfos get the information of http caches in memory,
+// it returns the count of all caches and the information of caches in [offset, offset+limit)
+func (d *dispatcher) GetHTTPCacheInfos(offset, limit int) (int, []*HTTPCacheInfo) {
+	entries := d.getEntries()
+	count := len(entries)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > count {
+		offset = count
+	}
+	end := count
+	if limit > 0 && offset+limit < count {
+		end = offset + limit
+	}
+	infos := make([]*HTTPCacheInfo, 0, end-offset)
+	for _, item := range entries[offset:end] {
+		info := item.hc.GetInfo()
+		info.Key = item.key
+		infos = append(infos, info)
+	}
+	return count, infos
+}
+
+// GetStatusCounts get the count of http caches in memory for each status
+func (d *dispatcher) GetStatusCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, item := range d.getEntries() {
+		counts[item.hc.GetInfo().Status]++
+	}
+	return counts
+}
+
+// PeekHTTPCache get the http cache by key, it doesn't create the http cache or
+// change the order of lru. If it's not in memory, it will be loaded from store.
+func (d *dispatcher) PeekHTTPCache(key []byte) *httpCache {
+	lru := d.getLRU(key)
+	lru.mu.Lock()
+	hc := lru.keys[byteSliceToString(key)]
+	lru.mu.Unlock()
+	if hc != nil {
+		return hc
+	}
+	return d.loadFromStore(key)
+}
+
+// GetLen get the count of all http cache in memory
+func (d *dispatcher) GetLen() int {
+	count := 0
+	for _, lru := range d.list {
+		lru.mu.Lock()
+		count += lru.cache.Len()
+		lru.mu.Unlock()
+	}
+	return count
+}
+
+// GetBytes get the bytes of all http cache in memory
+func (d *dispatcher) GetBytes() uint64 {
+	var bytes uint64
+	for _, lru := range d.list {
+		lru.mu.Lock()
+		bytes += lru.bytes
+		lru.mu.Unlock()
+	}
+	return bytes
+}
+
 // NewDispatchers new dispatchers
 func NewDispatchers(opts []DispatcherOption) *dispatchers {
 	ds := &dispatchers{
 		m: &sync.Map{},
 	}
 	for _, opt := range opts {
-		ds.m.Store(opt.Name, NewDispatcher(opt.Size, opt.HitForPass))
+		ds.m.Store(opt.Name, newDispatcher(opt))
 	}
 	return ds
 }
@@ -169,6 +624,76 @@ func (ds *dispatchers) Get(name string) *dispatcher {
 	return d
 }
 
+// purge purge the http caches of dispatcher, if the name is empty, all dispatchers will be purged
+func (ds *dispatchers) purge(name string, fn func(d *dispatcher) int) int {
+	if name != "" {
+		d := ds.Get(name)
+		if d == nil {
+			return 0
+		}
+		return fn(d)
+	}
+	count := 0
+	ds.m.Range(func(_, v interface{}) bool {
+		d, ok := v.(*dispatcher)
+		if ok {
+			count += fn(d)
+		}
+		return true
+	})
+	return count
+}
+
+// PurgeByPrefix purge the http caches which key has the prefix
+func (ds *dispatchers) PurgeByPrefix(name, prefix string, soft bool) int {
+	return ds.purge(name, func(d *dispatcher) int {
+		return d.PurgeByPrefix(prefix, soft)
+	})
+}
+
+// PurgeByRegexp purge the http caches which key matches the regexp
+func (ds *dispatchers) PurgeByRegexp(name string, reg *regexp.Regexp, soft bool) int {
+	return ds.purge(name, func(d *dispatcher) int {
+		return d.PurgeByRegexp(reg, soft)
+	})
+}
+
+// PurgeByTag purge the http caches which has the tag
+func (ds *dispatchers) PurgeByTag(name, tag string, soft bool) int {
+	return ds.purge(name, func(d *dispatcher) int {
+		return d.PurgeByTag(tag, soft)
+	})
+}
+
+// SoftRemoveHTTPCache set the http cache expired but keep the response
+func (ds *dispatchers) SoftRemoveHTTPCache(name string, key []byte) {
+	ds.purge(name, func(d *dispatcher) int {
+		d.SoftRemoveHTTPCache(key)
+		return 0
+	})
+}
+
+// GetStats get the stats of all dispatchers
+func (ds *dispatchers) GetStats() []DispatcherStats {
+	result := make([]DispatcherStats, 0)
+	ds.m.Range(func(k, v interface{}) bool {
+		name, _ := k.(string)
+		d, ok := v.(*dispatcher)
+		if ok {
+			result = append(result, DispatcherStats{
+				Name:  name,
+				Len:   d.GetLen(),
+				Bytes: d.GetBytes(),
+			})
+		}
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
 // RemoveHTTPCache remove http cache
 func (ds *dispatchers) RemoveHTTPCache(name string, key []byte) {
 	if name != "" {
@@ -209,7 +734,7 @@ func (ds *dispatchers) Reset(opts []DispatcherOption) {
 		// 如果当前dispatcher不存在，则创建
 		// 如果存在，对原来的size不调整
 		if !ok {
-			ds.m.Store(opt.Name, NewDispatcher(opt.Size, opt.HitForPass))
+			ds.m.Store(opt.Name, newDispatcher(opt))
 		}
 	}
 }
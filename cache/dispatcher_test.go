@@ -23,14 +23,21 @@
 package cache
 
 import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestLRUGetCache(t *testing.T) {
 	assert := assert.New(t)
-	httpLRU := newHTTPLRUCache(10)
+	httpLRU := newHTTPLRUCache(10, 0)
 	key := []byte("abcd")
 	c, ok := httpLRU.getCache(key)
 	assert.False(ok)
@@ -64,6 +71,224 @@ func TestDispatcher(t *testing.T) {
 	assert.Empty(hc.createdAt)
 }
 
+func TestLRUEvictByBytes(t *testing.T) {
+	assert := assert.New(t)
+	httpLRU := newHTTPLRUCache(0, 100)
+	key1 := []byte("key1")
+	hc1 := NewHTTPCache()
+	httpLRU.addCache(key1, hc1)
+	assert.Equal(uint64(len(key1)), httpLRU.bytes)
+
+	key2 := []byte("key2")
+	hc2 := NewHTTPCache()
+	httpLRU.addCache(key2, hc2)
+	assert.Equal(uint64(len(key1)+len(key2)), httpLRU.bytes)
+
+	// 缓存数据后更新字节数，超出最大字节数则淘汰最旧的缓存
+	hc2.response = &HTTPResponse{
+		RawBody: make([]byte, 95),
+	}
+	httpLRU.update(key2, hc2)
+	assert.Equal(uint64(len(key2)+95), httpLRU.bytes)
+	assert.Equal(1, httpLRU.cache.Len())
+	_, ok := httpLRU.getCache(key1)
+	assert.False(ok)
+
+	httpLRU.removeCache(key2)
+	assert.Equal(uint64(0), httpLRU.bytes)
+}
+
+func TestDispatcherMaxObjectSize(t *testing.T) {
+	assert := assert.New(t)
+	d := newDispatcher(DispatcherOption{
+		MaxMemory:     1024 * 1024,
+		MaxObjectSize: 10,
+	})
+	assert.True(d.IsStorable(&HTTPResponse{
+		RawBody: []byte("abc"),
+	}))
+	assert.False(d.IsStorable(&HTTPResponse{
+		RawBody: []byte("Hello world!"),
+	}))
+
+	key := []byte("key")
+	hc := d.GetHTTPCache(key)
+	assert.Equal(uint64(len(key)), d.GetBytes())
+	hc.Cacheable(&HTTPResponse{
+		RawBody: []byte("abc"),
+	}, 300)
+	assert.Equal(uint64(len(key)+3), d.GetBytes())
+
+	// 单个缓存的最大尺寸不超过zone的最大内存
+	d = newDispatcher(DispatcherOption{
+		MaxMemory: 128 * 10,
+	})
+	assert.Equal(10, d.maxObjectSize)
+	d = newDispatcher(DispatcherOption{
+		MaxMemory:     128 * 10,
+		MaxObjectSize: 100,
+	})
+	assert.Equal(10, d.maxObjectSize)
+}
+
+func TestDispatcherWithDiskStore(t *testing.T) {
+	assert := assert.New(t)
+	path, err := ioutil.TempDir("", "pike")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	opt := DispatcherOption{
+		Size:  100,
+		Store: StoreDisk,
+		Path:  path,
+	}
+	d := newDispatcher(opt)
+	assert.NotNil(d.store)
+
+	key := []byte("key")
+	hc := d.GetHTTPCache(key)
+	status, _ := hc.Get()
+	assert.Equal(StatusFetching, status)
+	hc.Cacheable(&HTTPResponse{
+		StatusCode: 200,
+		RawBody:    []byte("Hello world!"),
+	}, 300)
+	// 保存至磁盘为异步处理
+	for i := 0; i < 100 && d.store.Size() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(uint64(0), d.store.Size())
+
+	// 重新创建dispatcher，缓存从磁盘中加载，并发获取时返回相同的缓存
+	d = newDispatcher(opt)
+	wg := sync.WaitGroup{}
+	caches := make([]*httpCache, 10)
+	for i := range caches {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			caches[index] = d.GetHTTPCache(key)
+		}(i)
+	}
+	wg.Wait()
+	hc = caches[0]
+	for _, item := range caches {
+		assert.Same(hc, item)
+	}
+	status, resp := hc.Get()
+	assert.Equal(StatusHit, status)
+	assert.Equal([]byte("Hello world!"), resp.RawBody)
+
+	d.RemoveHTTPCache(key)
+	assert.Equal(uint64(0), d.store.Size())
+}
+
+func TestDispatcherPurge(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDispatcher(100, 300)
+
+	for _, key := range []string{
+		"GET example.com /api/users/1",
+		"GET example.com /api/users/2",
+		"GET example.com /api/products/1",
+	} {
+		d.GetHTTPCache([]byte(key)).Cacheable(&HTTPResponse{
+			Header: http.Header{
+				"Surrogate-Key": []string{"api " + strings.Split(key, "/")[2]},
+			},
+			RawBody: []byte("abc"),
+		}, 300)
+	}
+
+	assert.Equal(2, d.PurgeByPrefix("GET example.com /api/users/", false))
+	assert.Equal(0, d.PurgeByPrefix("GET example.com /api/users/", false))
+	assert.Equal(1, d.PurgeByTag("api", false))
+	assert.Equal(0, d.PurgeByTag("api", false))
+
+	d.GetHTTPCache([]byte("GET example.com /api/users/1")).Cacheable(&HTTPResponse{
+		RawBody: []byte("abc"),
+	}, 300)
+	assert.Equal(0, d.PurgeByRegexp(regexp.MustCompile(`products`), false))
+	assert.Equal(1, d.PurgeByRegexp(regexp.MustCompile(`/users/\d+$`), false))
+	assert.Equal(uint64(0), d.GetBytes())
+}
+
+func TestDispatcherSoftPurge(t *testing.T) {
+	assert := assert.New(t)
+	path, err := ioutil.TempDir("", "pike")
+	assert.Nil(err)
+	defer os.RemoveAll(path)
+
+	opt := DispatcherOption{
+		Size:  100,
+		Store: StoreDisk,
+		Path:  path,
+	}
+	d := newDispatcher(opt)
+	key := []byte("GET example.com /api/users/1")
+	hc := d.GetHTTPCache(key)
+	hc.Get()
+	hc.Cacheable(&HTTPResponse{
+		StatusCode: 200,
+		RawBody:    []byte("abc"),
+	}, 300)
+	for i := 0; i < 100 && d.store.Size() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// hit for pass的缓存不受影响
+	d.GetHTTPCache([]byte("GET example.com /api/users/2")).HitForPass(300)
+
+	assert.Equal(1, d.PurgeByPrefix("GET example.com /api/users/", true))
+	status, resp := hc.Get()
+	assert.Equal(StatusStale, status)
+	assert.Equal([]byte("abc"), resp.RawBody)
+	assert.True(hc.StartRevalidating())
+
+	// 磁盘中的缓存也设置为过期
+	d = newDispatcher(opt)
+	status, resp = d.GetHTTPCache(key).Get()
+	assert.Equal(StatusStale, status)
+	assert.Equal([]byte("abc"), resp.RawBody)
+
+	d.SoftRemoveHTTPCache(key)
+	status, _ = d.GetHTTPCache(key).Get()
+	assert.Equal(StatusStale, status)
+}
+
+func TestDispatcherGetHTTPCacheInfos(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDispatcher(100, 300)
+
+	for _, key := range []string{"c", "a", "b"} {
+		d.GetHTTPCache([]byte(key)).Cacheable(&HTTPResponse{
+			RawBody: []byte("abc"),
+		}, 300)
+	}
+	d.GetHTTPCache([]byte("d")).HitForPass(300)
+
+	count, infos := d.GetHTTPCacheInfos(1, 2)
+	assert.Equal(4, count)
+	assert.Equal(2, len(infos))
+	assert.Equal("b", infos[0].Key)
+	assert.Equal("c", infos[1].Key)
+	assert.Equal("hit", infos[0].Status)
+
+	count, infos = d.GetHTTPCacheInfos(10, 2)
+	assert.Equal(4, count)
+	assert.Empty(infos)
+
+	assert.Equal(map[string]int{
+		"hit":        3,
+		"hitForPass": 1,
+	}, d.GetStatusCounts())
+
+	assert.NotNil(d.PeekHTTPCache([]byte("a")))
+	assert.Nil(d.PeekHTTPCache([]byte("e")))
+	// peek不会创建缓存
+	count, _ = d.GetHTTPCacheInfos(0, 0)
+	assert.Equal(4, count)
+}
+
 func TestDispatchers(t *testing.T) {
 	assert := assert.New(t)
 	name1 := "test1"
@@ -104,4 +329,28 @@ func TestDispatchers(t *testing.T) {
 	hc1 := ds.Get(name2).GetHTTPCache(key)
 	assert.Empty(hc1.createdAt)
 
+	stats := ds.GetStats()
+	assert.Equal(1, len(stats))
+	assert.Equal(name2, stats[0].Name)
+	assert.Equal(1, stats[0].Len)
+	assert.Equal(uint64(len(key)), stats[0].Bytes)
+
+}
+
+func TestDispatcherVariantEvicted(t *testing.T) {
+	assert := assert.New(t)
+	d := newDispatcher(DispatcherOption{
+		Size: 128 * 10,
+	})
+	baseKey := []byte("base")
+	variantKey := []byte("base lang=en")
+	base := d.GetHTTPCache(baseKey)
+	base.SetVary([]string{"Accept-Language"})
+	assert.True(base.AddVariant(string(variantKey), 1))
+	d.GetVariantHTTPCache(base, variantKey)
+	assert.False(base.AddVariant("base lang=zh", 1))
+
+	// vary缓存删除后，从基础缓存中删除
+	d.RemoveHTTPCache(variantKey)
+	assert.True(base.AddVariant("base lang=zh", 1))
 }
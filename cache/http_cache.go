@@ -22,11 +22,14 @@
 
 // 针对同一个请求，在状态未知时，控制只允许一个请求转发至后续流程
 // 在获取状态之后，支持hit for pass 与 hit 两种处理，其中hit for pass表示该请求不可缓存，
-// 直接转发至后端程序，而hit则返回当前缓存的响应数据
+// 直接转发至后端程序，而hit则返回当前缓存的响应数据。
+// 如果缓存设置了stale-while-revalidate，过期后的一段时间内返回stale，使用过期数据响应并后台更新，
+// 如果设置了stale-if-error，则在更新缓存出错时，可使用过期数据响应
 
 package cache
 
 import (
+	"strings"
 	"sync"
 	"time"
 
@@ -46,11 +49,19 @@ const (
 	StatusHit
 	// StatusPassed pass status
 	StatusPassed
+	// StatusStale stale status
+	StatusStale
 )
 
 // defaultHitForPassSeconds default hit for pass: 300 seconds
 const defaultHitForPassSeconds = 300
 
+// revalidateFailBackoffSeconds the backoff of revalidating after fail: 5 seconds
+const revalidateFailBackoffSeconds = 5
+
+// encodingIdentity the encoding of raw body
+const encodingIdentity = "identity"
+
 type (
 	// httpCache http cache (only for same request method+host+uri)
 	httpCache struct {
@@ -60,6 +71,44 @@ type (
 		response  *HTTPResponse
 		createdAt int
 		expiredAt int
+		// 过期后可继续使用（后台更新）的截止时间
+		staleWhileRevalidateUntil int
+		// 更新出错时可继续使用的截止时间
+		staleIfErrorUntil int
+		// 是否正在后台更新
+		revalidating bool
+		// 后台更新失败的时间，失败后一段时间内不再后台更新
+		revalidateFailedAt int
+		// 响应的Vary，设置后该缓存仅用于记录Vary，
+		// 响应数据根据请求头保存至对应的缓存中
+		vary []string
+		// 已生成的Vary缓存的key
+		variants map[string]struct{}
+		// Vary缓存所属的基础缓存，淘汰时从基础缓存的variants中删除
+		base *httpCache
+		// 设置为可缓存后的回调，如保存至磁盘
+		onCacheable func(*httpCache)
+		// 在lru中所占用的字节数，仅在lru的锁中读写
+		bytes uint64
+		// 在lru中记录的tag，仅在lru的锁中读写
+		tags []string
+	}
+	// HTTPCacheInfo the information of http cache
+	HTTPCacheInfo struct {
+		Key       string `json:"key"`
+		Status    string `json:"status"`
+		CreatedAt int    `json:"createdAt,omitempty"`
+		ExpiredAt int    `json:"expiredAt,omitempty"`
+		// 缓存的时长
+		Age int `json:"age"`
+		// 剩余的有效期
+		TTL int `json:"ttl"`
+		// 保存的数据编码：identity、gzip、br
+		Encodings []string `json:"encodings,omitempty"`
+		// 各编码数据的尺寸
+		Sizes map[string]int `json:"sizes,omitempty"`
+		// 缓存占用的尺寸
+		Size int `json:"size"`
 	}
 )
 
@@ -77,6 +126,8 @@ func (i Status) String() string {
 		return "hit"
 	case StatusPassed:
 		return "passed"
+	case StatusStale:
+		return "stale"
 	default:
 		return "unknown"
 	}
@@ -109,11 +160,17 @@ func (hc *httpCache) Get() (status Status, response *HTTPResponse) {
 
 func (hc *httpCache) get() (status Status, done chan struct{}, data *HTTPResponse) {
 	now := nowUnix()
-	// 如果缓存已过期，设置为StatusUnknown
 	if hc.expiredAt != 0 && hc.expiredAt < now {
-		hc.status = StatusUnknown
-		// 将有效期重置（若不重置则导致hs.status每次都被重置为Unknown)
-		hc.expiredAt = 0
+		isCached := hc.status == StatusHit || hc.status == StatusStale
+		if isCached && hc.response != nil && now <= hc.staleWhileRevalidateUntil {
+			// 如果在stale-while-revalidate的时间内，则使用过期数据
+			hc.status = StatusStale
+		} else {
+			// 如果缓存已过期，设置为StatusUnknown
+			hc.status = StatusUnknown
+			// 将有效期重置（若不重置则导致hs.status每次都被重置为Unknown)
+			hc.expiredAt = 0
+		}
 	}
 
 	// 仅有同类请求为fetching，才会需要等待
@@ -133,12 +190,119 @@ func (hc *httpCache) get() (status Status, done chan struct{}, data *HTTPRespons
 	// 为什么需要返回status与data
 	// 因为有可能在函数调用完成后，刚好缓存过期了，如果此时不返回status与data
 	// 当其它goroutine获取锁之后，有可能刚好重置数据
-	if status == StatusHit {
+	if status == StatusHit || status == StatusStale {
 		data = hc.response
 	}
 	return
 }
 
+// Peek get the fresh cached response without fetching, it is used for the request
+// which response shouldn't be cached(e.g.: range request), the status is passed
+// if there is no fresh cached response
+func (hc *httpCache) Peek() (status Status, response *HTTPResponse) {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	if hc.status == StatusHit &&
+		hc.response != nil &&
+		(hc.expiredAt == 0 || hc.expiredAt >= nowUnix()) {
+		return StatusHit, hc.response
+	}
+	return StatusPassed, nil
+}
+
+// StartRevalidating start revalidating the stale http cache,
+// it will return false if the http cache isn't stale, is revalidating
+// or the last revalidating failed in backoff
+func (hc *httpCache) StartRevalidating() bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.status != StatusStale || hc.revalidating {
+		return false
+	}
+	// 更新失败后，避免每个请求均触发后台更新
+	if hc.revalidateFailedAt != 0 &&
+		nowUnix() < hc.revalidateFailedAt+revalidateFailBackoffSeconds {
+		return false
+	}
+	hc.revalidating = true
+	return true
+}
+
+// StopRevalidating stop revalidating, it should be called when revalidate fail
+func (hc *httpCache) StopRevalidating() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.revalidating = false
+	hc.revalidateFailedAt = nowUnix()
+}
+
+// StaleIfError get the stale response when fetch fail, it will return nil if
+// the http cache can't be used on error. The status of http cache will be set to stale
+// and the waiting requests will use the stale response too.
+func (hc *httpCache) StaleIfError() *HTTPResponse {
+	return hc.stale(true)
+}
+
+// Stale set the http cache to be stale and return the expired response even if
+// it is out of stale-if-error, it is used when the upstream is unavailable
+func (hc *httpCache) Stale() *HTTPResponse {
+	return hc.stale(false)
+}
+
+func (hc *httpCache) stale(checkStaleIfError bool) *HTTPResponse {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	now := nowUnix()
+	// hit for pass之后staleIfErrorUntil为0，过期数据不可再使用
+	if hc.response == nil ||
+		hc.staleIfErrorUntil == 0 ||
+		(checkStaleIfError && now > hc.staleIfErrorUntil) {
+		return nil
+	}
+	hc.status = StatusStale
+	// 设置为当前时间，下一秒的请求则重新获取
+	hc.expiredAt = now
+	list := hc.chanList
+	hc.chanList = nil
+	for _, ch := range list {
+		ch <- struct{}{}
+	}
+	return hc.response
+}
+
+// softExpire get the expired times of soft purge, the expired time is set to the past
+// and the response can be used as stale data until the original expired time
+func softExpire(now, expiredAt, staleWhileRevalidateUntil, staleIfErrorUntil int) (int, int, int) {
+	if expiredAt < now {
+		return expiredAt, staleWhileRevalidateUntil, staleIfErrorUntil
+	}
+	if staleWhileRevalidateUntil < expiredAt {
+		staleWhileRevalidateUntil = expiredAt
+	}
+	if staleIfErrorUntil < expiredAt {
+		staleIfErrorUntil = expiredAt
+	}
+	return now - 1, staleWhileRevalidateUntil, staleIfErrorUntil
+}
+
+// SoftPurge set the http cache expired but keep the response, the next request will
+// get the stale response and revalidate it in background. It returns false if
+// the http cache has no cacheable response.
+func (hc *httpCache) SoftPurge() bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if (hc.status != StatusHit && hc.status != StatusStale) || hc.response == nil {
+		return false
+	}
+	hc.expiredAt, hc.staleWhileRevalidateUntil, hc.staleIfErrorUntil = softExpire(
+		nowUnix(),
+		hc.expiredAt,
+		hc.staleWhileRevalidateUntil,
+		hc.staleIfErrorUntil,
+	)
+	return true
+}
+
 // HitForPass set the http cache hit for pass
 func (hc *httpCache) HitForPass(ttl int) {
 	hc.mu.Lock()
@@ -148,6 +312,11 @@ func (hc *httpCache) HitForPass(ttl int) {
 	}
 	hc.expiredAt = nowUnix() + ttl
 	hc.status = StatusHitForPass
+	// 不可缓存，过期数据也不可再使用
+	hc.staleWhileRevalidateUntil = 0
+	hc.staleIfErrorUntil = 0
+	hc.revalidating = false
+	hc.revalidateFailedAt = 0
 	list := hc.chanList
 	hc.chanList = nil
 	for _, ch := range list {
@@ -157,13 +326,21 @@ func (hc *httpCache) HitForPass(ttl int) {
 
 // Cacheable set http cache cacheable and compress it
 func (hc *httpCache) Cacheable(resp *HTTPResponse, ttl int) {
+	hc.CacheableWithStale(resp, ttl, 0, 0)
+}
+
+// CacheableWithStale set http cache cacheable with stale-while-revalidate and stale-if-error
+func (hc *httpCache) CacheableWithStale(resp *HTTPResponse, ttl, staleWhileRevalidate, staleIfError int) {
 	hc.mu.Lock()
-	defer hc.mu.Unlock()
 	// 如果是可缓存数据，则选择默认的best compression
 	resp.CompressSrv = compress.BestCompression
 	_ = resp.Compress()
 	hc.createdAt = nowUnix()
 	hc.expiredAt = hc.createdAt + ttl
+	hc.staleWhileRevalidateUntil = hc.expiredAt + staleWhileRevalidate
+	hc.staleIfErrorUntil = hc.expiredAt + staleIfError
+	hc.revalidating = false
+	hc.revalidateFailedAt = 0
 	hc.status = StatusHit
 	hc.response = resp
 	list := hc.chanList
@@ -171,6 +348,144 @@ func (hc *httpCache) Cacheable(resp *HTTPResponse, ttl int) {
 	for _, ch := range list {
 		ch <- struct{}{}
 	}
+	fn := hc.onCacheable
+	hc.mu.Unlock()
+	// 回调中会读取缓存数据，因此在释放锁之后再调用
+	if fn != nil {
+		fn(hc)
+	}
+}
+
+// GetVary get the vary of http cache
+func (hc *httpCache) GetVary() []string {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return hc.vary
+}
+
+// SetVary set the vary of http cache, the variants will be reset if vary is changed
+func (hc *httpCache) SetVary(vary []string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if strings.Join(hc.vary, ",") == strings.Join(vary, ",") {
+		return
+	}
+	hc.vary = vary
+	hc.variants = nil
+}
+
+// AddVariant add the key of variant, it will return false if the count of variants is more than max
+func (hc *httpCache) AddVariant(key string, max int) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.variants == nil {
+		hc.variants = make(map[string]struct{})
+	}
+	if _, ok := hc.variants[key]; ok {
+		return true
+	}
+	if max > 0 && len(hc.variants) >= max {
+		return false
+	}
+	hc.variants[key] = struct{}{}
+	return true
+}
+
+// RemoveVariant remove the key of variant
+func (hc *httpCache) RemoveVariant(key string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	delete(hc.variants, key)
+}
+
+// setBase set the base http cache of variant
+func (hc *httpCache) setBase(base *httpCache) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.base = base
+}
+
+// getBase get the base http cache of variant
+func (hc *httpCache) getBase() *httpCache {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return hc.base
+}
+
+// responseSize get the size of http cache's response
+func (hc *httpCache) responseSize() int {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	if hc.response == nil {
+		return 0
+	}
+	return hc.response.Size()
+}
+
+// responseTags get the tags of http cache's response
+func (hc *httpCache) responseTags() []string {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	if hc.response == nil {
+		return nil
+	}
+	return hc.response.Tags()
+}
+
+// GetInfo get the information of http cache, the status is the status which will be
+// returned by Get, but it doesn't change the status of http cache
+func (hc *httpCache) GetInfo() *HTTPCacheInfo {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	now := nowUnix()
+	info := &HTTPCacheInfo{
+		CreatedAt: hc.createdAt,
+		ExpiredAt: hc.expiredAt,
+	}
+	status := hc.status
+	if hc.expiredAt != 0 && hc.expiredAt < now {
+		isCached := status == StatusHit || status == StatusStale
+		if isCached && hc.response != nil && now <= hc.staleWhileRevalidateUntil {
+			status = StatusStale
+		} else {
+			status = StatusUnknown
+		}
+	}
+	info.Status = status.String()
+	if hc.createdAt != 0 {
+		info.Age = now - hc.createdAt
+	}
+	if hc.expiredAt > now {
+		info.TTL = hc.expiredAt - now
+	}
+	resp := hc.response
+	if resp == nil {
+		return info
+	}
+	info.Size = resp.Size()
+	info.Sizes = make(map[string]int)
+	for _, item := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{encodingIdentity, resp.RawBody},
+		{compress.EncodingGzip, resp.GzipBody},
+		{compress.EncodingBrotli, resp.BrBody},
+	} {
+		if len(item.body) == 0 {
+			continue
+		}
+		info.Encodings = append(info.Encodings, item.encoding)
+		info.Sizes[item.encoding] = len(item.body)
+	}
+	return info
+}
+
+// GetResponse get the response of http cache
+func (hc *httpCache) GetResponse() *HTTPResponse {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return hc.response
 }
 
 // Age get http cache's age
@@ -115,6 +115,27 @@ func TestHTTPCacheGetStatus(t *testing.T) {
 	assert.Equal(StatusFetching, hc.GetStatus())
 }
 
+func TestHTTPCachePeek(t *testing.T) {
+	assert := assert.New(t)
+	hc := NewHTTPCache()
+	// 未有缓存，pass且不影响其它请求获取数据
+	status, resp := hc.Peek()
+	assert.Equal(StatusPassed, status)
+	assert.Nil(resp)
+	assert.Equal(StatusUnknown, hc.GetStatus())
+
+	hc.Cacheable(&HTTPResponse{}, 10)
+	status, resp = hc.Peek()
+	assert.Equal(StatusHit, status)
+	assert.NotNil(resp)
+
+	// 已过期
+	hc.expiredAt = 1
+	status, resp = hc.Peek()
+	assert.Equal(StatusPassed, status)
+	assert.Nil(resp)
+}
+
 func TestHTTPCacheIsExpired(t *testing.T) {
 	assert := assert.New(t)
 	hc := httpCache{
@@ -127,3 +148,131 @@ func TestHTTPCacheIsExpired(t *testing.T) {
 	hc.expiredAt = nowUnix() + 10
 	assert.False(hc.IsExpired())
 }
+
+func TestHTTPCacheStale(t *testing.T) {
+	assert := assert.New(t)
+	resp := &HTTPResponse{
+		StatusCode: 200,
+		RawBody:    []byte("Hello world!"),
+	}
+	hc := NewHTTPCache()
+	status, _ := hc.Get()
+	assert.Equal(StatusFetching, status)
+	hc.CacheableWithStale(resp, 10, 10, 20)
+	// 非stale状态不可后台更新
+	assert.False(hc.StartRevalidating())
+
+	// 已过期但在stale-while-revalidate时间内
+	hc.expiredAt = nowUnix() - 1
+	status, data := hc.Get()
+	assert.Equal(StatusStale, status)
+	assert.Equal(resp, data)
+	assert.True(hc.StartRevalidating())
+	// 只允许一个更新
+	assert.False(hc.StartRevalidating())
+	hc.StopRevalidating()
+	// 更新失败后需要等待一段时间才可再次更新
+	assert.False(hc.StartRevalidating())
+	hc.revalidateFailedAt = nowUnix() - revalidateFailBackoffSeconds
+	assert.True(hc.StartRevalidating())
+
+	// 超出stale-while-revalidate时间
+	hc.expiredAt = nowUnix() - 15
+	hc.staleWhileRevalidateUntil = hc.expiredAt + 10
+	status, data = hc.Get()
+	assert.Equal(StatusFetching, status)
+	assert.Nil(data)
+	// 在stale-if-error时间内，可使用过期数据
+	assert.Equal(resp, hc.StaleIfError())
+	assert.Equal(StatusStale, hc.GetStatus())
+
+	// 超出stale-if-error时间
+	hc.expiredAt = nowUnix() - 1
+	hc.staleWhileRevalidateUntil = 0
+	hc.staleIfErrorUntil = nowUnix() - 1
+	status, _ = hc.Get()
+	assert.Equal(StatusFetching, status)
+	assert.Nil(hc.StaleIfError())
+	// upstream不可用时，仍可使用过期数据
+	assert.Equal(resp, hc.Stale())
+	assert.Equal(StatusStale, hc.GetStatus())
+
+	// hit for pass之后过期数据不可再使用
+	hc.CacheableWithStale(resp, 10, 10, 20)
+	hc.HitForPass(-1)
+	assert.Nil(hc.StaleIfError())
+	assert.Nil(hc.Stale())
+}
+
+func TestHTTPCacheVary(t *testing.T) {
+	assert := assert.New(t)
+	hc := NewHTTPCache()
+	assert.Empty(hc.GetVary())
+
+	vary := []string{"Accept-Language"}
+	hc.SetVary(vary)
+	assert.Equal(vary, hc.GetVary())
+
+	assert.True(hc.AddVariant("a", 2))
+	assert.True(hc.AddVariant("b", 2))
+	// 已存在的可正常添加
+	assert.True(hc.AddVariant("a", 2))
+	// 超出最大数量
+	assert.False(hc.AddVariant("c", 2))
+
+	// vary不变，variants不重置
+	hc.SetVary([]string{"Accept-Language"})
+	assert.False(hc.AddVariant("c", 2))
+	// vary变化，variants重置
+	hc.SetVary([]string{"X-Device"})
+	assert.True(hc.AddVariant("c", 2))
+}
+
+func TestHTTPCacheSoftPurge(t *testing.T) {
+	assert := assert.New(t)
+	hc := NewHTTPCache()
+	assert.False(hc.SoftPurge())
+
+	hc.Get()
+	hc.Cacheable(&HTTPResponse{
+		RawBody: []byte("abc"),
+	}, 300)
+	expiredAt := hc.expiredAt
+	assert.True(hc.SoftPurge())
+	assert.True(hc.IsExpired())
+	// 原有效期内可使用过期数据
+	assert.Equal(expiredAt, hc.staleWhileRevalidateUntil)
+	assert.Equal(expiredAt, hc.staleIfErrorUntil)
+	status, resp := hc.Get()
+	assert.Equal(StatusStale, status)
+	assert.Equal([]byte("abc"), resp.RawBody)
+}
+
+func TestHTTPCacheGetInfo(t *testing.T) {
+	assert := assert.New(t)
+	hc := NewHTTPCache()
+	info := hc.GetInfo()
+	assert.Equal("unknown", info.Status)
+	assert.Equal(0, info.Size)
+
+	hc.Cacheable(&HTTPResponse{
+		RawBody:  []byte("abc"),
+		GzipBody: []byte("gzip"),
+	}, 300)
+	info = hc.GetInfo()
+	assert.Equal("hit", info.Status)
+	assert.Equal(300, info.TTL)
+	assert.Equal([]string{"identity", "gzip"}, info.Encodings)
+	assert.Equal(map[string]int{
+		"identity": 3,
+		"gzip":     4,
+	}, info.Sizes)
+
+	// 已过期，但未修改缓存的状态
+	hc.expiredAt = 1
+	hc.staleWhileRevalidateUntil = 1
+	info = hc.GetInfo()
+	assert.Equal("unknown", info.Status)
+	assert.Equal(0, info.TTL)
+	assert.Equal(StatusHit, hc.GetStatus())
+}
@@ -48,6 +48,12 @@ var ignoreHeaders = []string{
 
 var ErrBodyIsNil = errors.New("body is nil")
 
+// tagHeaders the headers of cache tag, e.g.: Surrogate-Key: a b, Cache-Tag: a,b
+var tagHeaders = []string{
+	"Surrogate-Key",
+	"Cache-Tag",
+}
+
 var defaultCompressContentTypeFilter = regexp.MustCompile(`text|javascript|json|wasm|xml|font`)
 
 type (
@@ -66,6 +72,8 @@ type (
 		GzipBody   []byte
 		BrBody     []byte
 		RawBody    []byte
+		// 压缩后是否保留原始数据，range请求的响应保留，截取时无需每次解压
+		KeepRawBody bool
 	}
 )
 
@@ -103,7 +111,24 @@ func NewHTTPResponse(statusCode int, header http.Header, encoding string, data [
 	return resp, nil
 }
 
+// isNoTransform check the response is set Cache-Control: no-transform,
+// pike shouldn't compress the data of this response
+func (resp *HTTPResponse) isNoTransform() bool {
+	for _, value := range resp.Header.Values(elton.HeaderCacheControl) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), "no-transform") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (resp *HTTPResponse) shouldCompressed() bool {
+	// no-transform的响应不可压缩，以原始数据返回
+	if resp.isNoTransform() {
+		return false
+	}
 	// 如果数据都小于最小压缩长度，则表示无需压缩
 	if len(resp.RawBody) <= resp.CompressMinLength &&
 		len(resp.GzipBody) <= resp.CompressMinLength &&
@@ -135,6 +160,29 @@ func (resp *HTTPResponse) GetRawBody() (rawBody []byte, err error) {
 	return
 }
 
+// Refresh create a new http response which headers are merged with the headers of
+// 304 response, the body of http response is reused and needn't to be compressed again
+func (resp *HTTPResponse) Refresh(header http.Header) *HTTPResponse {
+	h := resp.Header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	for key, values := range cloneHeaderAndIgnore(header) {
+		h[key] = values
+	}
+	return &HTTPResponse{
+		CompressSrv:               resp.CompressSrv,
+		CompressMinLength:         resp.CompressMinLength,
+		CompressContentTypeFilter: resp.CompressContentTypeFilter,
+		Header:                    h,
+		StatusCode:                resp.StatusCode,
+		GzipBody:                  resp.GzipBody,
+		BrBody:                    resp.BrBody,
+		RawBody:                   resp.RawBody,
+		KeepRawBody:               resp.KeepRawBody,
+	}
+}
+
 // Compress compress http response's data
 func (resp *HTTPResponse) Compress() (err error) {
 	// 如果数据不需要压缩，则直接返回
@@ -169,7 +217,9 @@ func (resp *HTTPResponse) Compress() (err error) {
 	}
 	// 压缩后清空原始数据，因为基本所有的客户端都支持gzip，
 	// 没必要再保存原始数据，如果有需要，可以从gzip中解压
-	resp.RawBody = nil
+	if !resp.KeepRawBody {
+		resp.RawBody = nil
+	}
 	return
 }
 
@@ -221,8 +271,53 @@ func (resp *HTTPResponse) getBodyByAcceptEncoding(acceptEncoding string) (encodi
 	return "", rawBody, nil
 }
 
-// Fill fill response to context
+// Size get the bytes of http response, include header and body
+func (resp *HTTPResponse) Size() int {
+	size := len(resp.GzipBody) + len(resp.BrBody) + len(resp.RawBody)
+	for key, values := range resp.Header {
+		size += len(key)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return size
+}
+
+// Tags get the cache tags of http response
+func (resp *HTTPResponse) Tags() []string {
+	var tags []string
+	for _, key := range tagHeaders {
+		for _, value := range resp.Header.Values(key) {
+			fields := strings.FieldsFunc(value, func(r rune) bool {
+				return r == ' ' || r == ','
+			})
+			for _, tag := range fields {
+				if !containsString(tags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	return tags
+}
+
+func containsString(arr []string, value string) bool {
+	for _, item := range arr {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Fill fill response to context, the partial content will be filled if it is range request
 func (resp *HTTPResponse) Fill(c *elton.Context) (err error) {
+	if resp.shouldFillRange(c.Request) {
+		done, err := resp.fillRange(c)
+		if err != nil || done {
+			return err
+		}
+	}
 	encoding, body, err := resp.getBodyByAcceptEncoding(c.GetRequestHeader(elton.HeaderAcceptEncoding))
 	if err != nil {
 		return
@@ -230,6 +325,10 @@ func (resp *HTTPResponse) Fill(c *elton.Context) (err error) {
 	c.MergeHeader(resp.Header)
 	c.SetHeader(elton.HeaderContentEncoding, encoding)
 	c.StatusCode = resp.StatusCode
+	// 完整的响应数据支持range请求
+	if resp.StatusCode == http.StatusOK && c.GetHeader(headerAcceptRanges) == "" {
+		c.SetHeader(headerAcceptRanges, "bytes")
+	}
 
 	c.BodyBuffer = bytes.NewBuffer(body)
 	return
@@ -1,6 +1,9 @@
 package cache
 
 import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -127,6 +130,15 @@ func TestShouldCompressed(t *testing.T) {
 			brBody:           data,
 			shouldCompressed: true,
 		},
+		// no-transform的响应不压缩
+		{
+			header: http.Header{
+				elton.HeaderContentType:  []string{"application/json"},
+				elton.HeaderCacheControl: []string{"public, max-age=60, No-Transform"},
+			},
+			rawBody:          data,
+			shouldCompressed: false,
+		},
 	}
 	for _, tt := range tests {
 		resp := &HTTPResponse{
@@ -215,6 +227,20 @@ func TestCompress(t *testing.T) {
 		assert.Equal(gzipData, resp.GzipBody)
 		assert.Equal(brData, resp.BrBody)
 	}
+
+	// range请求的响应保留原始数据
+	resp := &HTTPResponse{
+		Header: http.Header{
+			elton.HeaderContentType: []string{"application/json"},
+		},
+		RawBody:           data,
+		CompressMinLength: 1,
+		KeepRawBody:       true,
+	}
+	err = resp.Compress()
+	assert.Nil(err)
+	assert.Equal(data, resp.RawBody)
+	assert.Equal(gzipData, resp.GzipBody)
 }
 
 func TestGetBodyByAcceptEncoding(t *testing.T) {
@@ -311,6 +337,56 @@ func TestGetBodyByAcceptEncoding(t *testing.T) {
 	}
 }
 
+func TestHTTPResponseSize(t *testing.T) {
+	assert := assert.New(t)
+	resp := &HTTPResponse{
+		Header: http.Header{
+			"Content-Type": []string{"text/plain"},
+		},
+		GzipBody: []byte("gzip"),
+		BrBody:   []byte("br"),
+		RawBody:  []byte("raw"),
+	}
+	assert.Equal(len("Content-Type")+len("text/plain")+9, resp.Size())
+}
+
+func TestHTTPResponseRefresh(t *testing.T) {
+	assert := assert.New(t)
+	resp := &HTTPResponse{
+		StatusCode: 200,
+		Header: http.Header{
+			"Etag":          []string{`"1"`},
+			"Cache-Control": []string{"max-age=60"},
+			"X-Custom":      []string{"1"},
+		},
+		GzipBody: []byte("gzip"),
+		BrBody:   []byte("br"),
+	}
+	newResp := resp.Refresh(http.Header{
+		"Cache-Control":  []string{"max-age=120"},
+		"Content-Length": []string{"0"},
+	})
+	assert.Equal(200, newResp.StatusCode)
+	assert.Equal("max-age=120", newResp.Header.Get("Cache-Control"))
+	assert.Equal("1", newResp.Header.Get("X-Custom"))
+	assert.Empty(newResp.Header.Get("Content-Length"))
+	assert.Equal(resp.GzipBody, newResp.GzipBody)
+	assert.Equal(resp.BrBody, newResp.BrBody)
+	// 原有的响应不受影响
+	assert.Equal("max-age=60", resp.Header.Get("Cache-Control"))
+}
+
+func TestHTTPResponseTags(t *testing.T) {
+	assert := assert.New(t)
+	resp := &HTTPResponse{
+		Header: http.Header{
+			"Surrogate-Key": []string{"user  product"},
+			"Cache-Tag":     []string{"order,product"},
+		},
+	}
+	assert.Equal([]string{"user", "product", "order"}, resp.Tags())
+}
+
 func TestFill(t *testing.T) {
 	assert := assert.New(t)
 	data := []byte("Hello world!")
@@ -363,3 +439,121 @@ func TestFill(t *testing.T) {
 		assert.Equal(tt.result, c.BodyBuffer.Bytes())
 	}
 }
+
+func TestParseRange(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		value  string
+		ranges []httpRange
+		err    error
+	}{
+		{
+			value: "bytes=0-4",
+			ranges: []httpRange{
+				{start: 0, length: 5},
+			},
+		},
+		{
+			value: "bytes=6-,-3",
+			ranges: []httpRange{
+				{start: 6, length: 6},
+				{start: 9, length: 3},
+			},
+		},
+		{
+			value: "bytes=10-100",
+			ranges: []httpRange{
+				{start: 10, length: 2},
+			},
+		},
+		{
+			value: "bytes=12-",
+			err:   errRangeNotSatisfied,
+		},
+		{
+			value: "items=0-1",
+			err:   errRangeInvalid,
+		},
+		{
+			value: "bytes=5-1",
+			err:   errRangeInvalid,
+		},
+	}
+	for _, tt := range tests {
+		ranges, err := parseRange(tt.value, 12)
+		assert.Equal(tt.err, err)
+		assert.Equal(tt.ranges, ranges)
+	}
+}
+
+func TestFillRange(t *testing.T) {
+	assert := assert.New(t)
+	data := []byte("Hello world!")
+	compressSrv := compress.Get("")
+	gzipData, err := compressSrv.Gzip(data)
+	assert.Nil(err)
+	resp := &HTTPResponse{
+		Header: http.Header{
+			elton.HeaderContentType: []string{"text/plain"},
+			"Etag":                  []string{`"1"`},
+		},
+		// 只有压缩数据，range时需要解压
+		GzipBody:   gzipData,
+		StatusCode: 200,
+	}
+	newContext := func(rangeValue, ifRange string) *elton.Context {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(elton.HeaderAcceptEncoding, compress.EncodingGzip)
+		req.Header.Set("Range", rangeValue)
+		req.Header.Set("If-Range", ifRange)
+		return elton.NewContext(httptest.NewRecorder(), req)
+	}
+
+	c := newContext("bytes=0-4", "")
+	err = resp.Fill(c)
+	assert.Nil(err)
+	assert.Equal(206, c.StatusCode)
+	assert.Equal("bytes 0-4/12", c.GetHeader("Content-Range"))
+	assert.Empty(c.GetHeader(elton.HeaderContentEncoding))
+	assert.Equal("Hello", c.BodyBuffer.String())
+
+	// If-Range匹配ETag
+	c = newContext("bytes=-6", `"1"`)
+	err = resp.Fill(c)
+	assert.Nil(err)
+	assert.Equal(206, c.StatusCode)
+	assert.Equal("world!", c.BodyBuffer.String())
+
+	// If-Range不匹配，返回完整数据
+	c = newContext("bytes=-6", `"2"`)
+	err = resp.Fill(c)
+	assert.Nil(err)
+	assert.Equal(200, c.StatusCode)
+	assert.Equal("bytes", c.GetHeader("Accept-Ranges"))
+	assert.Equal(gzipData, c.BodyBuffer.Bytes())
+
+	// 超出范围
+	c = newContext("bytes=20-", "")
+	err = resp.Fill(c)
+	assert.Nil(err)
+	assert.Equal(416, c.StatusCode)
+	assert.Equal("bytes */12", c.GetHeader("Content-Range"))
+
+	// 多个range
+	c = newContext("bytes=0-4,6-10", "")
+	err = resp.Fill(c)
+	assert.Nil(err)
+	assert.Equal(206, c.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(c.GetHeader(elton.HeaderContentType))
+	assert.Nil(err)
+	assert.Equal("multipart/byteranges", mediaType)
+	r := multipart.NewReader(c.BodyBuffer, params["boundary"])
+	for _, expected := range []string{"Hello", "world"} {
+		part, err := r.NextPart()
+		assert.Nil(err)
+		assert.Equal("text/plain", part.Header.Get(elton.HeaderContentType))
+		buf, err := ioutil.ReadAll(part)
+		assert.Nil(err)
+		assert.Equal(expected, string(buf))
+	}
+}
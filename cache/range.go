@@ -0,0 +1,214 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Range请求的处理，从缓存的完整数据中截取对应的部分返回，
+// 多个range时以multipart/byteranges的形式返回
+
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/vicanso/elton"
+)
+
+const (
+	headerRange        = "Range"
+	headerIfRange      = "If-Range"
+	headerContentRange = "Content-Range"
+	headerAcceptRanges = "Accept-Ranges"
+)
+
+var (
+	errRangeInvalid      = errors.New("range is invalid")
+	errRangeNotSatisfied = errors.New("range is not satisfiable")
+)
+
+// httpRange the range of http request
+type httpRange struct {
+	start  int
+	length int
+}
+
+func (r httpRange) contentRange(size int) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parse the range header, e.g.: bytes=0-99,200-,-100
+func parseRange(value string, size int) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(value, prefix) {
+		return nil, errRangeInvalid
+	}
+	ranges := make([]httpRange, 0)
+	noOverlap := false
+	for _, item := range strings.Split(value[len(prefix):], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		index := strings.IndexByte(item, '-')
+		if index < 0 {
+			return nil, errRangeInvalid
+		}
+		start := strings.TrimSpace(item[:index])
+		end := strings.TrimSpace(item[index+1:])
+		var r httpRange
+		if start == "" {
+			// -100 表示最后的100字节
+			n, err := strconv.Atoi(end)
+			if err != nil || n < 0 {
+				return nil, errRangeInvalid
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			i, err := strconv.Atoi(start)
+			if err != nil || i < 0 {
+				return nil, errRangeInvalid
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - i
+			} else {
+				j, err := strconv.Atoi(end)
+				if err != nil || i > j {
+					return nil, errRangeInvalid
+				}
+				if j >= size {
+					j = size - 1
+				}
+				r.length = j - i + 1
+			}
+		}
+		if r.length == 0 {
+			noOverlap = true
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errRangeNotSatisfied
+	}
+	return ranges, nil
+}
+
+// isRangeMatched check the If-Range is matched the ETag or Last-Modified of response,
+// the range request is only handled if it is matched
+func (resp *HTTPResponse) isRangeMatched(ifRange string) bool {
+	if ifRange == "" {
+		return true
+	}
+	// 弱ETag不可用于range请求
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == resp.Header.Get(elton.HeaderETag)
+	}
+	return ifRange == resp.Header.Get(elton.HeaderLastModified)
+}
+
+// shouldFillRange check the response should be filled by range or not
+func (resp *HTTPResponse) shouldFillRange(req *http.Request) bool {
+	return resp.StatusCode == http.StatusOK &&
+		req.Method == http.MethodGet &&
+		req.Header.Get(headerRange) != "" &&
+		resp.isRangeMatched(req.Header.Get(headerIfRange))
+}
+
+// fillRange fill the partial content of response to context, it returns
+// false if the range is invalid and the whole response should be filled
+func (resp *HTTPResponse) fillRange(c *elton.Context) (bool, error) {
+	body, err := resp.GetRawBody()
+	if err != nil {
+		return false, err
+	}
+	size := len(body)
+	ranges, err := parseRange(c.GetRequestHeader(headerRange), size)
+	if err == errRangeNotSatisfied {
+		c.MergeHeader(resp.Header)
+		c.SetHeader(headerContentRange, fmt.Sprintf("bytes */%d", size))
+		c.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		c.BodyBuffer = new(bytes.Buffer)
+		return true, nil
+	}
+	// range无效则忽略，返回完整数据
+	if err != nil || len(ranges) == 0 {
+		return false, nil
+	}
+	total := 0
+	for _, r := range ranges {
+		total += r.length
+	}
+	// 请求的数据总长度超过原有数据，则直接返回完整数据
+	if total > size {
+		return false, nil
+	}
+	c.MergeHeader(resp.Header)
+	// range针对的是未压缩的数据
+	c.SetHeader(elton.HeaderContentEncoding, "")
+	c.StatusCode = http.StatusPartialContent
+	if len(ranges) == 1 {
+		r := ranges[0]
+		c.SetHeader(headerContentRange, r.contentRange(size))
+		c.BodyBuffer = bytes.NewBuffer(body[r.start : r.start+r.length])
+		return true, nil
+	}
+
+	buf := new(bytes.Buffer)
+	w := multipart.NewWriter(buf)
+	contentType := resp.Header.Get(elton.HeaderContentType)
+	for _, r := range ranges {
+		h := make(textproto.MIMEHeader)
+		if contentType != "" {
+			h.Set(elton.HeaderContentType, contentType)
+		}
+		h.Set(headerContentRange, r.contentRange(size))
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return false, err
+		}
+		_, err = part.Write(body[r.start : r.start+r.length])
+		if err != nil {
+			return false, err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return false, err
+	}
+	c.SetHeader(elton.HeaderContentType, "multipart/byteranges; boundary="+w.Boundary())
+	c.BodyBuffer = buf
+	return true, nil
+}
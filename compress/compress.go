@@ -26,9 +26,11 @@ import (
 	"compress/gzip"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/andybalholm/brotli"
 	"github.com/vicanso/pike/config"
+	"github.com/vicanso/pike/metrics"
 	"go.uber.org/atomic"
 )
 
@@ -183,7 +185,12 @@ func (srv *compressSrv) Decompress(encoding string, data []byte) ([]byte, error)
 // Gzip compress data by gzip
 func (srv *compressSrv) Gzip(data []byte) ([]byte, error) {
 	level := srv.GetLevel(EncodingGzip)
-	return doGzip(data, level)
+	startedAt := time.Now()
+	result, err := doGzip(data, level)
+	if err == nil {
+		metrics.ObserveCompress(EncodingGzip, time.Since(startedAt), len(data), len(result))
+	}
+	return result, err
 }
 
 // Gunzip decompress data by gzip
@@ -194,7 +201,12 @@ func (srv *compressSrv) Gunzip(data []byte) ([]byte, error) {
 // Brotli compress data by br
 func (srv *compressSrv) Brotli(data []byte) ([]byte, error) {
 	level := srv.GetLevel(EncodingBrotli)
-	return doBrotli(data, level)
+	startedAt := time.Now()
+	result, err := doBrotli(data, level)
+	if err == nil {
+		metrics.ObserveCompress(EncodingBrotli, time.Since(startedAt), len(data), len(result))
+	}
+	return result, err
 }
 
 // BrotliDecode decompress data by brotli
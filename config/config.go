@@ -23,9 +23,13 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io/ioutil"
 	"strings"
 
+	"github.com/dustin/go-humanize"
 	"github.com/vicanso/pike/app"
 	"github.com/vicanso/pike/log"
 	"go.uber.org/zap"
@@ -58,6 +62,7 @@ type (
 		Upstreams  []UpstreamConfig `json:"upstreams,omitempty" yaml:"upstreams,omitempty" validate:"omitempty,dive"`
 		Locations  []LocationConfig `json:"locations,omitempty" yaml:"locations,omitempty" validate:"omitempty,dive"`
 		Servers    []ServerConfig   `json:"servers,omitempty" yaml:"servers,omitempty" validate:"omitempty,dive"`
+		Warmups    []WarmupConfig   `json:"warmups,omitempty" yaml:"warmups,omitempty" validate:"omitempty,dive"`
 	}
 	// AdminConfig admin config
 	AdminConfig struct {
@@ -74,26 +79,106 @@ type (
 	// CacheConfig cache config
 	CacheConfig struct {
 		Name       string `json:"name,omitempty" yaml:"name,omitempty" validate:"required,xName"`
-		Size       int    `json:"size,omitempty" yaml:"size,omitempty" validate:"required,gt=0" `
+		Size       int    `json:"size,omitempty" yaml:"size,omitempty" validate:"required_without=MaxMemory,gte=0" `
 		HitForPass string `json:"hitForPass,omitempty" yaml:"hitForPass,omitempty" validate:"required,xDuration"`
-		Remark     string `json:"remark,omitempty" yaml:"remark,omitempty"`
+		// 最大内存，如512mb，设置后根据缓存数据的字节数淘汰
+		MaxMemory string `json:"maxMemory,omitempty" yaml:"maxMemory,omitempty" validate:"omitempty,xSize"`
+		// 单个缓存的最大尺寸，超过则不缓存。最大内存平均分配至各个zone，因此不能超过maxMemory/128
+		MaxObjectSize string `json:"maxObjectSize,omitempty" yaml:"maxObjectSize,omitempty" validate:"omitempty,xSize"`
+		// 每个url根据Vary生成的最大缓存数，默认为10
+		MaxVariants int `json:"maxVariants,omitempty" yaml:"maxVariants,omitempty" validate:"omitempty,gt=0"`
+		// 缓存存储方式，memory或disk，默认为memory
+		Store string `json:"store,omitempty" yaml:"store,omitempty" validate:"omitempty,oneof=memory disk"`
+		// 磁盘缓存的目录
+		Path string `json:"path,omitempty" yaml:"path,omitempty" validate:"required_if=Store disk"`
+		// 磁盘缓存最大尺寸，默认为1GB
+		MaxDiskSize string `json:"maxDiskSize,omitempty" yaml:"maxDiskSize,omitempty" validate:"omitempty,xSize"`
+		Remark      string `json:"remark,omitempty" yaml:"remark,omitempty"`
 	}
 	// UpstreamServerConfig upstream server config
 	UpstreamServerConfig struct {
 		Addr   string `json:"addr,omitempty" yaml:"addr,omitempty" validate:"required,xAddr"`
 		Backup bool   `json:"backup,omitempty" yaml:"backup,omitempty"`
+		// 权重，用于weightedRoundRobin与consistentHash，默认为1
+		Weight int `json:"weight,omitempty" yaml:"weight,omitempty" validate:"omitempty,gt=0"`
 		// Healthy 界面展示使用，不需要保存
 		Healthy bool `json:"healthy,omitempty" yaml:"-"`
+		// Circuit 熔断器的状态，界面展示使用，不需要保存
+		Circuit string `json:"circuit,omitempty" yaml:"-"`
 	}
 	// UpstreamConfig upstream config
 	UpstreamConfig struct {
-		Name           string                 `json:"name,omitempty" yaml:"name,omitempty" validate:"required,xName"`
-		HealthCheck    string                 `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty" validate:"omitempty,xURLPath"`
-		Policy         string                 `json:"policy,omitempty" yaml:"policy,omitempty" validate:"omitempty,xPolicy"`
-		EnableH2C      bool                   `json:"enableH2C,omitempty" yaml:"enableH2C,omitempty"`
-		AcceptEncoding string                 `json:"acceptEncoding,omitempty" yaml:"acceptEncoding,omitempty" validate:"omitempty,ascii"`
-		Servers        []UpstreamServerConfig `json:"servers,omitempty" yaml:"servers,omitempty" validate:"required,dive"`
-		Remark         string                 `json:"remark,omitempty" yaml:"remark,omitempty"`
+		Name           string `json:"name,omitempty" yaml:"name,omitempty" validate:"required,xName"`
+		HealthCheck    string `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty" validate:"omitempty,xURLPath"`
+		Policy         string `json:"policy,omitempty" yaml:"policy,omitempty" validate:"omitempty,xPolicy"`
+		EnableH2C      bool   `json:"enableH2C,omitempty" yaml:"enableH2C,omitempty"`
+		AcceptEncoding string `json:"acceptEncoding,omitempty" yaml:"acceptEncoding,omitempty" validate:"omitempty,ascii"`
+		// 一致性哈希的key，url（默认）、ip、header:name或cookie:name
+		HashKey string `json:"hashKey,omitempty" yaml:"hashKey,omitempty" validate:"omitempty,xHashKey"`
+		// 主动检测的间隔与超时，默认为5s与3s
+		HealthCheckInterval string `json:"healthCheckInterval,omitempty" yaml:"healthCheckInterval,omitempty" validate:"omitempty,xDuration"`
+		HealthCheckTimeout  string `json:"healthCheckTimeout,omitempty" yaml:"healthCheckTimeout,omitempty" validate:"omitempty,xDuration"`
+		// 主动检测期望的状态码范围，如200-399（默认）
+		HealthCheckStatus string `json:"healthCheckStatus,omitempty" yaml:"healthCheckStatus,omitempty" validate:"omitempty,xStatusRange"`
+		// 连续成功rise次则设置为healthy，连续失败fall次则设置为sick
+		HealthCheckRise int `json:"healthCheckRise,omitempty" yaml:"healthCheckRise,omitempty" validate:"omitempty,gt=0"`
+		HealthCheckFall int `json:"healthCheckFall,omitempty" yaml:"healthCheckFall,omitempty" validate:"omitempty,gt=0"`
+		// 被动检测，转发请求连续出错（5xx或连接失败）的次数达到则设置为sick，为0则不启用
+		PassiveFailures int `json:"passiveFailures,omitempty" yaml:"passiveFailures,omitempty" validate:"omitempty,gt=0"`
+		// 被动检测设置为sick后，经过cool-down时长后重新启用，默认为30s
+		PassiveCooldown string `json:"passiveCooldown,omitempty" yaml:"passiveCooldown,omitempty" validate:"omitempty,xDuration"`
+		// 转发失败时最多尝试的次数（包括首次），仅针对GET与HEAD请求
+		RetryAttempts int `json:"retryAttempts,omitempty" yaml:"retryAttempts,omitempty" validate:"omitempty,gt=0"`
+		// 重试的条件，error、5xx或指定状态码，默认为error
+		RetryOn []string `json:"retryOn,omitempty" yaml:"retryOn,omitempty" validate:"omitempty,dive,xRetryOn"`
+		// 每次尝试的超时
+		RetryTimeout string `json:"retryTimeout,omitempty" yaml:"retryTimeout,omitempty" validate:"omitempty,xDuration"`
+		// 重试次数占请求数的最大百分比
+		RetryBudget int `json:"retryBudget,omitempty" yaml:"retryBudget,omitempty" validate:"omitempty,min=1,max=100"`
+		// 熔断的出错（5xx或连接失败）百分比阈值
+		BreakerErrorRate int `json:"breakerErrorRate,omitempty" yaml:"breakerErrorRate,omitempty" validate:"omitempty,min=1,max=100"`
+		// 熔断的慢请求耗时与百分比阈值
+		BreakerSlowLatency string `json:"breakerSlowLatency,omitempty" yaml:"breakerSlowLatency,omitempty" validate:"omitempty,xDuration"`
+		BreakerSlowRate    int    `json:"breakerSlowRate,omitempty" yaml:"breakerSlowRate,omitempty" validate:"omitempty,min=1,max=100"`
+		// 熔断统计周期内最少的请求数，默认为20
+		BreakerMinRequests int `json:"breakerMinRequests,omitempty" yaml:"breakerMinRequests,omitempty" validate:"omitempty,gt=0"`
+		// 熔断的统计周期，默认为10s
+		BreakerWindow string `json:"breakerWindow,omitempty" yaml:"breakerWindow,omitempty" validate:"omitempty,xDuration"`
+		// 熔断后进入半开状态的时长，默认为30s
+		BreakerOpenTimeout string `json:"breakerOpenTimeout,omitempty" yaml:"breakerOpenTimeout,omitempty" validate:"omitempty,xDuration"`
+		// 半开状态允许的探测请求数，默认为3
+		BreakerHalfOpenRequests int `json:"breakerHalfOpenRequests,omitempty" yaml:"breakerHalfOpenRequests,omitempty" validate:"omitempty,gt=0"`
+		// 校验upstream证书的CA（PEM格式或文件路径），为空则使用系统的CA
+		TLSCA     string `json:"tlsCA,omitempty" yaml:"tlsCA,omitempty"`
+		TLSCAFile string `json:"tlsCAFile,omitempty" yaml:"tlsCAFile,omitempty"`
+		// 客户端证书与私钥（PEM格式或文件路径），用于双向认证
+		TLSCert     string `json:"tlsCert,omitempty" yaml:"tlsCert,omitempty" validate:"required_with=TLSKey"`
+		TLSKey      string `json:"tlsKey,omitempty" yaml:"tlsKey,omitempty" validate:"required_with=TLSCert"`
+		TLSCertFile string `json:"tlsCertFile,omitempty" yaml:"tlsCertFile,omitempty" validate:"required_with=TLSKeyFile"`
+		TLSKeyFile  string `json:"tlsKeyFile,omitempty" yaml:"tlsKeyFile,omitempty" validate:"required_with=TLSCertFile"`
+		// 校验证书使用的域名（SNI），为空则使用upstream地址中的域名
+		TLSServerName string `json:"tlsServerName,omitempty" yaml:"tlsServerName,omitempty" validate:"omitempty,hostname"`
+		// 不校验upstream的证书，仅用于测试
+		TLSInsecureSkipVerify bool `json:"tlsInsecureSkipVerify,omitempty" yaml:"tlsInsecureSkipVerify,omitempty"`
+		// 连接超时，默认为30s
+		DialTimeout string `json:"dialTimeout,omitempty" yaml:"dialTimeout,omitempty" validate:"omitempty,xDuration"`
+		// TCP keep-alive的间隔，默认为30s
+		KeepAlive string `json:"keepAlive,omitempty" yaml:"keepAlive,omitempty" validate:"omitempty,xDuration"`
+		// 禁用连接复用
+		DisableKeepAlives bool `json:"disableKeepAlives,omitempty" yaml:"disableKeepAlives,omitempty"`
+		// 等待响应头的超时，默认不限制
+		ResponseHeaderTimeout string `json:"responseHeaderTimeout,omitempty" yaml:"responseHeaderTimeout,omitempty" validate:"omitempty,xDuration"`
+		// 空闲连接的超时，默认为90s
+		IdleConnTimeout string `json:"idleConnTimeout,omitempty" yaml:"idleConnTimeout,omitempty" validate:"omitempty,xDuration"`
+		// 最大的空闲连接数与每个host最大的空闲连接数，默认为500与50
+		MaxIdleConns        int `json:"maxIdleConns,omitempty" yaml:"maxIdleConns,omitempty" validate:"omitempty,gt=0"`
+		MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty" yaml:"maxIdleConnsPerHost,omitempty" validate:"omitempty,gt=0"`
+		// 每个host最大的连接数，默认不限制
+		MaxConnsPerHost int `json:"maxConnsPerHost,omitempty" yaml:"maxConnsPerHost,omitempty" validate:"omitempty,gt=0"`
+		// 使用的协议，http1或http2（默认）
+		Protocol string                 `json:"protocol,omitempty" yaml:"protocol,omitempty" validate:"omitempty,oneof=http1 http2"`
+		Servers  []UpstreamServerConfig `json:"servers,omitempty" yaml:"servers,omitempty" validate:"required,dive"`
+		Remark   string                 `json:"remark,omitempty" yaml:"remark,omitempty"`
 	}
 	// LocationConfig location config
 	LocationConfig struct {
@@ -106,7 +191,42 @@ type (
 		ReqHeaders   []string `json:"reqHeaders,omitempty" yaml:"reqHeaders,omitempty" validate:"omitempty,dive,xDivide"`
 		Hosts        []string `json:"hosts,omitempty" yaml:"hosts,omitempty" validate:"omitempty,dive,hostname"`
 		ProxyTimeout string   `json:"proxyTimeout,omitempty" yaml:"proxyTimeout,omitempty" validate:"omitempty,xDuration"`
-		Remark       string   `json:"remark,omitempty" yaml:"remark,omitempty"`
+		// 缓存key的生成配置
+		CacheKey *CacheKeyConfig `json:"cacheKey,omitempty" yaml:"cacheKey,omitempty" validate:"omitempty"`
+		// 请求数据的最大尺寸，超出则返回413
+		MaxRequestBodySize string `json:"maxRequestBodySize,omitempty" yaml:"maxRequestBodySize,omitempty" validate:"omitempty,xSize"`
+		// 非流式转发时响应数据的最大尺寸，超出则返回502
+		MaxResponseBodySize string `json:"maxResponseBodySize,omitempty" yaml:"maxResponseBodySize,omitempty" validate:"omitempty,xSize"`
+		// 不可缓存的请求（pass与hit for pass）是否以流的方式转发响应
+		Stream bool `json:"stream,omitempty" yaml:"stream,omitempty"`
+		// 响应数据超过此尺寸时以流的方式转发
+		StreamThreshold string `json:"streamThreshold,omitempty" yaml:"streamThreshold,omitempty" validate:"omitempty,xSize"`
+		// range请求未命中缓存时，是否从upstream获取完整的数据（用于缓存）
+		RangeFetchFull bool `json:"rangeFetchFull,omitempty" yaml:"rangeFetchFull,omitempty"`
+		// upgrade的连接（如websocket）的空闲超时
+		UpgradeIdleTimeout string `json:"upgradeIdleTimeout,omitempty" yaml:"upgradeIdleTimeout,omitempty" validate:"omitempty,xDuration"`
+		// 限流的速率，如：10/s，100/m，为空则不限流
+		RateLimit string `json:"rateLimit,omitempty" yaml:"rateLimit,omitempty" validate:"omitempty,xRate"`
+		// 限流允许的突发请求数，默认为每秒的速率（最少为1）
+		RateLimitBurst int `json:"rateLimitBurst,omitempty" yaml:"rateLimitBurst,omitempty" validate:"omitempty,min=1"`
+		// 限流的key，ip(默认) xff path 或 header:name
+		RateLimitKey string `json:"rateLimitKey,omitempty" yaml:"rateLimitKey,omitempty" validate:"omitempty,xRateLimitKey"`
+		// 是否通过etcd在多个实例之间共享限流计数
+		RateLimitShared bool   `json:"rateLimitShared,omitempty" yaml:"rateLimitShared,omitempty"`
+		Remark          string `json:"remark,omitempty" yaml:"remark,omitempty"`
+	}
+	// CacheKeyConfig cache key config
+	CacheKeyConfig struct {
+		// 忽略的query参数，支持以*结尾的前缀匹配，如utm_*
+		IgnoreQueries []string `json:"ignoreQueries,omitempty" yaml:"ignoreQueries,omitempty" validate:"omitempty,dive,required"`
+		// 是否对query参数排序
+		SortQuery bool `json:"sortQuery,omitempty" yaml:"sortQuery,omitempty"`
+		// 添加至缓存key的请求头
+		Headers []string `json:"headers,omitempty" yaml:"headers,omitempty" validate:"omitempty,dive,required"`
+		// 添加至缓存key的cookie
+		Cookies []string `json:"cookies,omitempty" yaml:"cookies,omitempty" validate:"omitempty,dive,required"`
+		// 缓存key中是否忽略host
+		IgnoreHost bool `json:"ignoreHost,omitempty" yaml:"ignoreHost,omitempty"`
 	}
 	// ServerConfig server config
 	ServerConfig struct {
@@ -119,17 +239,72 @@ type (
 		CompressMinLength string `json:"compressMinLength,omitempty" yaml:"compressMinLength,omitempty" validate:"omitempty,xSize"`
 		// 压缩数据类型
 		CompressContentTypeFilter string `json:"compressContentTypeFilter,omitempty" yaml:"compressContentTypeFilter,omitempty" validate:"omitempty,xFilter"`
-		Remark                    string `json:"remark,omitempty" yaml:"remark,omitempty"`
+		// TLS证书，配置后则使用https，多个证书时根据SNI选择
+		Certificates []CertificateConfig `json:"certificates,omitempty" yaml:"certificates,omitempty" validate:"omitempty,dive"`
+		// TLS的最低与最高版本，如1.2
+		TLSMinVersion string `json:"tlsMinVersion,omitempty" yaml:"tlsMinVersion,omitempty" validate:"omitempty,xTLSVersion"`
+		TLSMaxVersion string `json:"tlsMaxVersion,omitempty" yaml:"tlsMaxVersion,omitempty" validate:"omitempty,xTLSVersion"`
+		// TLS的加密套件，如TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256，为空则使用默认
+		TLSCipherSuites []string `json:"tlsCipherSuites,omitempty" yaml:"tlsCipherSuites,omitempty" validate:"omitempty,dive,xCipherSuite"`
+		// 是否启用h2c(http/2 over tcp)，只用于未配置证书的server
+		EnableH2C bool `json:"enableH2C,omitempty" yaml:"enableH2C,omitempty"`
+		// 是否启用http/2，只用于配置了证书的server
+		EnableHTTP2 bool `json:"enableHTTP2,omitempty" yaml:"enableHTTP2,omitempty"`
+		// 是否启用http/3(实验性)，只用于配置了证书的server，调整后需重启生效
+		EnableHTTP3 bool   `json:"enableHTTP3,omitempty" yaml:"enableHTTP3,omitempty"`
+		Remark      string `json:"remark,omitempty" yaml:"remark,omitempty"`
+	}
+	// CertificateConfig certificate config
+	CertificateConfig struct {
+		// 证书对应的域名，支持*.example.com的形式，为空则使用证书中的域名
+		Domains []string `json:"domains,omitempty" yaml:"domains,omitempty" validate:"omitempty,dive,required"`
+		// PEM格式的证书与私钥，与配置一起保存（如etcd）
+		Cert string `json:"cert,omitempty" yaml:"cert,omitempty" validate:"required_without=CertFile"`
+		Key  string `json:"key,omitempty" yaml:"key,omitempty" validate:"required_without=KeyFile"`
+		// 证书与私钥的文件路径
+		CertFile string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+		KeyFile  string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	}
+	// WarmupConfig warmup config
+	WarmupConfig struct {
+		Name string `json:"name,omitempty" yaml:"name,omitempty" validate:"required,xName"`
+		// 预热使用的server（server的addr）
+		Server string `json:"server,omitempty" yaml:"server,omitempty" validate:"required,ascii"`
+		// 预热的url列表，如http://example.com/api/products
+		URLs []string `json:"urls,omitempty" yaml:"urls,omitempty" validate:"required_without=Sitemap,omitempty,dive,url"`
+		// sitemap或url列表文件（每行一个url）的地址，支持http(s)或本地文件
+		Sitemap string `json:"sitemap,omitempty" yaml:"sitemap,omitempty" validate:"omitempty,ascii"`
+		// 并发数，默认为5
+		Concurrency int `json:"concurrency,omitempty" yaml:"concurrency,omitempty" validate:"omitempty,gt=0"`
+		// 添加的请求头
+		Headers []string `json:"headers,omitempty" yaml:"headers,omitempty" validate:"omitempty,dive,xDivide"`
+		// 定时执行的cron表达式，如@every 1h
+		Schedule string `json:"schedule,omitempty" yaml:"schedule,omitempty" validate:"omitempty,xCron"`
+		Remark   string `json:"remark,omitempty" yaml:"remark,omitempty"`
 	}
 )
 
 var defaultClient Client
 
+// CacheZoneSize the zone size of cache, the max memory is split across the zones
+const CacheZoneSize = 128
+
+const (
+	// PolicyWeightedRoundRobin weighted round robin policy of upstream
+	PolicyWeightedRoundRobin = "weightedRoundRobin"
+	// PolicyConsistentHash consistent hash policy of upstream
+	PolicyConsistentHash = "consistentHash"
+)
+
 var (
 	ErrUpstreamNotFound = errors.New("upstream of location not found")
 	ErrLocationNotFound = errors.New("location of server not found")
 	ErrCacheNotFound    = errors.New("cache of server not found")
 	ErrCompressNotFound = errors.New("compress of server not found")
+	ErrServerNotFound   = errors.New("server of warmup not found")
+	ErrCAInvalid        = errors.New("ca of upstream is invalid")
+
+	ErrMaxObjectSizeTooLarge = errors.New("max object size of cache is larger than the max memory of zone")
 )
 
 // InitDefaultClient init default client
@@ -178,6 +353,24 @@ func (c *PikeConfig) Validate() error {
 			return ErrUpstreamNotFound
 		}
 	}
+	// 最大内存平均分配至各个zone，单个缓存不能超过zone的最大内存
+	for _, item := range c.Caches {
+		if item.MaxMemory == "" || item.MaxObjectSize == "" {
+			continue
+		}
+		maxMemory, _ := humanize.ParseBytes(item.MaxMemory)
+		maxObjectSize, _ := humanize.ParseBytes(item.MaxObjectSize)
+		if maxObjectSize > maxMemory/CacheZoneSize {
+			return ErrMaxObjectSizeTooLarge
+		}
+	}
+	// 校验upstream的TLS配置
+	for _, u := range c.Upstreams {
+		_, err := u.TLSConfig()
+		if err != nil {
+			return err
+		}
+	}
 	// 校验server中的location, cache 以及 compress 是否正确设置
 	for _, s := range c.Servers {
 		for _, item := range s.Locations {
@@ -211,11 +404,90 @@ func (c *PikeConfig) Validate() error {
 		if !foundCompress {
 			return ErrCompressNotFound
 		}
+
+		for _, item := range s.Certificates {
+			_, err := item.Load()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// 校验warmup中的server是否存在
+	for _, w := range c.Warmups {
+		found := false
+		for _, s := range c.Servers {
+			if w.Server == s.Addr {
+				found = true
+			}
+		}
+		if !found {
+			return ErrServerNotFound
+		}
 	}
 
 	return nil
 }
 
+// Load load the certificate from PEM or file
+func (c *CertificateConfig) Load() (tls.Certificate, error) {
+	if c.Cert != "" && c.Key != "" {
+		return tls.X509KeyPair([]byte(c.Cert), []byte(c.Key))
+	}
+	return tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+}
+
+// TLSConfig create the tls config of upstream, it returns nil if there is no tls setting
+func (u *UpstreamConfig) TLSConfig() (*tls.Config, error) {
+	if u.TLSCA == "" &&
+		u.TLSCAFile == "" &&
+		u.TLSCert == "" &&
+		u.TLSCertFile == "" &&
+		u.TLSServerName == "" &&
+		!u.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         u.TLSServerName,
+		InsecureSkipVerify: u.TLSInsecureSkipVerify,
+	}
+	ca := []byte(u.TLSCA)
+	if len(ca) == 0 && u.TLSCAFile != "" {
+		var err error
+		ca, err = ioutil.ReadFile(u.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(ca) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, ErrCAInvalid
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if u.TLSCert != "" || u.TLSCertFile != "" {
+		certConfig := CertificateConfig{
+			Cert:     u.TLSCert,
+			Key:      u.TLSKey,
+			CertFile: u.TLSCertFile,
+			KeyFile:  u.TLSKeyFile,
+		}
+		cert, err := certConfig.Load()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{
+			cert,
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Validate validate the warmup config
+func (w *WarmupConfig) Validate() error {
+	return defaultValidator.Struct(w)
+}
+
 // GetAdminConfig get admin config
 func (p *PikeConfig) GetAdminConfig() AdminConfig {
 	return p.Admin
@@ -128,6 +128,23 @@ func TestValidate(t *testing.T) {
 	err = c.Validate()
 	assert.Equal(ErrCompressNotFound, err)
 
+	// 单个缓存的最大尺寸超过zone的最大内存
+	c = &PikeConfig{
+		Caches: []CacheConfig{
+			{
+				Name:          "cache-test",
+				HitForPass:    "1m",
+				MaxMemory:     "128MB",
+				MaxObjectSize: "2MB",
+			},
+		},
+	}
+	err = c.Validate()
+	assert.Equal(ErrMaxObjectSizeTooLarge, err)
+	c.Caches[0].MaxObjectSize = "1MB"
+	err = c.Validate()
+	assert.Nil(err)
+
 	c = &PikeConfig{
 		Caches: []CacheConfig{
 			{
@@ -192,6 +209,119 @@ func TestValidate(t *testing.T) {
 	}
 	err = c.Validate()
 	assert.Nil(err)
+
+	// 磁盘缓存未设置目录
+	c.Caches[0].Store = "disk"
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Caches[0].Path = "/tmp/pike"
+	c.Caches[0].MaxDiskSize = "1gb"
+	err = c.Validate()
+	assert.Nil(err)
+
+	// 根据内存限制缓存
+	c.Caches[0].Size = 0
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Caches[0].MaxMemory = "512mb"
+	c.Caches[0].MaxObjectSize = "1mb"
+	err = c.Validate()
+	assert.Nil(err)
+
+	// TLS版本与加密套件
+	c.Servers[0].TLSMinVersion = "1.5"
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Servers[0].TLSMinVersion = "1.2"
+	c.Servers[0].TLSCipherSuites = []string{
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	}
+	err = c.Validate()
+	assert.Nil(err)
+
+	// 证书未配置或无法加载
+	c.Servers[0].Certificates = []CertificateConfig{
+		{
+			Domains: []string{
+				"test.com",
+			},
+		},
+	}
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Servers[0].Certificates[0].Cert = "cert"
+	c.Servers[0].Certificates[0].Key = "key"
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Servers[0].Certificates = nil
+
+	// upstream的CA无效
+	c.Upstreams[0].TLSCA = "ca"
+	err = c.Validate()
+	assert.Equal(ErrCAInvalid, err)
+	c.Upstreams[0].TLSCA = ""
+	// 客户端证书只配置了证书未配置私钥
+	c.Upstreams[0].TLSCertFile = "/tmp/client.crt"
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Upstreams[0].TLSCertFile = ""
+
+	// location的限流配置
+	c.Locations[0].RateLimit = "10/d"
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Locations[0].RateLimit = "10/s"
+	c.Locations[0].RateLimitKey = "header:"
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Locations[0].RateLimitKey = "header:X-Token"
+	c.Locations[0].RateLimitBurst = 20
+	err = c.Validate()
+	assert.Nil(err)
+
+	// 预热未设置url与sitemap
+	c.Warmups = []WarmupConfig{
+		{
+			Name:   "warmup-test",
+			Server: ":3015",
+		},
+	}
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Warmups[0].URLs = []string{
+		"http://test.com/api/products",
+	}
+	c.Warmups[0].Schedule = "every hour"
+	err = c.Validate()
+	assert.NotNil(err)
+	c.Warmups[0].Schedule = "@every 1h"
+	err = c.Validate()
+	assert.Nil(err)
+	// 预热的server不存在
+	c.Warmups[0].Server = ":3016"
+	err = c.Validate()
+	assert.Equal(ErrServerNotFound, err)
+}
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	u := &UpstreamConfig{}
+	tlsConfig, err := u.TLSConfig()
+	assert.Nil(err)
+	assert.Nil(tlsConfig)
+
+	u.TLSServerName = "test.com"
+	u.TLSInsecureSkipVerify = true
+	tlsConfig, err = u.TLSConfig()
+	assert.Nil(err)
+	assert.Equal("test.com", tlsConfig.ServerName)
+	assert.True(tlsConfig.InsecureSkipVerify)
+	assert.Nil(tlsConfig.RootCAs)
+
+	u.TLSCAFile = "/not-exists-ca.crt"
+	_, err = u.TLSConfig()
+	assert.NotNil(err)
 }
 
 func TestInitDefaultClient(t *testing.T) {
@@ -128,3 +128,13 @@ func (ec *etcdClient) Watch(onChange OnChange) {
 func (ec *etcdClient) Close() error {
 	return ec.c.Close()
 }
+
+// GetEtcdClient get the etcd client and the key of config,
+// it returns nil if the config is not stored in etcd
+func GetEtcdClient() (*clientv3.Client, string) {
+	ec, ok := defaultClient.(*etcdClient)
+	if !ok || ec == nil {
+		return nil, ""
+	}
+	return ec.c, ec.key
+}
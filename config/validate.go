@@ -26,11 +26,14 @@ import (
 	"net/url"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/go-playground/validator/v10"
+	"github.com/robfig/cron/v3"
+	"github.com/vicanso/pike/util"
 	us "github.com/vicanso/upstream"
 )
 
@@ -89,6 +92,49 @@ func init() {
 		_, err := regexp.Compile(value)
 		return err == nil
 	})
+	addValidate("xCron", func(fl validator.FieldLevel) bool {
+		value, ok := toString(fl)
+		if !ok {
+			return false
+		}
+		_, err := cron.ParseStandard(value)
+		return err == nil
+	})
+	addValidate("xStatusRange", func(fl validator.FieldLevel) bool {
+		value, ok := toString(fl)
+		if !ok {
+			return false
+		}
+		_, _, err := util.ParseStatusRange(value)
+		return err == nil
+	})
+	addValidate("xRetryOn", func(fl validator.FieldLevel) bool {
+		value, ok := toString(fl)
+		if !ok {
+			return false
+		}
+		if value == "error" || value == "5xx" {
+			return true
+		}
+		code, err := strconv.Atoi(value)
+		return err == nil && code >= 100 && code <= 599
+	})
+	addValidate("xTLSVersion", func(fl validator.FieldLevel) bool {
+		value, ok := toString(fl)
+		if !ok {
+			return false
+		}
+		_, ok = util.ParseTLSVersion(value)
+		return ok
+	})
+	addValidate("xCipherSuite", func(fl validator.FieldLevel) bool {
+		value, ok := toString(fl)
+		if !ok {
+			return false
+		}
+		_, ok = util.ParseCipherSuite(value)
+		return ok
+	})
 	addValidate("xPolicy", func(fl validator.FieldLevel) bool {
 		value, ok := toString(fl)
 		if !ok {
@@ -99,8 +145,44 @@ func init() {
 			us.PolicyRandom,
 			us.PolicyRoundRobin,
 			us.PolicyLeastconn,
+			PolicyWeightedRoundRobin,
+			PolicyConsistentHash,
 		}, value)
 	})
+	addValidate("xRate", func(fl validator.FieldLevel) bool {
+		value, ok := toString(fl)
+		if !ok {
+			return false
+		}
+		_, err := util.ParseRate(value)
+		return err == nil
+	})
+	addValidate("xRateLimitKey", func(fl validator.FieldLevel) bool {
+		value, ok := toString(fl)
+		if !ok {
+			return false
+		}
+		if contains([]string{"ip", "xff", "path"}, value) {
+			return true
+		}
+		prefix := "header:"
+		return strings.HasPrefix(value, prefix) && len(value) > len(prefix)
+	})
+	addValidate("xHashKey", func(fl validator.FieldLevel) bool {
+		value, ok := toString(fl)
+		if !ok {
+			return false
+		}
+		if value == "url" || value == "ip" {
+			return true
+		}
+		for _, prefix := range []string{"header:", "cookie:"} {
+			if strings.HasPrefix(value, prefix) && len(value) > len(prefix) {
+				return true
+			}
+		}
+		return false
+	})
 }
 
 // toString 转换为string
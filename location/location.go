@@ -35,6 +35,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/vicanso/pike/config"
 	"github.com/vicanso/pike/log"
 	"go.uber.org/atomic"
@@ -55,7 +56,34 @@ type (
 		RequestHeader  http.Header
 		Query          url.Values
 		URLRewriter    Rewriter
-		priority       atomic.Int32
+		// 缓存key的生成配置，为空则使用默认的method host uri
+		CacheKey *CacheKey
+		// 请求数据的最大尺寸，为0则不限制
+		MaxRequestBodySize int
+		// 非流式转发时响应数据的最大尺寸，为0则不限制
+		MaxResponseBodySize int
+		// 不可缓存的请求是否以流的方式转发响应
+		Stream bool
+		// 响应数据超过此尺寸时以流的方式转发，为0则不启用
+		StreamThreshold int
+		// range请求未命中缓存时，是否从upstream获取完整的数据
+		RangeFetchFull bool
+		// upgrade的连接（如websocket）的空闲超时，为0则不限制
+		UpgradeIdleTimeout time.Duration
+		priority           atomic.Int32
+	}
+	// CacheKey cache key option
+	CacheKey struct {
+		// 忽略的query参数
+		IgnoreQueries []string
+		// 是否对query参数排序
+		SortQuery bool
+		// 添加至缓存key的请求头
+		Headers []string
+		// 添加至缓存key的cookie
+		Cookies []string
+		// 是否忽略host
+		IgnoreHost bool
 	}
 	rewriteRegexp struct {
 		Regexp *regexp.Regexp
@@ -194,6 +222,27 @@ func (l *Location) AddQuery(req *http.Request) {
 	req.URL.RawQuery = query.Encode()
 }
 
+// IsIgnoredQuery check the query should be ignored for cache key, the name support prefix match, e.g.: utm_*
+func (ck *CacheKey) IsIgnoredQuery(name string) bool {
+	for _, item := range ck.IgnoreQueries {
+		if strings.HasSuffix(item, "*") {
+			if strings.HasPrefix(name, item[:len(item)-1]) {
+				return true
+			}
+			continue
+		}
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldModifyQuery check the query of cache key should be modified
+func (ck *CacheKey) ShouldModifyQuery() bool {
+	return ck.SortQuery || len(ck.IgnoreQueries) != 0
+}
+
 func (l *Location) getPriority() int {
 	priority := l.priority.Load()
 	if priority != 0 {
@@ -285,13 +334,37 @@ func convertConfigs(configs []config.LocationConfig) []Location {
 	// 将配置转换为header与url.values
 	for _, item := range configs {
 		d, _ := time.ParseDuration(item.ProxyTimeout)
+		// 配置已校验，因此忽略出错
+		maxRequestBodySize, _ := humanize.ParseBytes(item.MaxRequestBodySize)
+		maxResponseBodySize, _ := humanize.ParseBytes(item.MaxResponseBodySize)
+		streamThreshold, _ := humanize.ParseBytes(item.StreamThreshold)
+		upgradeIdleTimeout, _ := time.ParseDuration(item.UpgradeIdleTimeout)
 		l := Location{
-			Name:         item.Name,
-			Upstream:     item.Upstream,
-			Prefixes:     item.Prefixes,
-			Rewrites:     item.Rewrites,
-			Hosts:        item.Hosts,
-			ProxyTimeout: d,
+			Name:                item.Name,
+			Upstream:            item.Upstream,
+			Prefixes:            item.Prefixes,
+			Rewrites:            item.Rewrites,
+			Hosts:               item.Hosts,
+			ProxyTimeout:        d,
+			MaxRequestBodySize:  int(maxRequestBodySize),
+			MaxResponseBodySize: int(maxResponseBodySize),
+			Stream:              item.Stream,
+			StreamThreshold:     int(streamThreshold),
+			RangeFetchFull:      item.RangeFetchFull,
+			UpgradeIdleTimeout:  upgradeIdleTimeout,
+		}
+		if item.CacheKey != nil {
+			headers := make([]string, len(item.CacheKey.Headers))
+			for index, header := range item.CacheKey.Headers {
+				headers[index] = http.CanonicalHeaderKey(header)
+			}
+			l.CacheKey = &CacheKey{
+				IgnoreQueries: item.CacheKey.IgnoreQueries,
+				SortQuery:     item.CacheKey.SortQuery,
+				Headers:       headers,
+				Cookies:       item.CacheKey.Cookies,
+				IgnoreHost:    item.CacheKey.IgnoreHost,
+			}
 		}
 		l.ResponseHeader = fn(item.RespHeaders)
 		l.RequestHeader = fn(item.ReqHeaders)
@@ -191,6 +191,14 @@ func TestConvertConfig(t *testing.T) {
 			ReqHeaders:   reqHeaders,
 			RespHeaders:  respHeaders,
 			ProxyTimeout: "1m",
+			CacheKey: &config.CacheKeyConfig{
+				IgnoreQueries: []string{
+					"utm_*",
+				},
+				Headers: []string{
+					"x-device",
+				},
+			},
 		},
 	}
 	opts := convertConfigs(configs)
@@ -213,6 +221,30 @@ func TestConvertConfig(t *testing.T) {
 			"2",
 		},
 	}, opts[0].ResponseHeader)
+	assert.Equal(&CacheKey{
+		IgnoreQueries: []string{
+			"utm_*",
+		},
+		Headers: []string{
+			"X-Device",
+		},
+	}, opts[0].CacheKey)
+}
+
+func TestCacheKeyIgnoredQuery(t *testing.T) {
+	assert := assert.New(t)
+	ck := &CacheKey{}
+	assert.False(ck.ShouldModifyQuery())
+	assert.False(ck.IsIgnoredQuery("utm_source"))
+
+	ck.IgnoreQueries = []string{
+		"utm_*",
+		"t",
+	}
+	assert.True(ck.ShouldModifyQuery())
+	assert.True(ck.IsIgnoredQuery("utm_source"))
+	assert.True(ck.IsIgnoredQuery("t"))
+	assert.False(ck.IsIgnoredQuery("type"))
 }
 func TestDefaultLocations(t *testing.T) {
 	assert := assert.New(t)
@@ -16,6 +16,8 @@ import (
 	"github.com/vicanso/pike/config"
 	"github.com/vicanso/pike/location"
 	"github.com/vicanso/pike/log"
+	"github.com/vicanso/pike/metrics"
+	"github.com/vicanso/pike/ratelimit"
 	_ "github.com/vicanso/pike/schedule"
 	"github.com/vicanso/pike/server"
 	"github.com/vicanso/pike/upstream"
@@ -91,6 +93,8 @@ func update() (err error) {
 	compress.Reset(pikeConfig.Compresses)
 	// 重置默认dispatcher列表
 	cache.ResetDispatchers(pikeConfig.Caches)
+	// upstream重置后会重新检测状态，因此清除原有的状态指标
+	metrics.ResetUpstreamStatus()
 	// 重置默认的upstream列表
 	upstream.ResetWithOnStats(pikeConfig.Upstreams, func(si upstream.StatusInfo) {
 		log.Default().Info("upstream status change",
@@ -98,6 +102,7 @@ func update() (err error) {
 			zap.String("status", si.Status),
 			zap.String("addr", si.URL),
 		)
+		metrics.SetUpstreamStatus(si.Name, si.URL, si.Status == "healthy")
 
 		if si.Status == "sick" {
 			message := fmt.Sprintf("%s is %s, addr: %s", si.Name, si.Status, si.URL)
@@ -106,8 +111,12 @@ func update() (err error) {
 	})
 	// 重置location列表
 	location.Reset(pikeConfig.Locations)
+	// 重置location的限流
+	ratelimit.Reset(pikeConfig.Locations)
 
 	server.Reset(pikeConfig.Servers)
+	// 重置缓存预热任务
+	server.ResetWarmups(pikeConfig.Warmups)
 	return server.Start()
 }
 
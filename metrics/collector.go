@@ -0,0 +1,328 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 简单实现prometheus text format的指标收集，
+// 仅支持counter、gauge以及histogram，label的值按顺序传入
+
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// labelSeparator the separator of label values
+const labelSeparator = "\xff"
+
+type (
+	// collector the metric collector
+	collector interface {
+		write(w *bufio.Writer)
+	}
+	// metric the base of metric
+	metric struct {
+		mu     *sync.RWMutex
+		name   string
+		help   string
+		labels []string
+	}
+	// sample the sample of counter or gauge
+	sample struct {
+		labelValues []string
+		value       float64
+	}
+	// histogramSample the sample of histogram
+	histogramSample struct {
+		labelValues []string
+		// 各bucket的数量（非累计）
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+	// CounterVec counter with labels
+	CounterVec struct {
+		metric
+		samples map[string]*sample
+	}
+	// GaugeVec gauge with labels
+	GaugeVec struct {
+		metric
+		samples map[string]*sample
+	}
+	// GaugeValue the value of gauge with label values
+	GaugeValue struct {
+		LabelValues []string
+		Value       float64
+	}
+	// HistogramVec histogram with labels
+	HistogramVec struct {
+		metric
+		buckets []float64
+		samples map[string]*histogramSample
+	}
+	// Registry the registry of collectors
+	Registry struct {
+		mu         *sync.RWMutex
+		collectors []collector
+	}
+)
+
+func newMetric(name, help string, labels []string) metric {
+	return metric{
+		mu:     &sync.RWMutex{},
+		name:   name,
+		help:   help,
+		labels: labels,
+	}
+}
+
+// NewCounterVec create a counter with labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		metric:  newMetric(name, help, labels),
+		samples: make(map[string]*sample),
+	}
+}
+
+// NewGaugeVec create a gauge with labels
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{
+		metric:  newMetric(name, help, labels),
+		samples: make(map[string]*sample),
+	}
+}
+
+// NewHistogramVec create a histogram with labels, the buckets should be sorted
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		metric:  newMetric(name, help, labels),
+		buckets: buckets,
+		samples: make(map[string]*histogramSample),
+	}
+}
+
+// NewRegistry create a registry
+func NewRegistry() *Registry {
+	return &Registry{
+		mu: &sync.RWMutex{},
+	}
+}
+
+// getSample get the sample of label values, it should be called in lock
+func getSample(samples map[string]*sample, labelValues []string) *sample {
+	key := strings.Join(labelValues, labelSeparator)
+	s, ok := samples[key]
+	if !ok {
+		s = &sample{
+			labelValues: append([]string(nil), labelValues...),
+		}
+		samples[key] = s
+	}
+	return s
+}
+
+// Add add the value to the counter, the value should not be negative
+func (cv *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	getSample(cv.samples, labelValues).value += value
+}
+
+// Inc increase the counter
+func (cv *CounterVec) Inc(labelValues ...string) {
+	cv.Add(1, labelValues...)
+}
+
+// Set set the value of gauge
+func (gv *GaugeVec) Set(value float64, labelValues ...string) {
+	gv.mu.Lock()
+	defer gv.mu.Unlock()
+	getSample(gv.samples, labelValues).value = value
+}
+
+// Reset remove all the values of gauge
+func (gv *GaugeVec) Reset() {
+	gv.mu.Lock()
+	defer gv.mu.Unlock()
+	gv.samples = make(map[string]*sample)
+}
+
+// Replace replace all the values of gauge, the new values are built before
+// swapping in, so the collecting never gets the partial values
+func (gv *GaugeVec) Replace(values ...GaugeValue) {
+	samples := make(map[string]*sample, len(values))
+	for _, item := range values {
+		getSample(samples, item.LabelValues).value = item.Value
+	}
+	gv.mu.Lock()
+	defer gv.mu.Unlock()
+	gv.samples = samples
+}
+
+// Observe add the value to the histogram
+func (hv *HistogramVec) Observe(value float64, labelValues ...string) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	key := strings.Join(labelValues, labelSeparator)
+	s, ok := hv.samples[key]
+	if !ok {
+		s = &histogramSample{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(hv.buckets)),
+		}
+		hv.samples[key] = s
+	}
+	for i, bucket := range hv.buckets {
+		if value <= bucket {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// formatFloat format the float value
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	if math.IsInf(value, -1) {
+		return "-Inf"
+	}
+	if math.IsNaN(value) {
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapeLabelValue escape the label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatLabels format the labels, e.g.: {server=":3015",status="200"}
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	arr := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		arr = append(arr, name+`="`+escapeLabelValue(value)+`"`)
+	}
+	if extraName != "" {
+		arr = append(arr, extraName+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+	if len(arr) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(arr, ",") + "}"
+}
+
+// writeHeader write the help and type of metric
+func (m *metric) writeHeader(w *bufio.Writer, metricType string) {
+	_, _ = w.WriteString("# HELP " + m.name + " " + m.help + "\n")
+	_, _ = w.WriteString("# TYPE " + m.name + " " + metricType + "\n")
+}
+
+func writeSamples(w *bufio.Writer, m *metric, metricType string, samples map[string]*sample) {
+	m.writeHeader(w, metricType)
+	// 按label排序，保证每次输出的顺序一致
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := samples[key]
+		_, _ = w.WriteString(m.name + formatLabels(m.labels, s.labelValues, "", "") + " " + formatFloat(s.value) + "\n")
+	}
+}
+
+func (cv *CounterVec) write(w *bufio.Writer) {
+	cv.mu.RLock()
+	defer cv.mu.RUnlock()
+	writeSamples(w, &cv.metric, typeCounter, cv.samples)
+}
+
+func (gv *GaugeVec) write(w *bufio.Writer) {
+	gv.mu.RLock()
+	defer gv.mu.RUnlock()
+	writeSamples(w, &gv.metric, typeGauge, gv.samples)
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.mu.RLock()
+	defer hv.mu.RUnlock()
+	hv.writeHeader(w, typeHistogram)
+	keys := make([]string, 0, len(hv.samples))
+	for key := range hv.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := hv.samples[key]
+		// bucket的数量为累计值
+		var count uint64
+		for i, bucket := range hv.buckets {
+			count += s.counts[i]
+			_, _ = w.WriteString(hv.name + "_bucket" + formatLabels(hv.labels, s.labelValues, "le", formatFloat(bucket)) + " " + strconv.FormatUint(count, 10) + "\n")
+		}
+		_, _ = w.WriteString(hv.name + "_bucket" + formatLabels(hv.labels, s.labelValues, "le", "+Inf") + " " + strconv.FormatUint(s.count, 10) + "\n")
+		labels := formatLabels(hv.labels, s.labelValues, "", "")
+		_, _ = w.WriteString(hv.name + "_sum" + labels + " " + formatFloat(s.sum) + "\n")
+		_, _ = w.WriteString(hv.name + "_count" + labels + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+// Register register the collectors
+func (r *Registry) Register(collectors ...collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Write write the metrics of all collectors in prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range r.collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,143 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatFloat(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("+Inf", formatFloat(math.Inf(1)))
+	assert.Equal("-Inf", formatFloat(math.Inf(-1)))
+	assert.Equal("NaN", formatFloat(math.NaN()))
+	assert.Equal("0.005", formatFloat(0.005))
+	assert.Equal("10", formatFloat(10))
+}
+
+func TestFormatLabels(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("", formatLabels(nil, nil, "", ""))
+	assert.Equal(`{server=":3015",path="/\"a\"\\\n"}`, formatLabels([]string{
+		"server",
+		"path",
+	}, []string{
+		":3015",
+		"/\"a\"\\\n",
+	}, "", ""))
+	assert.Equal(`{server=":3015",le="0.1"}`, formatLabels([]string{
+		"server",
+	}, []string{
+		":3015",
+	}, "le", "0.1"))
+}
+
+func TestCollector(t *testing.T) {
+	assert := assert.New(t)
+	counter := NewCounterVec("test_total", "The test counter", "server")
+	counter.Inc(":3016")
+	counter.Add(2, ":3015")
+	// 不允许负数
+	counter.Add(-1, ":3015")
+
+	gauge := NewGaugeVec("test_gauge", "The test gauge", "server")
+	gauge.Set(1, ":3015")
+	gauge.Set(3, ":3015")
+
+	histogram := NewHistogramVec("test_seconds", "The test histogram", []float64{0.1, 1}, "server")
+	histogram.Observe(0.05, ":3015")
+	histogram.Observe(0.5, ":3015")
+	histogram.Observe(2, ":3015")
+
+	r := NewRegistry()
+	r.Register(counter, gauge, histogram)
+	buf := &bytes.Buffer{}
+	err := r.Write(buf)
+	assert.Nil(err)
+	assert.Equal(`# HELP test_total The test counter
+# TYPE test_total counter
+test_total{server=":3015"} 2
+test_total{server=":3016"} 1
+# HELP test_gauge The test gauge
+# TYPE test_gauge gauge
+test_gauge{server=":3015"} 3
+# HELP test_seconds The test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{server=":3015",le="0.1"} 1
+test_seconds_bucket{server=":3015",le="1"} 2
+test_seconds_bucket{server=":3015",le="+Inf"} 3
+test_seconds_sum{server=":3015"} 2.55
+test_seconds_count{server=":3015"} 3
+`, buf.String())
+
+	gauge.Reset()
+	buf.Reset()
+	err = r.Write(buf)
+	assert.Nil(err)
+	assert.NotContains(buf.String(), "test_gauge{")
+}
+
+func TestGaugeVecReplace(t *testing.T) {
+	assert := assert.New(t)
+	gauge := NewGaugeVec("test_entries", "The test gauge", "cache")
+	gauge.Set(1, "old")
+
+	r := NewRegistry()
+	r.Register(gauge)
+	gauge.Replace(GaugeValue{
+		LabelValues: []string{"default"},
+		Value:       1.5,
+	}, GaugeValue{
+		LabelValues: []string{"disk"},
+		Value:       2,
+	})
+	buf := &bytes.Buffer{}
+	err := r.Write(buf)
+	assert.Nil(err)
+	assert.Equal(`# HELP test_entries The test gauge
+# TYPE test_entries gauge
+test_entries{cache="default"} 1.5
+test_entries{cache="disk"} 2
+`, buf.String())
+}
+
+func TestRegistryTextFormat(t *testing.T) {
+	assert := assert.New(t)
+	counter := NewCounterVec("test_requests_total", "The test counter", "server", "path")
+	counter.Inc(":3015", "/\"a\"\\\n")
+
+	r := NewRegistry()
+	r.Register(counter)
+	buf := &bytes.Buffer{}
+	err := r.Write(buf)
+	assert.Nil(err)
+	// label的值需要转义反斜杠、双引号以及换行符
+	assert.Equal(`# HELP test_requests_total The test counter
+# TYPE test_requests_total counter
+test_requests_total{server=":3015",path="/\"a\"\\\n"} 1
+`, buf.String())
+}
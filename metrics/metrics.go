@@ -0,0 +1,162 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package metrics
+
+import (
+	"io"
+	"strconv"
+	"time"
+)
+
+var (
+	// defaultDurationBuckets the buckets of request duration(seconds)
+	defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	// compressDurationBuckets the buckets of compress duration(seconds)
+	compressDurationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5}
+	// compressRatioBuckets the buckets of compress ratio(compressed size / original size)
+	compressRatioBuckets = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1}
+)
+
+var (
+	requestTotal = NewCounterVec(
+		"pike_http_requests_total",
+		"The total number of http requests",
+		"server", "location", "upstream", "status",
+	)
+	requestDuration = NewHistogramVec(
+		"pike_http_request_duration_seconds",
+		"The duration of http requests",
+		defaultDurationBuckets,
+		"server", "location", "upstream",
+	)
+	cacheStatusTotal = NewCounterVec(
+		"pike_cache_status_total",
+		"The total number of http requests by cache status",
+		"server", "status",
+	)
+	cacheEntries = NewGaugeVec(
+		"pike_cache_entries",
+		"The count of http caches in memory",
+		"cache",
+	)
+	cacheBytes = NewGaugeVec(
+		"pike_cache_bytes",
+		"The bytes of http caches in memory",
+		"cache",
+	)
+	compressDuration = NewHistogramVec(
+		"pike_compress_duration_seconds",
+		"The duration of compression",
+		compressDurationBuckets,
+		"encoding",
+	)
+	compressRatio = NewHistogramVec(
+		"pike_compress_ratio",
+		"The ratio of compressed size to original size",
+		compressRatioBuckets,
+		"encoding",
+	)
+	upstreamHealthy = NewGaugeVec(
+		"pike_upstream_healthy",
+		"The health status of upstream server, 1 is healthy",
+		"upstream", "addr",
+	)
+)
+
+var defaultRegistry = NewRegistry()
+
+func init() {
+	defaultRegistry.Register(
+		requestTotal,
+		requestDuration,
+		cacheStatusTotal,
+		cacheEntries,
+		cacheBytes,
+		compressDuration,
+		compressRatio,
+		upstreamHealthy,
+	)
+}
+
+// ObserveRequest observe the http request
+func ObserveRequest(server, location, upstream string, status int, d time.Duration) {
+	requestTotal.Inc(server, location, upstream, strconv.Itoa(status))
+	requestDuration.Observe(d.Seconds(), server, location, upstream)
+}
+
+// IncCacheStatus increase the count of cache status
+func IncCacheStatus(server, status string) {
+	cacheStatusTotal.Inc(server, status)
+}
+
+// CacheStats the count and bytes of cache
+type CacheStats struct {
+	Name    string
+	Entries int
+	Bytes   uint64
+}
+
+// ReplaceCacheStats replace the stats of all caches
+func ReplaceCacheStats(stats []CacheStats) {
+	entries := make([]GaugeValue, len(stats))
+	bytes := make([]GaugeValue, len(stats))
+	for i, item := range stats {
+		entries[i] = GaugeValue{
+			LabelValues: []string{item.Name},
+			Value:       float64(item.Entries),
+		}
+		bytes[i] = GaugeValue{
+			LabelValues: []string{item.Name},
+			Value:       float64(item.Bytes),
+		}
+	}
+	cacheEntries.Replace(entries...)
+	cacheBytes.Replace(bytes...)
+}
+
+// ObserveCompress observe the duration and ratio of compression
+func ObserveCompress(encoding string, d time.Duration, size, compressedSize int) {
+	compressDuration.Observe(d.Seconds(), encoding)
+	if size > 0 {
+		compressRatio.Observe(float64(compressedSize)/float64(size), encoding)
+	}
+}
+
+// ResetUpstreamStatus reset the health status of upstreams
+func ResetUpstreamStatus() {
+	upstreamHealthy.Reset()
+}
+
+// SetUpstreamStatus set the health status of upstream server
+func SetUpstreamStatus(upstream, addr string, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	upstreamHealthy.Set(value, upstream, addr)
+}
+
+// Write write the default metrics in prometheus text format
+func Write(w io.Writer) error {
+	return defaultRegistry.Write(w)
+}
@@ -0,0 +1,71 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	ObserveRequest(":3015", "location-test", "upstream-test", 200, 10*time.Millisecond)
+	IncCacheStatus(":3015", "hit")
+	ReplaceCacheStats([]CacheStats{
+		{
+			Name:    "cache-test",
+			Entries: 10,
+			Bytes:   1024,
+		},
+	})
+	ObserveCompress("gzip", time.Millisecond, 100, 30)
+	SetUpstreamStatus("upstream-test", "http://127.0.0.1:3000", true)
+
+	buf := &bytes.Buffer{}
+	err := Write(buf)
+	assert.Nil(err)
+	str := buf.String()
+	for _, item := range []string{
+		`pike_http_requests_total{server=":3015",location="location-test",upstream="upstream-test",status="200"} 1`,
+		`pike_http_request_duration_seconds_bucket{server=":3015",location="location-test",upstream="upstream-test",le="0.01"} 1`,
+		`pike_cache_status_total{server=":3015",status="hit"} 1`,
+		`pike_cache_entries{cache="cache-test"} 10`,
+		`pike_cache_bytes{cache="cache-test"} 1024`,
+		`pike_compress_ratio_bucket{encoding="gzip",le="0.3"} 1`,
+		`pike_upstream_healthy{upstream="upstream-test",addr="http://127.0.0.1:3000"} 1`,
+	} {
+		assert.Contains(str, item)
+	}
+
+	ReplaceCacheStats(nil)
+	ResetUpstreamStatus()
+	buf.Reset()
+	err = Write(buf)
+	assert.Nil(err)
+	assert.NotContains(buf.String(), `pike_cache_entries{`)
+	assert.NotContains(buf.String(), `pike_upstream_healthy{`)
+}
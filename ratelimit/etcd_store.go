@@ -0,0 +1,177 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 通过etcd在多个实例之间共享限流计数，每个实例定时将此周期消耗的令牌数写入新的key
+//（key以实例标识与序号区分，使用短期的lease，过期后自动删除），
+// 并读取上次同步后其它实例写入的数据，由于是定时同步，因此多实例时限流存在一个同步周期的误差
+
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+const (
+	// etcdStoreTTL the ttl(seconds) of the consumed tokens in etcd
+	etcdStoreTTL = 10
+	// etcdStoreLeaseReuse the duration of reusing the lease, the keys are kept
+	// in etcd at least etcdStoreTTL - etcdStoreLeaseReuse seconds
+	etcdStoreLeaseReuse = 5 * time.Second
+	// etcdStoreTimeout the timeout of etcd request
+	etcdStoreTimeout = 3 * time.Second
+)
+
+// etcdStore the store which shares the consumed tokens by etcd
+type etcdStore struct {
+	mutex  *sync.Mutex
+	client *clientv3.Client
+	prefix string
+	// 当前实例的标识
+	id string
+	// 当前实例写入数据的序号
+	seq int64
+	// 各限流已读取数据的版本
+	revisions map[string]int64
+	// 当前使用的lease以及可使用的截止时间
+	leaseID    clientv3.LeaseID
+	leaseUntil time.Time
+}
+
+var (
+	defaultEtcdStore      *etcdStore
+	defaultEtcdStoreMutex = &sync.Mutex{}
+)
+
+// getEtcdStore get the etcd store of client, the store is reused if the client is not changed
+func getEtcdStore(client *clientv3.Client, key string) *etcdStore {
+	defaultEtcdStoreMutex.Lock()
+	defer defaultEtcdStoreMutex.Unlock()
+	if defaultEtcdStore == nil || defaultEtcdStore.client != client {
+		defaultEtcdStore = newEtcdStore(client, key+"-ratelimit/")
+	}
+	return defaultEtcdStore
+}
+
+func newEtcdStore(client *clientv3.Client, prefix string) *etcdStore {
+	hostname, _ := os.Hostname()
+	id := hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	return &etcdStore{
+		mutex:     &sync.Mutex{},
+		client:    client,
+		prefix:    prefix,
+		id:        id,
+		revisions: make(map[string]int64),
+	}
+}
+
+// getLease get the lease for the consumed tokens, the lease isn't kept alive
+// so the keys are removed after ttl, it is reused for a while to reduce the grant requests
+func (store *etcdStore) getLease(ctx context.Context) (clientv3.LeaseID, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	if store.leaseID != 0 && now.Before(store.leaseUntil) {
+		return store.leaseID, nil
+	}
+	lease, err := store.client.Grant(ctx, etcdStoreTTL)
+	if err != nil {
+		return 0, err
+	}
+	store.leaseID = lease.ID
+	store.leaseUntil = now.Add(etcdStoreLeaseReuse)
+	return lease.ID, nil
+}
+
+// nextKey get the key of this sync, each sync uses a new key so that
+// the consumed tokens aren't overwritten before other instances read them
+func (store *etcdStore) nextKey(prefix string) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.seq++
+	return prefix + store.id + "/" + strconv.FormatInt(store.seq, 10)
+}
+
+// Sync publish the consumed tokens of current instance to etcd,
+// and get the consumed tokens of other instances which are written since last sync
+func (store *etcdStore) Sync(name string, consumed map[string]int) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStoreTimeout)
+	defer cancel()
+	prefix := store.prefix + name + "/"
+	// 无消耗则不写入
+	if len(consumed) != 0 {
+		data, err := json.Marshal(consumed)
+		if err != nil {
+			return nil, err
+		}
+		leaseID, err := store.getLease(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, err = store.client.Put(ctx, store.nextKey(prefix), string(data), clientv3.WithLease(leaseID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	store.mutex.Lock()
+	revision, synced := store.revisions[name]
+	store.mutex.Unlock()
+	// 只读取上次同步后写入的数据
+	resp, err := store.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithMinModRev(revision+1))
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if resp.Header.Revision > store.revisions[name] {
+		store.revisions[name] = resp.Header.Revision
+	}
+	// 首次同步只记录版本，之前的消耗不再计入
+	if !synced {
+		return nil, nil
+	}
+	own := prefix + store.id + "/"
+	others := make(map[string]int)
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if strings.HasPrefix(key, own) {
+			continue
+		}
+		values := make(map[string]int)
+		// 数据异常的忽略
+		if json.Unmarshal(kv.Value, &values) != nil {
+			continue
+		}
+		for k, count := range values {
+			others[k] += count
+		}
+	}
+	return others, nil
+}
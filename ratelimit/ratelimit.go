@@ -0,0 +1,372 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 以location为单位使用令牌桶限流，可根据客户端IP、X-Forwarded-For、请求头或路径区分限流的key，
+// 计数保存在内存中，如需多个实例共享则定时通过store同步各实例消耗的令牌数
+
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vicanso/elton"
+	"github.com/vicanso/pike/config"
+	"github.com/vicanso/pike/log"
+	"github.com/vicanso/pike/util"
+	"go.uber.org/zap"
+)
+
+const (
+	// KeyIP limit by the ip of connection
+	KeyIP = "ip"
+	// KeyXFF limit by the client ip of X-Forwarded-For
+	KeyXFF = "xff"
+	// KeyPath limit by the path of url
+	KeyPath = "path"
+	// keyHeaderPrefix limit by request header, e.g.: header:X-Token
+	keyHeaderPrefix = "header:"
+)
+
+const (
+	// defaultSyncInterval the interval of syncing with store
+	defaultSyncInterval = time.Second
+	// cleanInterval the interval of removing the full buckets
+	cleanInterval = time.Minute
+)
+
+type (
+	// Option the option of limiter
+	Option struct {
+		// location的名称
+		Name string
+		// 每秒生成的令牌数
+		Rate float64
+		// 令牌桶的容量
+		Burst int
+		// 限流的key
+		Key string
+		// 是否在多个实例之间共享
+		Shared bool
+	}
+	// Store the store for sharing the consumed tokens between instances
+	Store interface {
+		// Sync publish the tokens consumed by current instance since last sync,
+		// and return the tokens consumed by other instances since last sync
+		Sync(name string, consumed map[string]int) (map[string]int, error)
+	}
+	// bucket the token bucket
+	bucket struct {
+		tokens    float64
+		updatedAt time.Time
+	}
+	// Limiter the token bucket limiter
+	Limiter struct {
+		mutex   *sync.Mutex
+		opt     Option
+		buckets map[string]*bucket
+		// 未同步至store的消耗令牌数
+		consumed  map[string]int
+		store     Store
+		cleanedAt time.Time
+		getKey    func(c *elton.Context) string
+		done      chan struct{}
+		closeOnce *sync.Once
+	}
+	// Limiters the limiters of locations
+	Limiters struct {
+		m *sync.Map
+	}
+)
+
+var defaultLimiters = NewLimiters()
+
+// fillDefault fill the default value of option
+func (opt *Option) fillDefault() {
+	// 默认容量为每秒的令牌数
+	if opt.Burst <= 0 {
+		opt.Burst = int(math.Max(1, math.Ceil(opt.Rate)))
+	}
+}
+
+// NewLimiter create a new limiter, the consumed tokens are synced
+// with store if the option is shared and store is not nil
+func NewLimiter(opt Option, store Store) *Limiter {
+	opt.fillDefault()
+	l := &Limiter{
+		mutex:     &sync.Mutex{},
+		opt:       opt,
+		buckets:   make(map[string]*bucket),
+		consumed:  make(map[string]int),
+		cleanedAt: time.Now(),
+		getKey:    newKeyGetter(opt.Key),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	if opt.Shared && store != nil {
+		l.store = store
+		go l.syncLoop(defaultSyncInterval)
+	}
+	return l
+}
+
+// getRemoteIP get the ip of connection
+func getRemoteIP(c *elton.Context) string {
+	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return ip
+}
+
+// newKeyGetter create the function to get the limit key of request
+func newKeyGetter(key string) func(c *elton.Context) string {
+	switch {
+	case key == KeyXFF:
+		return func(c *elton.Context) string {
+			return c.ClientIP()
+		}
+	case key == KeyPath:
+		return func(c *elton.Context) string {
+			return c.Request.URL.Path
+		}
+	case strings.HasPrefix(key, keyHeaderPrefix):
+		name := key[len(keyHeaderPrefix):]
+		return func(c *elton.Context) string {
+			value := c.GetRequestHeader(name)
+			// 无该请求头的则使用客户端IP，避免共用同一个令牌桶
+			if value == "" {
+				return getRemoteIP(c)
+			}
+			return keyHeaderPrefix + value
+		}
+	default:
+		return getRemoteIP
+	}
+}
+
+// refill refill the tokens of bucket by the elapsed time
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{
+			tokens:    float64(l.opt.Burst),
+			updatedAt: now,
+		}
+		l.buckets[key] = b
+		return b
+	}
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(l.opt.Burst), b.tokens+elapsed*l.opt.Rate)
+		b.updatedAt = now
+	}
+	return b
+}
+
+// clean remove the full buckets, they are the same as the new buckets
+func (l *Limiter) clean(now time.Time) {
+	if now.Sub(l.cleanedAt) < cleanInterval {
+		return
+	}
+	l.cleanedAt = now
+	for key := range l.buckets {
+		if l.refill(key, now).tokens >= float64(l.opt.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// take take a token of key, it returns the duration to wait if there is no token
+func (l *Limiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.clean(now)
+	b := l.refill(key, now)
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / l.opt.Rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	b.tokens--
+	if l.store != nil {
+		l.consumed[key]++
+	}
+	return true, 0
+}
+
+// consume remove the tokens which are consumed by other instances
+func (l *Limiter) consume(consumed map[string]int, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, count := range consumed {
+		b := l.refill(key, now)
+		b.tokens = math.Max(0, b.tokens-float64(count))
+	}
+}
+
+// Allow check the request is allowed or not, it returns the duration
+// to retry if the request is not allowed
+func (l *Limiter) Allow(c *elton.Context) (bool, time.Duration) {
+	return l.take(l.getKey(c), time.Now())
+}
+
+// sync publish the consumed tokens to store and remove the tokens
+// which are consumed by other instances
+func (l *Limiter) sync() error {
+	l.mutex.Lock()
+	consumed := l.consumed
+	l.consumed = make(map[string]int)
+	l.mutex.Unlock()
+
+	others, err := l.store.Sync(l.opt.Name, consumed)
+	if err != nil {
+		return err
+	}
+	l.consume(others, time.Now())
+	return nil
+}
+
+func (l *Limiter) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			err := l.sync()
+			if err != nil {
+				log.Default().Error("sync rate limit fail",
+					zap.String("name", l.opt.Name),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// Close stop syncing with store
+func (l *Limiter) Close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+// NewLimiters create limiters
+func NewLimiters() *Limiters {
+	return &Limiters{
+		m: &sync.Map{},
+	}
+}
+
+// Get get limiter by name
+func (ls *Limiters) Get(name string) *Limiter {
+	value, ok := ls.m.Load(name)
+	if !ok {
+		return nil
+	}
+	l, ok := value.(*Limiter)
+	if !ok {
+		return nil
+	}
+	return l
+}
+
+// Reset reset the limiters, the limiter is kept if its option is not changed
+func (ls *Limiters) Reset(opts []Option, store Store) {
+	// 删除不再使用的limiter
+	removed := util.MapDelete(ls.m, func(key string) bool {
+		for _, opt := range opts {
+			if opt.Name == key {
+				return false
+			}
+		}
+		return true
+	})
+	for _, value := range removed {
+		if l, ok := value.(*Limiter); ok {
+			l.Close()
+		}
+	}
+
+	for _, opt := range opts {
+		opt.fillDefault()
+		l := ls.Get(opt.Name)
+		// 配置未调整的保留原有的计数
+		if l != nil && l.opt == opt {
+			continue
+		}
+		if l != nil {
+			l.Close()
+		}
+		ls.m.Store(opt.Name, NewLimiter(opt, store))
+	}
+}
+
+func convertConfigs(configs []config.LocationConfig) []Option {
+	opts := make([]Option, 0)
+	for _, item := range configs {
+		if item.RateLimit == "" {
+			continue
+		}
+		rate, err := util.ParseRate(item.RateLimit)
+		if err != nil {
+			continue
+		}
+		opts = append(opts, Option{
+			Name:   item.Name,
+			Rate:   rate,
+			Burst:  item.RateLimitBurst,
+			Key:    item.RateLimitKey,
+			Shared: item.RateLimitShared,
+		})
+	}
+	return opts
+}
+
+// Get get limiter from default limiters
+func Get(name string) *Limiter {
+	return defaultLimiters.Get(name)
+}
+
+// Reset reset default limiters, the shared limiters are synced
+// with etcd if the config is stored in etcd
+func Reset(configs []config.LocationConfig) {
+	opts := convertConfigs(configs)
+	var store Store
+	for _, opt := range opts {
+		if !opt.Shared {
+			continue
+		}
+		client, key := config.GetEtcdClient()
+		if client == nil {
+			log.Default().Warn("rate limit is shared only if the config is stored in etcd")
+			break
+		}
+		store = getEtcdStore(client, key)
+		break
+	}
+	defaultLimiters.Reset(opts, store)
+}
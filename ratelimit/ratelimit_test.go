@@ -0,0 +1,204 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	"github.com/vicanso/pike/config"
+)
+
+type testStore struct {
+	consumed map[string]int
+	others   map[string]int
+}
+
+func (store *testStore) Sync(name string, consumed map[string]int) (map[string]int, error) {
+	store.consumed = consumed
+	return store.others, nil
+}
+
+func TestLimiterTake(t *testing.T) {
+	assert := assert.New(t)
+	l := NewLimiter(Option{
+		Rate:  2,
+		Burst: 3,
+	}, nil)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		allowed, _ := l.take("a", now)
+		assert.True(allowed)
+	}
+	allowed, retryAfter := l.take("a", now)
+	assert.False(allowed)
+	assert.Equal(500*time.Millisecond, retryAfter)
+
+	// 其它key不受影响
+	allowed, _ = l.take("b", now)
+	assert.True(allowed)
+
+	// 令牌按时间补充
+	allowed, _ = l.take("a", now.Add(500*time.Millisecond))
+	assert.True(allowed)
+	allowed, _ = l.take("a", now.Add(500*time.Millisecond))
+	assert.False(allowed)
+
+	// 已填满的令牌桶定时清除
+	l.take("c", now.Add(cleanInterval+time.Minute))
+	assert.Equal(1, len(l.buckets))
+}
+
+func TestLimiterDefaultBurst(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(5, NewLimiter(Option{
+		Rate: 4.5,
+	}, nil).opt.Burst)
+	assert.Equal(1, NewLimiter(Option{
+		Rate: 0.1,
+	}, nil).opt.Burst)
+}
+
+func TestKeyGetter(t *testing.T) {
+	assert := assert.New(t)
+	req := httptest.NewRequest("GET", "/users/me?type=1", nil)
+	req.RemoteAddr = "192.168.1.1:6001"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 192.168.1.2")
+	req.Header.Set("X-Token", "abc")
+	c := elton.NewContext(nil, req)
+
+	assert.Equal("192.168.1.1", newKeyGetter("")(c))
+	assert.Equal("192.168.1.1", newKeyGetter(KeyIP)(c))
+	assert.Equal("1.1.1.1", newKeyGetter(KeyXFF)(c))
+	assert.Equal("/users/me", newKeyGetter(KeyPath)(c))
+	assert.Equal("header:abc", newKeyGetter("header:X-Token")(c))
+	// 无该请求头则使用客户端IP
+	assert.Equal("192.168.1.1", newKeyGetter("header:X-User")(c))
+}
+
+func TestLimiterSync(t *testing.T) {
+	assert := assert.New(t)
+	store := &testStore{
+		others: map[string]int{
+			"a": 2,
+			"b": 10,
+		},
+	}
+	l := NewLimiter(Option{
+		Rate:  0.001,
+		Burst: 3,
+	}, nil)
+	// 未启用共享时不记录消耗的令牌数
+	l.take("a", time.Now())
+	assert.Empty(l.consumed)
+
+	l = NewLimiter(Option{
+		Rate:   0.001,
+		Burst:  3,
+		Shared: true,
+	}, store)
+	defer l.Close()
+	l.take("a", time.Now())
+	err := l.sync()
+	assert.Nil(err)
+	assert.Equal(map[string]int{
+		"a": 1,
+	}, store.consumed)
+	assert.Empty(l.consumed)
+
+	// 其它实例消耗的令牌也需要扣除
+	allowed, _ := l.take("a", time.Now())
+	assert.False(allowed)
+	allowed, _ = l.take("b", time.Now())
+	assert.False(allowed)
+}
+
+func TestLimiters(t *testing.T) {
+	assert := assert.New(t)
+	ls := NewLimiters()
+	ls.Reset([]Option{
+		{
+			Name: "a",
+			Rate: 10,
+		},
+		{
+			Name: "b",
+			Rate: 10,
+		},
+	}, nil)
+	a := ls.Get("a")
+	assert.NotNil(a)
+	assert.NotNil(ls.Get("b"))
+
+	// 配置未调整的limiter保留
+	ls.Reset([]Option{
+		{
+			Name: "a",
+			Rate: 10,
+		},
+		{
+			Name: "c",
+			Rate: 10,
+		},
+	}, nil)
+	assert.Same(a, ls.Get("a"))
+	assert.Nil(ls.Get("b"))
+	assert.NotNil(ls.Get("c"))
+
+	// 配置调整则重新创建
+	ls.Reset([]Option{
+		{
+			Name: "a",
+			Rate: 20,
+		},
+	}, nil)
+	assert.NotSame(a, ls.Get("a"))
+	assert.Nil(ls.Get("c"))
+}
+
+func TestResetDefaultLimiters(t *testing.T) {
+	assert := assert.New(t)
+	defer Reset(nil)
+	Reset([]config.LocationConfig{
+		{
+			Name:         "location-test",
+			RateLimit:    "60/m",
+			RateLimitKey: KeyPath,
+		},
+		{
+			Name: "location-no-limit",
+		},
+	})
+	l := Get("location-test")
+	assert.NotNil(l)
+	assert.Equal(Option{
+		Name:  "location-test",
+		Rate:  1,
+		Burst: 1,
+		Key:   KeyPath,
+	}, l.opt)
+	assert.Nil(Get("location-no-limit"))
+}
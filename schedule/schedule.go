@@ -29,10 +29,22 @@ import (
 	"go.uber.org/zap"
 )
 
+var defaultCron = cron.New()
+
 func init() {
-	c := cron.New()
-	_, _ = c.AddFunc("@every 1m", cpuUsageStats)
-	c.Start()
+	_, _ = defaultCron.AddFunc("@every 1m", cpuUsageStats)
+	defaultCron.Start()
+}
+
+// Add add the function to be run on the spec, it returns the id of the entry
+func Add(spec string, fn func()) (int, error) {
+	id, err := defaultCron.AddFunc(spec, fn)
+	return int(id), err
+}
+
+// Remove remove the entry of id
+func Remove(id int) {
+	defaultCron.Remove(cron.EntryID(id))
 }
 
 // cpuUsageStats update cpu usage
@@ -28,6 +28,9 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gobuffalo/packr/v2"
@@ -38,6 +41,8 @@ import (
 	"github.com/vicanso/pike/cache"
 	"github.com/vicanso/pike/config"
 	"github.com/vicanso/pike/log"
+	"github.com/vicanso/pike/metrics"
+	"github.com/vicanso/pike/stats"
 	"github.com/vicanso/pike/upstream"
 	"github.com/vicanso/pike/util"
 	"go.uber.org/zap"
@@ -67,6 +72,21 @@ type (
 		*app.Info
 		Processing map[string]int32 `json:"processing,omitempty"`
 	}
+	// purgeResult purge cache result
+	purgeResult struct {
+		Count int `json:"count"`
+	}
+	// cacheListResult cache list result
+	cacheListResult struct {
+		Count  int                    `json:"count"`
+		Caches []*cache.HTTPCacheInfo `json:"caches"`
+	}
+	// cacheDetail cache detail
+	cacheDetail struct {
+		*cache.HTTPCacheInfo
+		StatusCode int         `json:"statusCode,omitempty"`
+		Header     http.Header `json:"header,omitempty"`
+	}
 )
 
 var webBox = packr.New("web", "../web")
@@ -77,6 +97,35 @@ var accountOrPasswordIsWrong = util.NewError("Account or password is wrong", htt
 
 var cacheKeyIsNil = util.NewError("The key of cache can't be null", http.StatusBadRequest)
 
+var cachePrefixIsNil = util.NewError("The prefix of cache can't be null", http.StatusBadRequest)
+
+var cacheRegexpIsInvalid = util.NewError("The regexp of cache is invalid", http.StatusBadRequest)
+
+var cacheTagIsNil = util.NewError("The tag of cache can't be null", http.StatusBadRequest)
+
+var cacheNotFound = util.NewError("The cache is not found", http.StatusNotFound)
+
+var purgeModeIsInvalid = util.NewError("The mode of purge should be hard or soft", http.StatusBadRequest)
+
+var statsWindowIsInvalid = util.NewError("The window of stats should be 1m, 5m or 1h", http.StatusBadRequest)
+
+const (
+	// purgeModeHard 删除缓存
+	purgeModeHard = "hard"
+	// purgeModeSoft 仅将缓存设置为过期，可用于后台更新与stale-if-error
+	purgeModeSoft = "soft"
+)
+
+// defaultCacheListLimit default limit of cache list
+const defaultCacheListLimit = 20
+
+// statsWindows the windows of stats
+var statsWindows = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+}
+
 const jwtCookie = "pike"
 
 // Exists Test whether or not the given path exists
@@ -188,6 +237,7 @@ func updateServerStatus(conf *config.PikeConfig) {
 			for _, status := range statusList {
 				if server.Addr == status.Addr {
 					server.Healthy = status.Healthy
+					server.Circuit = status.Circuit
 				}
 			}
 			servers[j] = server
@@ -269,6 +319,18 @@ func getApplicationInfo(c *elton.Context) (err error) {
 	return
 }
 
+// isSoftPurge check the purge mode is soft, the default mode is hard
+func isSoftPurge(c *elton.Context) (bool, error) {
+	switch c.QueryParam("mode") {
+	case "", purgeModeHard:
+		return false, nil
+	case purgeModeSoft:
+		return true, nil
+	default:
+		return false, purgeModeIsInvalid
+	}
+}
+
 // removeCache 删除缓存
 func removeCache(c *elton.Context) (err error) {
 	key := c.QueryParam("key")
@@ -276,13 +338,266 @@ func removeCache(c *elton.Context) (err error) {
 		err = cacheKeyIsNil
 		return
 	}
+	soft, err := isSoftPurge(c)
+	if err != nil {
+		return
+	}
+	if soft {
+		cache.SoftRemoveHTTPCache(c.QueryParam("cache"), []byte(key))
+		c.NoContent()
+		return
+	}
 	cache.RemoveHTTPCache(c.QueryParam("cache"), []byte(key))
 	c.NoContent()
 	return
 }
 
-// StartAdminServer start admin server
-func StartAdminServer(config AdminServerConfig) (err error) {
+// purgeCacheByPrefix 根据key的前缀删除缓存，如：GET example.com /api/products/*
+func purgeCacheByPrefix(c *elton.Context) (err error) {
+	prefix := strings.TrimSuffix(c.QueryParam("prefix"), "*")
+	if prefix == "" {
+		err = cachePrefixIsNil
+		return
+	}
+	soft, err := isSoftPurge(c)
+	if err != nil {
+		return
+	}
+	c.Body = &purgeResult{
+		Count: cache.PurgeByPrefix(c.QueryParam("cache"), prefix, soft),
+	}
+	return
+}
+
+// purgeCacheByRegexp 根据正则删除缓存
+func purgeCacheByRegexp(c *elton.Context) (err error) {
+	value := c.QueryParam("regexp")
+	if value == "" {
+		err = cacheRegexpIsInvalid
+		return
+	}
+	reg, e := regexp.Compile(value)
+	if e != nil {
+		err = cacheRegexpIsInvalid
+		return
+	}
+	soft, err := isSoftPurge(c)
+	if err != nil {
+		return
+	}
+	c.Body = &purgeResult{
+		Count: cache.PurgeByRegexp(c.QueryParam("cache"), reg, soft),
+	}
+	return
+}
+
+// purgeCacheByTag 根据响应头Surrogate-Key或Cache-Tag中的tag删除缓存
+func purgeCacheByTag(c *elton.Context) (err error) {
+	tag := c.QueryParam("tag")
+	if tag == "" {
+		err = cacheTagIsNil
+		return
+	}
+	soft, err := isSoftPurge(c)
+	if err != nil {
+		return
+	}
+	c.Body = &purgeResult{
+		Count: cache.PurgeByTag(c.QueryParam("cache"), tag, soft),
+	}
+	return
+}
+
+// listCache 分页获取缓存列表
+func listCache(c *elton.Context) (err error) {
+	disp := cache.GetDispatcher(c.QueryParam("cache"))
+	if disp == nil {
+		err = ErrCacheDispatcherNotFound
+		return
+	}
+	offset, _ := strconv.Atoi(c.QueryParam("offset"))
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if limit <= 0 {
+		limit = defaultCacheListLimit
+	}
+	count, infos := disp.GetHTTPCacheInfos(offset, limit)
+	c.Body = &cacheListResult{
+		Count:  count,
+		Caches: infos,
+	}
+	return
+}
+
+// getCacheStatusCounts 获取各缓存状态的数量
+func getCacheStatusCounts(c *elton.Context) (err error) {
+	disp := cache.GetDispatcher(c.QueryParam("cache"))
+	if disp == nil {
+		err = ErrCacheDispatcherNotFound
+		return
+	}
+	c.Body = disp.GetStatusCounts()
+	return
+}
+
+// getCacheResponse get the cache and its response
+func getCacheResponse(c *elton.Context) (*cache.HTTPCacheInfo, *cache.HTTPResponse, error) {
+	disp := cache.GetDispatcher(c.QueryParam("cache"))
+	if disp == nil {
+		return nil, nil, ErrCacheDispatcherNotFound
+	}
+	key := c.QueryParam("key")
+	if key == "" {
+		return nil, nil, cacheKeyIsNil
+	}
+	hc := disp.PeekHTTPCache([]byte(key))
+	if hc == nil {
+		return nil, nil, cacheNotFound
+	}
+	info := hc.GetInfo()
+	info.Key = key
+	return info, hc.GetResponse(), nil
+}
+
+// getCache 获取缓存的信息与响应头
+func getCache(c *elton.Context) (err error) {
+	info, resp, err := getCacheResponse(c)
+	if err != nil {
+		return
+	}
+	detail := &cacheDetail{
+		HTTPCacheInfo: info,
+	}
+	if resp != nil {
+		detail.StatusCode = resp.StatusCode
+		detail.Header = resp.Header
+	}
+	c.Body = detail
+	return
+}
+
+// getCacheBody 获取缓存的响应数据（未压缩）
+func getCacheBody(c *elton.Context) (err error) {
+	_, resp, err := getCacheResponse(c)
+	if err != nil {
+		return
+	}
+	if resp == nil {
+		err = cacheNotFound
+		return
+	}
+	body, err := resp.GetRawBody()
+	if err != nil {
+		return
+	}
+	c.SetHeader(elton.HeaderContentType, resp.Header.Get(elton.HeaderContentType))
+	c.BodyBuffer = bytes.NewBuffer(body)
+	return
+}
+
+// listWarmup 获取预热任务列表及其执行进度
+func listWarmup(c *elton.Context) (err error) {
+	c.Body = ListWarmupProgress()
+	return
+}
+
+// getWarmup 获取预热任务的执行进度
+func getWarmup(c *elton.Context) (err error) {
+	w := GetWarmup(c.Param("name"))
+	if w == nil {
+		err = ErrWarmupNotFound
+		return
+	}
+	c.Body = w.GetProgress()
+	return
+}
+
+// startWarmup 执行已配置的预热任务
+func startWarmup(c *elton.Context) (err error) {
+	w := GetWarmup(c.Param("name"))
+	if w == nil {
+		err = ErrWarmupNotFound
+		return
+	}
+	err = w.Start()
+	if err != nil {
+		return
+	}
+	c.Created(w.GetProgress())
+	return
+}
+
+// addWarmup 添加并执行预热任务（不保存至配置）
+func addWarmup(c *elton.Context) (err error) {
+	conf := config.WarmupConfig{}
+	err = json.Unmarshal(c.RequestBody, &conf)
+	if err != nil {
+		return
+	}
+	err = conf.Validate()
+	if err != nil {
+		err = util.NewError(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if Get(conf.Server) == nil {
+		err = util.NewError(config.ErrServerNotFound.Error(), http.StatusBadRequest)
+		return
+	}
+	w := AddWarmup(conf)
+	err = w.Start()
+	if err != nil {
+		return
+	}
+	c.Created(w.GetProgress())
+	return
+}
+
+// getMetrics 获取prometheus的指标
+func getMetrics(c *elton.Context) (err error) {
+	// 缓存的数量与尺寸在获取时更新，生成完整的数据后再替换，避免并发获取时数据不完整
+	dispatcherStats := cache.GetDispatcherStats()
+	cacheStats := make([]metrics.CacheStats, len(dispatcherStats))
+	for i, item := range dispatcherStats {
+		cacheStats[i] = metrics.CacheStats{
+			Name:    item.Name,
+			Entries: item.Len,
+			Bytes:   item.Bytes,
+		}
+	}
+	metrics.ReplaceCacheStats(cacheStats)
+	buf := &bytes.Buffer{}
+	err = metrics.Write(buf)
+	if err != nil {
+		return
+	}
+	c.SetHeader(elton.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.BodyBuffer = buf
+	return
+}
+
+// getStats 获取各location与upstream的统计，可指定window，默认返回所有window
+func getStats(c *elton.Context) (err error) {
+	window := c.QueryParam("window")
+	if window != "" {
+		duration, ok := statsWindows[window]
+		if !ok {
+			err = statsWindowIsInvalid
+			return
+		}
+		c.Body = map[string]*stats.WindowSummary{
+			window: stats.GetSummary(duration),
+		}
+		return
+	}
+	result := make(map[string]*stats.WindowSummary)
+	for name, duration := range statsWindows {
+		result[name] = stats.GetSummary(duration)
+	}
+	c.Body = result
+	return
+}
+
+// newAdminServer create the elton instance of admin server
+func newAdminServer(config AdminServerConfig) *elton.Elton {
 	logger := log.Default()
 	ttlToken := &jwt.TTLToken{
 		TTL: 24 * time.Hour,
@@ -359,9 +674,24 @@ func StartAdminServer(config AdminServerConfig) (err error) {
 	e.GET("/me", jwtPassthrough, newUserMeHandler(config.User))
 
 	e.GET("/application-info", getApplicationInfo)
+	e.GET("/metrics", getMetrics)
+	e.GET("/stats", getStats)
 
 	// 缓存
 	e.DELETE("/cache", removeCache)
+	e.DELETE("/cache/prefix", isLogin, purgeCacheByPrefix)
+	e.DELETE("/cache/regexp", isLogin, purgeCacheByRegexp)
+	e.DELETE("/cache/tag", isLogin, purgeCacheByTag)
+	e.GET("/caches", isLogin, listCache)
+	e.GET("/caches/status-counts", isLogin, getCacheStatusCounts)
+	e.GET("/cache", isLogin, getCache)
+	e.GET("/cache/body", isLogin, getCacheBody)
+
+	// 缓存预热
+	e.GET("/warmups", isLogin, listWarmup)
+	e.POST("/warmups", isLogin, addWarmup)
+	e.GET("/warmups/:name", isLogin, getWarmup)
+	e.POST("/warmups/:name", isLogin, startWarmup)
 
 	e.GET("/ping", func(c *elton.Context) error {
 		c.BodyBuffer = bytes.NewBufferString("pong")
@@ -384,7 +714,13 @@ func StartAdminServer(config AdminServerConfig) (err error) {
 		c.NoContent()
 		return nil
 	})
-	logger.Info("start admin server",
+	return e
+}
+
+// StartAdminServer start admin server
+func StartAdminServer(config AdminServerConfig) (err error) {
+	e := newAdminServer(config)
+	log.Default().Info("start admin server",
 		zap.String("addr", config.Addr),
 	)
 	return e.ListenAndServe(config.Addr)
@@ -0,0 +1,72 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminPurgeCacheRequireLogin(t *testing.T) {
+	assert := assert.New(t)
+	e := newAdminServer(AdminServerConfig{
+		User:     "admin",
+		Password: "password",
+	})
+
+	urls := []string{
+		"/cache/prefix?prefix=/api",
+		"/cache/regexp?regexp=^/api",
+		"/cache/tag?tag=goods",
+	}
+	// 未登录时批量删除缓存被拒绝
+	for _, url := range urls {
+		req := httptest.NewRequest("DELETE", url, nil)
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		assert.Equal(http.StatusUnauthorized, resp.Code, url)
+	}
+
+	// 登录后可以批量删除缓存
+	req := httptest.NewRequest("POST", "/login", bytes.NewBufferString(`{"account":"admin","password":"password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	assert.Equal(http.StatusOK, resp.Code)
+	cookies := resp.Result().Cookies()
+	assert.NotEmpty(cookies)
+
+	for _, url := range urls {
+		req := httptest.NewRequest("DELETE", url, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		assert.Equal(http.StatusOK, resp.Code, url)
+	}
+}
@@ -23,10 +23,18 @@
 package server
 
 import (
+	"context"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/vicanso/elton"
 	"github.com/vicanso/pike/cache"
+	"github.com/vicanso/pike/location"
+	"github.com/vicanso/pike/upstream"
+	"github.com/vicanso/pike/util"
 )
 
 const (
@@ -34,8 +42,39 @@ const (
 	spaceByte = byte(' ')
 )
 
+type contextKey string
+
+// revalidateContextKey 标记该请求为后台更新缓存的请求
+const revalidateContextKey contextKey = "revalidate"
+
+// newRevalidateRequest create a request for revalidating the stale cache,
+// it uses a new context because the original request may be finished
+func newRevalidateRequest(req *http.Request) *http.Request {
+	ctx := context.WithValue(context.Background(), revalidateContextKey, true)
+	return req.Clone(ctx)
+}
+
+// isRevalidateRequest check the request is revalidate request
+func isRevalidateRequest(req *http.Request) bool {
+	v, _ := req.Context().Value(revalidateContextKey).(bool)
+	return v
+}
+
+// isFetchFail check the fetch is fail, error or 5xx response
+func isFetchFail(c *elton.Context, err error) bool {
+	if err != nil {
+		return true
+	}
+	httpResp := getHTTPResp(c)
+	return httpResp != nil && httpResp.StatusCode >= http.StatusInternalServerError
+}
+
 // requestIsPass check request is passed
 func requestIsPass(req *http.Request) bool {
+	// upgrade的请求（如websocket）与server-sent events的请求直接pass
+	if util.IsUpgradeRequest(req) || util.IsEventStreamRequest(req) {
+		return true
+	}
 	// 非GET HEAD 的请求均直接pass
 	return req.Method != http.MethodGet &&
 		req.Method != http.MethodHead
@@ -71,6 +110,139 @@ func getKey(req *http.Request) []byte {
 	return buffer
 }
 
+// getCacheKey get key of request by the cache key option of location
+func getCacheKey(req *http.Request, ck *location.CacheKey) []byte {
+	if ck == nil {
+		return getKey(req)
+	}
+	uri := req.RequestURI
+	if len(uri) == 0 {
+		uri = req.URL.String()
+	}
+	if ck.ShouldModifyQuery() {
+		if index := strings.IndexByte(uri, '?'); index != -1 {
+			// 按原有的顺序处理，避免url.Values重新编码
+			queries := make([]string, 0)
+			for _, item := range strings.Split(uri[index+1:], "&") {
+				if item == "" {
+					continue
+				}
+				name := item
+				if i := strings.IndexByte(item, '='); i != -1 {
+					name = item[:i]
+				}
+				if v, err := url.QueryUnescape(name); err == nil {
+					name = v
+				}
+				if ck.IsIgnoredQuery(name) {
+					continue
+				}
+				queries = append(queries, item)
+			}
+			if ck.SortQuery {
+				sort.Strings(queries)
+			}
+			uri = uri[:index]
+			if len(queries) != 0 {
+				uri += "?" + strings.Join(queries, "&")
+			}
+		}
+	}
+
+	buffer := make([]byte, 0, len(req.Method)+len(req.Host)+len(uri)+2)
+	buffer = append(buffer, req.Method...)
+	buffer = append(buffer, spaceByte)
+	if !ck.IgnoreHost {
+		buffer = append(buffer, req.Host...)
+		buffer = append(buffer, spaceByte)
+	}
+	buffer = append(buffer, uri...)
+	for _, name := range ck.Headers {
+		buffer = append(buffer, spaceByte)
+		buffer = append(buffer, name...)
+		buffer = append(buffer, '=')
+		buffer = append(buffer, strings.Join(req.Header.Values(name), ",")...)
+	}
+	for _, name := range ck.Cookies {
+		buffer = append(buffer, spaceByte)
+		buffer = append(buffer, "cookie:"...)
+		buffer = append(buffer, name...)
+		buffer = append(buffer, '=')
+		if cookie, err := req.Cookie(name); err == nil {
+			buffer = append(buffer, cookie.Value...)
+		}
+	}
+	return buffer
+}
+
+// getVary get the request headers of vary, the accept-encoding will be ignored
+// because the compression is handled by pike. If vary is *, all will be true.
+func getVary(header http.Header) (vary []string, all bool) {
+	for _, value := range header.Values(headerVary) {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if item == "*" {
+				return nil, true
+			}
+			name := textproto.CanonicalMIMEHeaderKey(item)
+			if name == elton.HeaderAcceptEncoding {
+				continue
+			}
+			exists := false
+			for _, v := range vary {
+				if v == name {
+					exists = true
+					break
+				}
+			}
+			if !exists {
+				vary = append(vary, name)
+			}
+		}
+	}
+	sort.Strings(vary)
+	return
+}
+
+// isSameVary check the vary is the same
+func isSameVary(vary1, vary2 []string) bool {
+	if len(vary1) != len(vary2) {
+		return false
+	}
+	for i, v := range vary1 {
+		if vary2[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// getVaryKey get the key of variant, the values of request headers will be normalized
+func getVaryKey(key []byte, vary []string, req *http.Request) []byte {
+	buffer := make([]byte, 0, len(key)+64)
+	buffer = append(buffer, key...)
+	buffer = append(buffer, spaceByte)
+	for i, name := range vary {
+		if i != 0 {
+			buffer = append(buffer, '&')
+		}
+		values := req.Header.Values(name)
+		value := strings.ToLower(strings.Join(values, ","))
+		// 去除逗号间的空格
+		arr := strings.Split(value, ",")
+		for j, v := range arr {
+			arr[j] = strings.TrimSpace(v)
+		}
+		buffer = append(buffer, name...)
+		buffer = append(buffer, '=')
+		buffer = append(buffer, strings.Join(arr, ",")...)
+	}
+	return buffer
+}
+
 // NewCache new a cache middleware
 func NewCache(s *server) elton.Handler {
 	return func(c *elton.Context) (err error) {
@@ -85,24 +257,65 @@ func NewCache(s *server) elton.Handler {
 			return
 		}
 
-		key := getKey(c.Request)
-		httpCache := disp.GetHTTPCache(key)
-		cacheStatus, httpResp := httpCache.Get()
+		var ck *location.CacheKey
+		rangeFetchFull := false
+		if l := s.resolveLocation(c); l != nil {
+			ck = l.CacheKey
+			rangeFetchFull = l.RangeFetchFull
+		}
+		baseKey := getCacheKey(c.Request, ck)
+		httpCache := disp.GetHTTPCache(baseKey)
+		// 基础缓存，如果响应有Vary，则只用于记录Vary
+		baseCache := httpCache
+		if vary := baseCache.GetVary(); len(vary) != 0 {
+			key := getVaryKey(baseKey, vary, c.Request)
+			// 超出最大数量的则直接pass
+			if !baseCache.AddVariant(string(key), disp.GetMaxVariants()) {
+				setCacheStatus(c, cache.StatusPassed)
+				return c.Next()
+			}
+			httpCache = disp.GetVariantHTTPCache(baseCache, key)
+		}
+		var cacheStatus cache.Status
+		var httpResp *cache.HTTPResponse
+		revalidating := isRevalidateRequest(c.Request)
+		// 后台更新缓存的请求直接转发，不影响其它请求使用过期数据
+		switch {
+		case revalidating:
+			cacheStatus = cache.StatusFetching
+		// range请求如果不获取完整数据，upstream返回的206不可缓存，
+		// 因此只使用已有的缓存，未命中则pass，不影响其它请求生成缓存
+		case !rangeFetchFull && c.GetRequestHeader(headerRange) != "":
+			cacheStatus, httpResp = httpCache.Peek()
+		default:
+			cacheStatus, httpResp = httpCache.Get()
+		}
 
 		cacheable := false
+		stale := false
 		// 对于fetching类的请求，如果最终是不可缓存的，则设置hit for pass
 		// 保证只要不是panic，fetching的请求非可缓存的都为hit for pass
 		if cacheStatus == cache.StatusFetching {
 			defer func() {
-				if !cacheable {
-					httpCache.HitForPass(disp.GetHitForPass())
+				if cacheable || stale {
+					return
+				}
+				// 后台更新失败，继续使用过期数据（一段时间后才再次后台更新）
+				if revalidating && isFetchFail(c, err) {
+					httpCache.StopRevalidating()
+					return
 				}
+				httpCache.HitForPass(disp.GetHitForPass())
 			}()
 		}
 
 		setCacheStatus(c, cacheStatus)
 		// 缓存中读取的可缓存数据，不需要next
-		if cacheStatus == cache.StatusHit {
+		if cacheStatus == cache.StatusHit || cacheStatus == cache.StatusStale {
+			// 过期数据则后台更新（只有一个请求触发）
+			if cacheStatus == cache.StatusStale && httpCache.StartRevalidating() {
+				go s.fetch(newRevalidateRequest(c.Request))
+			}
 			// 设置缓存数据
 			setHTTPResp(c, httpResp)
 			// 设置缓存数据的age
@@ -110,7 +323,30 @@ func NewCache(s *server) elton.Handler {
 			return nil
 		}
 
+		// 如果有已过期的缓存数据，则可用于向upstream发送条件请求
+		if cacheStatus == cache.StatusFetching {
+			if expiredResp := httpCache.GetResponse(); expiredResp != nil {
+				setExpiredHTTPResp(c, expiredResp)
+			}
+		}
+
 		err = c.Next()
+		// 获取数据失败时，如果可使用过期数据，则返回过期数据
+		if cacheStatus == cache.StatusFetching && !revalidating && isFetchFail(c, err) {
+			staleResp := httpCache.StaleIfError()
+			// upstream熔断时，只要有过期数据则返回
+			if staleResp == nil && err == upstream.ErrCircuitOpen {
+				staleResp = httpCache.Stale()
+			}
+			if staleResp != nil {
+				stale = true
+				err = nil
+				setCacheStatus(c, cache.StatusStale)
+				setHTTPResp(c, staleResp)
+				setHTTPRespAge(c, httpCache.Age())
+				return nil
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -121,10 +357,32 @@ func NewCache(s *server) elton.Handler {
 		if cacheStatus == cache.StatusFetching {
 			// 获取缓存有效期
 			if maxAge := getHTTPCacheMaxAge(c); maxAge > 0 {
-				// 只有有响应数据可缓存时才设置为cacheable
-				if httpResp = getHTTPResp(c); httpResp != nil {
-					cacheable = true
-					httpCache.Cacheable(httpResp, maxAge)
+				// 只有有响应数据且未超出缓存尺寸限制时才设置为cacheable
+				if httpResp = getHTTPResp(c); httpResp != nil && disp.IsStorable(httpResp) {
+					target := httpCache
+					vary, all := getVary(httpResp.Header)
+					switch {
+					// Vary: * 不可缓存
+					case all:
+						target = nil
+					// 响应的Vary与当前记录的不一致（如首次响应带有Vary），则更新Vary，
+					// 并将此次响应保存至对应的Vary缓存，当前缓存则设置为hit for pass
+					case !isSameVary(vary, baseCache.GetVary()):
+						baseCache.SetVary(vary)
+						target = baseCache
+						if len(vary) != 0 {
+							key := getVaryKey(baseKey, vary, c.Request)
+							target = nil
+							if baseCache.AddVariant(string(key), disp.GetMaxVariants()) {
+								target = disp.GetVariantHTTPCache(baseCache, key)
+							}
+						}
+					}
+					if target != nil {
+						cacheable = target == httpCache
+						staleWhileRevalidate, staleIfError := getHTTPCacheStale(c)
+						target.CacheableWithStale(httpResp, maxAge, staleWhileRevalidate, staleIfError)
+					}
 				}
 			}
 		}
@@ -23,13 +23,18 @@
 package server
 
 import (
+	"errors"
+	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/vicanso/elton"
 	"github.com/vicanso/pike/cache"
 	"github.com/vicanso/pike/config"
+	"github.com/vicanso/pike/location"
+	"github.com/vicanso/pike/upstream"
 )
 
 func TestRequestIsPass(t *testing.T) {
@@ -39,6 +44,17 @@ func TestRequestIsPass(t *testing.T) {
 	assert.True(requestIsPass(httptest.NewRequest("PUT", "/", nil)))
 	assert.False(requestIsPass(httptest.NewRequest("GET", "/", nil)))
 	assert.False(requestIsPass(httptest.NewRequest("HEAD", "/", nil)))
+
+	// upgrade的请求
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	assert.True(requestIsPass(req))
+
+	// server-sent events的请求
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	assert.True(requestIsPass(req))
 }
 
 func TestGetKey(t *testing.T) {
@@ -124,3 +140,324 @@ func TestCacheMiddleware(t *testing.T) {
 	}
 
 }
+
+func TestCacheMiddlewareRange(t *testing.T) {
+	assert := assert.New(t)
+
+	cacheName := "range-test"
+	cache.ResetDispatchers([]config.CacheConfig{
+		{
+			Name: cacheName,
+			Size: 100,
+		},
+	})
+	fn := NewCache(NewServer(ServerOption{
+		Cache: cacheName,
+	}))
+	newContext := func(rangeValue string) *elton.Context {
+		req := httptest.NewRequest("GET", "/range", nil)
+		if rangeValue != "" {
+			req.Header.Set(headerRange, rangeValue)
+		}
+		c := elton.NewContext(httptest.NewRecorder(), req)
+		c.Next = func() error {
+			return nil
+		}
+		return c
+	}
+
+	// 未命中的range请求直接pass，不设置为hit for pass
+	c := newContext("bytes=0-4")
+	c.Next = func() error {
+		setHTTPCacheMaxAge(c, 10)
+		setHTTPResp(c, &cache.HTTPResponse{
+			StatusCode: http.StatusPartialContent,
+		})
+		return nil
+	}
+	err := fn(c)
+	assert.Nil(err)
+	assert.Equal(cache.StatusPassed, getCacheStatus(c))
+
+	// 完整数据的请求仍可生成缓存
+	c = newContext("")
+	c.Next = func() error {
+		setHTTPCacheMaxAge(c, 10)
+		setHTTPResp(c, &cache.HTTPResponse{
+			StatusCode: http.StatusOK,
+		})
+		return nil
+	}
+	err = fn(c)
+	assert.Nil(err)
+	assert.Equal(cache.StatusFetching, getCacheStatus(c))
+
+	// range请求使用已有的缓存
+	c = newContext("bytes=0-4")
+	err = fn(c)
+	assert.Nil(err)
+	assert.Equal(cache.StatusHit, getCacheStatus(c))
+}
+
+func TestCacheMiddlewareStaleIfError(t *testing.T) {
+	assert := assert.New(t)
+
+	cacheName := "testStale"
+	cache.ResetDispatchers([]config.CacheConfig{
+		{
+			Name: cacheName,
+			Size: 100,
+		},
+	})
+	s := NewServer(ServerOption{
+		Cache: cacheName,
+	})
+	fn := NewCache(s)
+
+	resp := &cache.HTTPResponse{
+		StatusCode: 200,
+		RawBody:    []byte("Hello world!"),
+	}
+	c := elton.NewContext(
+		httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/stale", nil),
+	)
+	setHTTPCacheMaxAge(c, 1)
+	setHTTPCacheStale(c, 0, 60)
+	setHTTPResp(c, resp)
+	c.Next = func() error {
+		return nil
+	}
+	err := fn(c)
+	assert.Nil(err)
+	assert.Equal(cache.StatusFetching, getCacheStatus(c))
+
+	// 等待缓存过期
+	time.Sleep(2100 * time.Millisecond)
+
+	c = elton.NewContext(
+		httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/stale", nil),
+	)
+	c.Next = func() error {
+		// 已过期的缓存数据用于条件请求
+		assert.Equal(resp, getExpiredHTTPResp(c))
+		return errors.New("connection refused")
+	}
+	err = fn(c)
+	assert.Nil(err)
+	assert.Equal(cache.StatusStale, getCacheStatus(c))
+	assert.Equal(resp, getHTTPResp(c))
+}
+
+func TestCacheMiddlewareCircuitOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	cacheName := "testCircuitOpen"
+	cache.ResetDispatchers([]config.CacheConfig{
+		{
+			Name: cacheName,
+			Size: 100,
+		},
+	})
+	s := NewServer(ServerOption{
+		Cache: cacheName,
+	})
+	fn := NewCache(s)
+
+	resp := &cache.HTTPResponse{
+		StatusCode: 200,
+		RawBody:    []byte("Hello world!"),
+	}
+	c := elton.NewContext(
+		httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/circuit-open", nil),
+	)
+	setHTTPCacheMaxAge(c, 1)
+	setHTTPResp(c, resp)
+	c.Next = func() error {
+		return nil
+	}
+	err := fn(c)
+	assert.Nil(err)
+
+	// 等待缓存过期
+	time.Sleep(2100 * time.Millisecond)
+
+	// 未设置stale-if-error，upstream熔断时也使用过期数据
+	c = elton.NewContext(
+		httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/circuit-open", nil),
+	)
+	c.Next = func() error {
+		return upstream.ErrCircuitOpen
+	}
+	err = fn(c)
+	assert.Nil(err)
+	assert.Equal(cache.StatusStale, getCacheStatus(c))
+	assert.Equal(resp, getHTTPResp(c))
+
+	// 无过期数据则返回出错
+	c = elton.NewContext(
+		httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/circuit-open?a=1", nil),
+	)
+	c.Next = func() error {
+		return upstream.ErrCircuitOpen
+	}
+	err = fn(c)
+	assert.Equal(upstream.ErrCircuitOpen, err)
+}
+
+func TestGetVary(t *testing.T) {
+	assert := assert.New(t)
+
+	h := http.Header{}
+	vary, all := getVary(h)
+	assert.Empty(vary)
+	assert.False(all)
+
+	h.Add("Vary", "x-device, Accept-Language")
+	h.Add("Vary", "Accept-Encoding,X-Device")
+	vary, all = getVary(h)
+	assert.Equal([]string{"Accept-Language", "X-Device"}, vary)
+	assert.False(all)
+
+	h.Set("Vary", "*")
+	vary, all = getVary(h)
+	assert.Empty(vary)
+	assert.True(all)
+}
+
+func TestGetVaryKey(t *testing.T) {
+	assert := assert.New(t)
+	req := httptest.NewRequest("GET", "http://test.com/users/me", nil)
+	req.Header.Set("Accept-Language", "zh-CN, en")
+	key := getVaryKey([]byte("GET test.com /users/me"), []string{"Accept-Language", "X-Device"}, req)
+	assert.Equal("GET test.com /users/me Accept-Language=zh-cn,en&X-Device=", string(key))
+}
+
+func TestCacheMiddlewareVary(t *testing.T) {
+	assert := assert.New(t)
+
+	cacheName := "testVary"
+	cache.ResetDispatchers([]config.CacheConfig{
+		{
+			Name:        cacheName,
+			Size:        100,
+			MaxVariants: 2,
+		},
+	})
+	s := NewServer(ServerOption{
+		Cache: cacheName,
+	})
+	fn := NewCache(s)
+
+	newContext := func(lang string) *elton.Context {
+		req := httptest.NewRequest("GET", "/vary", nil)
+		req.Header.Set("Accept-Language", lang)
+		c := elton.NewContext(httptest.NewRecorder(), req)
+		c.Next = func() error {
+			setHTTPCacheMaxAge(c, 60)
+			setHTTPResp(c, &cache.HTTPResponse{
+				StatusCode: 200,
+				Header: http.Header{
+					"Vary": []string{"Accept-Language"},
+				},
+				RawBody: []byte(lang),
+			})
+			return nil
+		}
+		return c
+	}
+
+	tests := []struct {
+		lang   string
+		status cache.Status
+	}{
+		// 首次获取，记录vary并保存至对应的缓存
+		{
+			lang:   "en",
+			status: cache.StatusFetching,
+		},
+		{
+			lang:   "en",
+			status: cache.StatusHit,
+		},
+		{
+			lang:   "zh",
+			status: cache.StatusFetching,
+		},
+		{
+			lang:   "zh",
+			status: cache.StatusHit,
+		},
+		// 超出最大数量
+		{
+			lang:   "fr",
+			status: cache.StatusPassed,
+		},
+	}
+	for _, tt := range tests {
+		c := newContext(tt.lang)
+		err := fn(c)
+		assert.Nil(err)
+		assert.Equal(tt.status, getCacheStatus(c))
+		if tt.status == cache.StatusHit {
+			assert.Equal([]byte(tt.lang), getHTTPResp(c).RawBody)
+		}
+	}
+
+	// vary缓存删除后，可生成新的vary缓存
+	disp := cache.GetDispatcher(cacheName)
+	req := newContext("en").Request
+	disp.RemoveHTTPCache(getVaryKey(getKey(req), []string{"Accept-Language"}, req))
+	c := newContext("fr")
+	err := fn(c)
+	assert.Nil(err)
+	assert.Equal(cache.StatusFetching, getCacheStatus(c))
+	c = newContext("fr")
+	err = fn(c)
+	assert.Nil(err)
+	assert.Equal(cache.StatusHit, getCacheStatus(c))
+	assert.Equal([]byte("fr"), getHTTPResp(c).RawBody)
+}
+
+func TestGetCacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	req := httptest.NewRequest("GET", "/users/me?utm_source=a&type=1&t=123&id=2", nil)
+	req.Host = "test.com"
+	assert.Equal(string(getKey(req)), string(getCacheKey(req, nil)))
+
+	ck := &location.CacheKey{
+		IgnoreQueries: []string{
+			"utm_*",
+			"t",
+		},
+		SortQuery: true,
+	}
+	assert.Equal("GET test.com /users/me?id=2&type=1", string(getCacheKey(req, ck)))
+
+	req.Header.Set("X-Device", "mobile")
+	req.AddCookie(&http.Cookie{
+		Name:  "lang",
+		Value: "en",
+	})
+	ck = &location.CacheKey{
+		IgnoreQueries: []string{
+			"utm_source",
+			"type",
+			"t",
+			"id",
+		},
+		Headers: []string{
+			"X-Device",
+		},
+		Cookies: []string{
+			"lang",
+		},
+		IgnoreHost: true,
+	}
+	assert.Equal("GET /users/me X-Device=mobile cookie:lang=en", string(getCacheKey(req, ck)))
+}
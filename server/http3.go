@@ -0,0 +1,62 @@
+//go:build http3
+// +build http3
+
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// HTTP/3为实验性功能，依赖的quic-go需要较新的go版本，因此仅在使用http3 tag编译时启用：
+// go get github.com/quic-go/quic-go@v0.54.0 && go build -tags http3
+
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/vicanso/pike/log"
+	"go.uber.org/zap"
+)
+
+// startHTTP3 start the http/3 server(experimental) on the udp address
+func (s *server) startHTTP3(addr string, handler http.Handler) (http3Server, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	h3 := &http3.Server{
+		Handler: handler,
+		// 证书与tcp的相同，在握手时读取
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			GetConfigForClient: s.getTLSConfig,
+		}),
+	}
+	go func() {
+		err := h3.Serve(conn)
+		log.Default().Error("http3 server serve fail",
+			zap.String("addr", s.addr),
+			zap.Error(err),
+		)
+	}()
+	return h3, nil
+}
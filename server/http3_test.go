@@ -0,0 +1,85 @@
+//go:build http3
+// +build http3
+
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	"github.com/vicanso/pike/cache"
+)
+
+func TestTLSServerHTTP3(t *testing.T) {
+	assert := assert.New(t)
+
+	cert, err := newTestCertificate("test.com")
+	assert.Nil(err)
+	s := NewServer(ServerOption{
+		Addr: "127.0.0.1:",
+		Certificates: []Certificate{
+			cert,
+		},
+		EnableHTTP3: true,
+	})
+	defer s.Close()
+	err = s.Start(true)
+	assert.Nil(err)
+
+	transport := &http3.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	defer transport.Close()
+	client := &http.Client{
+		Transport: transport,
+	}
+	resp, err := client.Get("https://" + s.GetListenAddr() + "/")
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(3, resp.ProtoMajor)
+
+	// 响应中添加Alt-Svc
+	_, port, _ := net.SplitHostPort(s.GetListenAddr())
+	c := elton.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	c.Next = func() error {
+		return nil
+	}
+	c.SetHeader(headerAltSvc, `h2=":443"`)
+	setHTTPResp(c, &cache.HTTPResponse{
+		StatusCode: 200,
+		RawBody:    []byte("abcd"),
+	})
+	err = NewResponder(s)(c)
+	assert.Nil(err)
+	assert.Equal(`h3=":`+port+`"; ma=2592000`, c.GetHeader(headerAltSvc))
+}
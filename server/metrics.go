@@ -0,0 +1,97 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/vicanso/elton"
+	"github.com/vicanso/pike/cache"
+	"github.com/vicanso/pike/metrics"
+	"github.com/vicanso/pike/stats"
+	"github.com/vicanso/pike/upstream"
+)
+
+// NewMetrics create a metrics middleware, it should be added before the error middleware
+func NewMetrics(s *server) elton.Handler {
+	return func(c *elton.Context) error {
+		startedAt := time.Now()
+		err := c.Next()
+
+		// location由后续的中间件匹配后保存至context，不再重复匹配
+		var locationName, upstreamName string
+		if l := getLocation(c); l != nil {
+			locationName = l.Name
+			upstreamName = l.Upstream
+		}
+		// 出错由error中间件转换为响应，因此直接使用状态码，
+		// 如果有出错（如panic后的处理），则认为是500
+		status := c.StatusCode
+		if err != nil {
+			status = http.StatusInternalServerError
+		} else if status == 0 {
+			status = http.StatusOK
+		}
+		latency := time.Since(startedAt)
+		metrics.ObserveRequest(s.addr, locationName, upstreamName, status, latency)
+		cacheStatus := getCacheStatus(c)
+		if cacheStatus != cache.StatusUnknown {
+			metrics.IncCacheStatus(s.addr, cacheStatus.String())
+		}
+
+		var bytesIn, bytesOut int64
+		if c.Request.ContentLength > 0 {
+			bytesIn = c.Request.ContentLength
+		}
+		if c.BodyBuffer != nil {
+			bytesOut = int64(c.BodyBuffer.Len())
+		} else if c.Committed {
+			// 以流的方式转发的响应
+			bytesOut = int64(c.GetInt(upstream.ProxyStreamedSizeKey))
+		}
+		stats.Add(locationName, "", "", stats.Sample{
+			Status:   status,
+			BytesIn:  bytesIn,
+			BytesOut: bytesOut,
+			Latency:  latency,
+			CacheHit: cacheStatus == cache.StatusHit || cacheStatus == cache.StatusStale,
+		})
+		// 请求转发至upstream时，每次尝试（包括重试）均记录至对应的target
+		attempts, _ := c.Get(upstream.ProxyAttemptsKey)
+		list, _ := attempts.([]upstream.ProxyAttempt)
+		for index, attempt := range list {
+			sample := stats.Sample{
+				Status:  attempt.Status,
+				Latency: attempt.Latency,
+			}
+			// 请求与响应的数据只计入最后一次尝试
+			if index == len(list)-1 {
+				sample.BytesIn = bytesIn
+				sample.BytesOut = bytesOut
+			}
+			stats.Add("", upstreamName, attempt.Target, sample)
+		}
+		return err
+	}
+}
@@ -0,0 +1,114 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	"github.com/vicanso/pike/cache"
+	"github.com/vicanso/pike/location"
+	"github.com/vicanso/pike/metrics"
+	"github.com/vicanso/pike/stats"
+	"github.com/vicanso/pike/upstream"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer(ServerOption{
+		Addr: ":3020",
+	})
+	fn := NewMetrics(s)
+
+	c := elton.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	c.Next = func() error {
+		setCacheStatus(c, cache.StatusHit)
+		return nil
+	}
+	err := fn(c)
+	assert.Nil(err)
+
+	c = elton.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	c.Next = func() error {
+		return errors.New("abc")
+	}
+	err = fn(c)
+	assert.NotNil(err)
+
+	// location由后续中间件匹配后保存至context
+	c = elton.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil))
+	c.Next = func() error {
+		c.Set(locationKey, &location.Location{
+			Name:     "api",
+			Upstream: "backend",
+		})
+		return nil
+	}
+	err = fn(c)
+	assert.Nil(err)
+
+	// 重试时每次转发均记录至对应的target
+	c = elton.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil))
+	c.Next = func() error {
+		c.Set(locationKey, &location.Location{
+			Name:     "metrics-retry",
+			Upstream: "metrics-retry-backend",
+		})
+		c.Set(upstream.ProxyAttemptsKey, []upstream.ProxyAttempt{
+			{
+				Target:  "http://127.0.0.1:3021",
+				Status:  502,
+				Latency: 10 * time.Millisecond,
+			},
+			{
+				Target:  "http://127.0.0.1:3022",
+				Status:  200,
+				Latency: 20 * time.Millisecond,
+			},
+		})
+		return nil
+	}
+	err = fn(c)
+	assert.Nil(err)
+	summary := stats.GetSummary(time.Minute)
+	assert.Equal(int64(1), summary.Locations["metrics-retry"].Requests)
+	targets := summary.Upstreams["metrics-retry-backend"]
+	assert.Equal(2, len(targets))
+	assert.Equal(int64(1), targets["http://127.0.0.1:3021"].Requests)
+	assert.Equal(int64(1), targets["http://127.0.0.1:3021"].Status5xx)
+	assert.Equal(int64(1), targets["http://127.0.0.1:3022"].Requests)
+	assert.Equal(int64(1), targets["http://127.0.0.1:3022"].Status2xx)
+
+	buf := &bytes.Buffer{}
+	err = metrics.Write(buf)
+	assert.Nil(err)
+	assert.Contains(buf.String(), `pike_http_requests_total{server=":3020",location="",upstream="",status="200"} 1`)
+	assert.Contains(buf.String(), `pike_http_requests_total{server=":3020",location="",upstream="",status="500"} 1`)
+	assert.Contains(buf.String(), `pike_http_requests_total{server=":3020",location="api",upstream="backend",status="200"} 1`)
+	assert.Contains(buf.String(), `pike_cache_status_total{server=":3020",status="hit"} 1`)
+}
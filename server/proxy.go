@@ -23,6 +23,7 @@
 package server
 
 import (
+	"io"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -30,7 +31,6 @@ import (
 	"github.com/vicanso/elton"
 	"github.com/vicanso/hes"
 	"github.com/vicanso/pike/cache"
-	"github.com/vicanso/pike/location"
 	"github.com/vicanso/pike/upstream"
 	"github.com/vicanso/pike/util"
 	"golang.org/x/net/context"
@@ -40,6 +40,9 @@ var (
 	noCacheReg = regexp.MustCompile(`no-cache|no-store|private`)
 	sMaxAgeReg = regexp.MustCompile(`s-maxage=(\d+)`)
 	maxAgeReg  = regexp.MustCompile(`max-age=(\d+)`)
+
+	staleWhileRevalidateReg = regexp.MustCompile(`stale-while-revalidate=(\d+)`)
+	staleIfErrorReg         = regexp.MustCompile(`stale-if-error=(\d+)`)
 )
 
 // 根据Cache-Control的信息，获取s-maxage 或者max-age的值
@@ -80,6 +83,71 @@ func getCacheMaxAge(header http.Header) int {
 	return maxAge
 }
 
+// 根据Cache-Control的信息，获取stale-while-revalidate与stale-if-error的值
+func getCacheStale(header http.Header) (staleWhileRevalidate, staleIfError int) {
+	cc := header.Get(elton.HeaderCacheControl)
+	if cc == "" {
+		return
+	}
+	result := staleWhileRevalidateReg.FindStringSubmatch(cc)
+	if len(result) == 2 {
+		staleWhileRevalidate, _ = strconv.Atoi(result[1])
+	}
+	result = staleIfErrorReg.FindStringSubmatch(cc)
+	if len(result) == 2 {
+		staleIfError, _ = strconv.Atoi(result[1])
+	}
+	return
+}
+
+// setConditionalHeader set the conditional request header by the ETag and Last-Modified
+// of the expired response, it returns false if both of them are empty
+func setConditionalHeader(reqHeader, respHeader http.Header) bool {
+	eTag := respHeader.Get(elton.HeaderETag)
+	lastModified := respHeader.Get(elton.HeaderLastModified)
+	if eTag != "" {
+		reqHeader.Set(elton.HeaderIfNoneMatch, eTag)
+	}
+	if lastModified != "" {
+		reqHeader.Set(elton.HeaderIfModifiedSince, lastModified)
+	}
+	return eTag != "" || lastModified != ""
+}
+
+// maxBytesReader the reader which returns error if the data is larger than the max size
+type maxBytesReader struct {
+	io.ReadCloser
+	remain   int64
+	exceeded bool
+}
+
+func newMaxBytesReader(r io.ReadCloser, max int) *maxBytesReader {
+	return &maxBytesReader{
+		ReadCloser: r,
+		remain:     int64(max),
+	}
+}
+
+// Read read data, it returns error if the data is larger than the max size
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, ErrRequestBodyTooLarge
+	}
+	// 多读取一个字节用于判断是否超出
+	if int64(len(p)) > r.remain+1 {
+		p = p[:r.remain+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if int64(n) <= r.remain {
+		r.remain -= int64(n)
+		return n, err
+	}
+	n = int(r.remain)
+	r.remain = 0
+	r.exceeded = true
+	return n, ErrRequestBodyTooLarge
+}
+
 // NewProxy create proxy middleware
 func NewProxy(s *server) elton.Handler {
 	return func(c *elton.Context) (err error) {
@@ -90,12 +158,36 @@ func NewProxy(s *server) elton.Handler {
 			return nil
 		}
 
-		l := location.Get(c.Request.Host, c.Request.RequestURI, s.GetLocations()...)
+		l := s.resolveLocation(c)
 		if l == nil {
 			err = ErrLocationNotFound
 			return
 		}
 
+		// 请求数据超出限制
+		var reqBody *maxBytesReader
+		if l.MaxRequestBodySize > 0 && c.Request.Body != nil && c.Request.Body != http.NoBody {
+			if c.Request.ContentLength > int64(l.MaxRequestBodySize) {
+				err = ErrRequestBodyTooLarge
+				return
+			}
+			reqBody = newMaxBytesReader(c.Request.Body, l.MaxRequestBodySize)
+			c.Request.Body = reqBody
+		}
+
+		status := getCacheStatus(c)
+		upstream.SetStreamOption(c, upstream.StreamOption{
+			// 不可缓存的请求直接以流的方式转发
+			Enabled:     l.Stream && (status == cache.StatusPassed || status == cache.StatusHitForPass),
+			Threshold:   l.StreamThreshold,
+			MaxBodySize: l.MaxResponseBodySize,
+			OnStream: func(header http.Header) {
+				l.AddResponseHeader(header)
+				header.Set(headerCacheStatus, status.String())
+			},
+			UpgradeIdleTimeout: l.UpgradeIdleTimeout,
+		})
+
 		upstream := upstream.Get(l.Upstream)
 		if upstream == nil {
 			err = ErrUpstreamNotFound
@@ -104,7 +196,8 @@ func NewProxy(s *server) elton.Handler {
 
 		reqHeader := c.Request.Header
 		var ifModifiedSince, ifNoneMatch string
-		status := getCacheStatus(c)
+		// 已过期的缓存数据，如果有ETag或Last-Modified，则向upstream发送条件请求
+		var expiredResp *cache.HTTPResponse
 		// 针对fetching的请求，由于其最终状态未知，因此需要删除有可能导致304的请求，避免无法生成缓存
 		if status == cache.StatusFetching {
 			ifModifiedSince = reqHeader.Get(elton.HeaderIfModifiedSince)
@@ -115,6 +208,22 @@ func NewProxy(s *server) elton.Handler {
 			if ifNoneMatch != "" {
 				reqHeader.Del(elton.HeaderIfNoneMatch)
 			}
+			expiredResp = getExpiredHTTPResp(c)
+			if expiredResp != nil && !setConditionalHeader(reqHeader, expiredResp.Header) {
+				expiredResp = nil
+			}
+		}
+		// range请求获取完整的数据，缓存后再由responder截取
+		var rangeValue, ifRange string
+		if status == cache.StatusFetching && l.RangeFetchFull {
+			rangeValue = reqHeader.Get(headerRange)
+			ifRange = reqHeader.Get(headerIfRange)
+			if rangeValue != "" {
+				reqHeader.Del(headerRange)
+			}
+			if ifRange != "" {
+				reqHeader.Del(headerIfRange)
+			}
 		}
 
 		// url rewrite
@@ -142,7 +251,10 @@ func NewProxy(s *server) elton.Handler {
 			reqHeader.Set(elton.HeaderAcceptEncoding, upstream.Option.AcceptEncoding)
 		}
 
-		if l.ProxyTimeout != 0 {
+		// upgrade与server-sent events的连接为长连接，不使用转发超时
+		if l.ProxyTimeout != 0 &&
+			!util.IsUpgradeRequest(c.Request) &&
+			!util.IsEventStreamRequest(c.Request) {
 			ctx, cancel := context.WithTimeout(c.Context(), l.ProxyTimeout)
 			defer cancel()
 			c.WithContext(ctx)
@@ -152,6 +264,10 @@ func NewProxy(s *server) elton.Handler {
 		originalHeader := c.Header().Clone()
 		c.ResetHeader()
 		err = upstream.Proxy(c)
+		// 请求数据超出限制，转发时读取出错
+		if reqBody != nil && reqBody.exceeded {
+			err = ErrRequestBodyTooLarge
+		}
 		// 如果出错超时，则转换为504 timeout，category:pike
 		if err != nil {
 			if he, ok := err.(*hes.Error); ok {
@@ -162,12 +278,22 @@ func NewProxy(s *server) elton.Handler {
 		}
 
 		// 恢复请求头
+		if expiredResp != nil {
+			reqHeader.Del(elton.HeaderIfModifiedSince)
+			reqHeader.Del(elton.HeaderIfNoneMatch)
+		}
 		if ifModifiedSince != "" {
 			reqHeader.Set(elton.HeaderIfModifiedSince, ifModifiedSince)
 		}
 		if ifNoneMatch != "" {
 			reqHeader.Set(elton.HeaderIfNoneMatch, ifNoneMatch)
 		}
+		if rangeValue != "" {
+			reqHeader.Set(headerRange, rangeValue)
+		}
+		if ifRange != "" {
+			reqHeader.Set(headerIfRange, ifRange)
+		}
 		if acceptEncodingChanged {
 			reqHeader.Set(elton.HeaderAcceptEncoding, acceptEncoding)
 		}
@@ -188,30 +314,44 @@ func NewProxy(s *server) elton.Handler {
 		if err != nil {
 			return
 		}
+		// 响应已以流的方式转发至客户端
+		if c.Committed {
+			return nil
+		}
+
+		var httpResp *cache.HTTPResponse
+		// 条件请求返回304，则使用已过期的缓存数据并更新响应头，无需重新压缩
+		if expiredResp != nil && c.StatusCode == http.StatusNotModified {
+			httpResp = expiredResp.Refresh(header)
+		} else {
+			var data []byte
+			if c.BodyBuffer != nil {
+				data = c.BodyBuffer.Bytes()
+			}
+			// 初始化http response时，如果已压缩，而且非gzip br，则会解压
+			httpResp, err = cache.NewHTTPResponse(c.StatusCode, header, header.Get(elton.HeaderContentEncoding), data)
+			if err != nil {
+				return
+			}
 
-		var data []byte
-		if c.BodyBuffer != nil {
-			data = c.BodyBuffer.Bytes()
+			compressSrv, minLength, filter := s.GetCompress()
+			httpResp.CompressSrv = compressSrv
+			httpResp.CompressMinLength = minLength
+			httpResp.CompressContentTypeFilter = filter
+			// 为range请求获取的完整数据，后续的range请求从原始数据中截取，因此保留
+			httpResp.KeepRawBody = rangeValue != ""
 		}
 
-		// 对于fetching的请求，从响应头中判断该请求缓存的有效期
-		if status == cache.StatusFetching {
-			maxAge := getCacheMaxAge(header)
+		// 对于fetching的请求，从响应头中判断该请求缓存的有效期，
+		// 部分数据的响应（206）不可缓存
+		if status == cache.StatusFetching && httpResp.StatusCode != http.StatusPartialContent {
+			maxAge := getCacheMaxAge(httpResp.Header)
 			if maxAge > 0 {
 				setHTTPCacheMaxAge(c, maxAge)
+				staleWhileRevalidate, staleIfError := getCacheStale(httpResp.Header)
+				setHTTPCacheStale(c, staleWhileRevalidate, staleIfError)
 			}
 		}
-
-		// 初始化http response时，如果已压缩，而且非gzip br，则会解压
-		httpResp, err := cache.NewHTTPResponse(c.StatusCode, header, header.Get(elton.HeaderContentEncoding), data)
-		if err != nil {
-			return
-		}
-
-		compressSrv, minLength, filter := s.GetCompress()
-		httpResp.CompressSrv = compressSrv
-		httpResp.CompressMinLength = minLength
-		httpResp.CompressContentTypeFilter = filter
 		setHTTPResp(c, httpResp)
 
 		// 重置context中由于proxy中间件影响的状态 statusCode, header, body
@@ -24,6 +24,7 @@ package server
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -111,6 +112,20 @@ func TestGetCacheMaxAge(t *testing.T) {
 	}
 }
 
+func TestGetCacheStale(t *testing.T) {
+	assert := assert.New(t)
+
+	h := http.Header{}
+	staleWhileRevalidate, staleIfError := getCacheStale(h)
+	assert.Equal(0, staleWhileRevalidate)
+	assert.Equal(0, staleIfError)
+
+	h.Set(elton.HeaderCacheControl, "max-age=10, stale-while-revalidate=30, stale-if-error=60")
+	staleWhileRevalidate, staleIfError = getCacheStale(h)
+	assert.Equal(30, staleWhileRevalidate)
+	assert.Equal(60, staleIfError)
+}
+
 func TestProxyMiddleware(t *testing.T) {
 	assert := assert.New(t)
 	ln, err := net.Listen("tcp", "127.0.0.1:")
@@ -150,6 +165,18 @@ func TestProxyMiddleware(t *testing.T) {
 			return nil
 		})
 
+		e.GET("/etag", func(c *elton.Context) error {
+			c.CacheMaxAge(2 * time.Minute)
+			if c.GetRequestHeader(elton.HeaderIfNoneMatch) == `"1"` {
+				c.SetHeader("X-Updated", "1")
+				c.NotModified()
+				return nil
+			}
+			c.SetHeader(elton.HeaderETag, `"2"`)
+			c.BodyBuffer = bytes.NewBufferString("new response")
+			return nil
+		})
+
 		// e.POST("/")
 		_ = e.Serve(ln)
 	}()
@@ -197,6 +224,8 @@ func TestProxyMiddleware(t *testing.T) {
 		body                   string
 		age                    int
 		originalAcceptEncoding string
+		ifNoneMatch            string
+		header                 http.Header
 	}{
 		// 正常fetching，可缓存请求
 		{
@@ -239,7 +268,54 @@ func TestProxyMiddleware(t *testing.T) {
 				c.SetRequestHeader("X-Custom", "1")
 				return c
 			},
-			body: ",,1",
+			body:        ",,1",
+			ifNoneMatch: "if none match",
+		},
+		// 过期缓存有ETag，upstream返回304
+		{
+			create: func() *elton.Context {
+				req := httptest.NewRequest("GET", "/etag", nil)
+				c := elton.NewContext(httptest.NewRecorder(), req)
+				setCacheStatus(c, cache.StatusFetching)
+				setExpiredHTTPResp(c, &cache.HTTPResponse{
+					CompressSrv:               "test-compress",
+					CompressMinLength:         100,
+					CompressContentTypeFilter: regexp.MustCompile(`text|json`),
+					StatusCode:                200,
+					Header: http.Header{
+						"Etag":                   []string{`"1"`},
+						elton.HeaderCacheControl: []string{"max-age=60"},
+					},
+					RawBody: []byte("expired response"),
+				})
+				return c
+			},
+			body: "expired response",
+			age:  120,
+			header: http.Header{
+				"Etag":      []string{`"1"`},
+				"X-Updated": []string{"1"},
+			},
+		},
+		// 过期缓存的ETag不匹配，upstream返回新的数据
+		{
+			create: func() *elton.Context {
+				req := httptest.NewRequest("GET", "/etag", nil)
+				c := elton.NewContext(httptest.NewRecorder(), req)
+				setCacheStatus(c, cache.StatusFetching)
+				setExpiredHTTPResp(c, &cache.HTTPResponse{
+					Header: http.Header{
+						"Etag": []string{`"0"`},
+					},
+					RawBody: []byte("expired response"),
+				})
+				return c
+			},
+			body: "new response",
+			age:  120,
+			header: http.Header{
+				"Etag": []string{`"2"`},
+			},
 		},
 	}
 
@@ -270,6 +346,11 @@ func TestProxyMiddleware(t *testing.T) {
 			assert.Empty(c.GetHeader(key))
 		}
 		assert.Equal(tt.originalAcceptEncoding, c.GetRequestHeader(elton.HeaderAcceptEncoding))
+		assert.Equal(tt.ifNoneMatch, c.GetRequestHeader(elton.HeaderIfNoneMatch))
+		assert.Equal(http.StatusOK, httpResp.StatusCode)
+		for key, value := range tt.header {
+			assert.Equal(value, httpResp.Header.Values(key))
+		}
 		assert.Equal(tt.body, string(httpResp.RawBody))
 		assert.Equal(tt.age, getHTTPCacheMaxAge(c))
 		assert.Equal(serverOption.CompressContentTypeFilter, httpResp.CompressContentTypeFilter)
@@ -277,3 +358,287 @@ func TestProxyMiddleware(t *testing.T) {
 		assert.Equal(serverOption.Compress, httpResp.CompressSrv)
 	}
 }
+
+func TestMaxBytesReader(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newMaxBytesReader(ioutil.NopCloser(strings.NewReader("abc")), 3)
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.Equal("abc", string(data))
+	assert.False(r.exceeded)
+
+	r = newMaxBytesReader(ioutil.NopCloser(strings.NewReader("abcd")), 3)
+	data, err = ioutil.ReadAll(r)
+	assert.Equal(ErrRequestBodyTooLarge, err)
+	assert.Equal("abc", string(data))
+	assert.True(r.exceeded)
+}
+
+func TestProxyMiddlewareStream(t *testing.T) {
+	assert := assert.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.Nil(err)
+	defer ln.Close()
+
+	largeResp := strings.Repeat("a", 100)
+	go func() {
+		e := elton.New()
+		e.GET("/large", func(c *elton.Context) error {
+			c.BodyBuffer = bytes.NewBufferString(largeResp)
+			return nil
+		})
+		e.POST("/upload", func(c *elton.Context) error {
+			c.NoContent()
+			return nil
+		})
+		_ = e.Serve(ln)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	location.Reset([]config.LocationConfig{
+		{
+			Name:     "stream-test",
+			Upstream: "stream-test",
+			RespHeaders: []string{
+				"X-Response-ID:2",
+			},
+			MaxRequestBodySize:  "10B",
+			MaxResponseBodySize: "50B",
+			Stream:              true,
+		},
+	})
+	upstream.Reset([]config.UpstreamConfig{
+		{
+			Name: "stream-test",
+			Servers: []config.UpstreamServerConfig{
+				{
+					Addr: "http://" + ln.Addr().String(),
+				},
+			},
+		},
+	})
+	fn := NewProxy(NewServer(ServerOption{
+		Locations: []string{
+			"stream-test",
+		},
+	}))
+
+	// pass的请求以流的方式转发
+	resp := httptest.NewRecorder()
+	c := elton.NewContext(resp, httptest.NewRequest("GET", "/large", nil))
+	setCacheStatus(c, cache.StatusPassed)
+	c.Next = func() error {
+		return nil
+	}
+	err = fn(c)
+	assert.Nil(err)
+	assert.True(c.Committed)
+	assert.Nil(getHTTPResp(c))
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(largeResp, resp.Body.String())
+	assert.Equal("2", resp.Header().Get("X-Response-ID"))
+	assert.Equal(cache.StatusPassed.String(), resp.Header().Get(headerCacheStatus))
+	assert.Equal(len(largeResp), c.GetInt(upstream.ProxyStreamedSizeKey))
+
+	// 可缓存的请求响应数据超出限制
+	c = elton.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/large", nil))
+	setCacheStatus(c, cache.StatusFetching)
+	c.Next = func() error {
+		return nil
+	}
+	err = fn(c)
+	assert.Equal(upstream.ErrResponseTooLarge, err)
+	assert.False(c.Committed)
+
+	// 请求数据超出限制
+	c = elton.NewContext(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("Hello world!")))
+	c.Next = func() error {
+		return nil
+	}
+	err = fn(c)
+	assert.Equal(ErrRequestBodyTooLarge, err)
+
+	// 未知长度的请求数据超出限制
+	req := httptest.NewRequest("POST", "/upload", ioutil.NopCloser(strings.NewReader("Hello world!")))
+	req.ContentLength = -1
+	c = elton.NewContext(httptest.NewRecorder(), req)
+	c.Next = func() error {
+		return nil
+	}
+	err = fn(c)
+	assert.Equal(ErrRequestBodyTooLarge, err)
+}
+
+func TestProxyMiddlewareRange(t *testing.T) {
+	assert := assert.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.Nil(err)
+	defer ln.Close()
+
+	go func() {
+		e := elton.New()
+		e.GET("/range", func(c *elton.Context) error {
+			c.CacheMaxAge(time.Minute)
+			if c.GetRequestHeader(headerRange) != "" {
+				c.StatusCode = http.StatusPartialContent
+				c.SetHeader("Content-Range", "bytes 0-4/12")
+				c.BodyBuffer = bytes.NewBufferString("Hello")
+				return nil
+			}
+			c.BodyBuffer = bytes.NewBufferString("Hello world!")
+			return nil
+		})
+		_ = e.Serve(ln)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	upstream.Reset([]config.UpstreamConfig{
+		{
+			Name: "range-test",
+			Servers: []config.UpstreamServerConfig{
+				{
+					Addr: "http://" + ln.Addr().String(),
+				},
+			},
+		},
+	})
+	fn := NewProxy(NewServer(ServerOption{
+		Locations: []string{
+			"range-test",
+		},
+	}))
+	newContext := func() *elton.Context {
+		req := httptest.NewRequest("GET", "/range", nil)
+		req.Header.Set(headerRange, "bytes=0-4")
+		c := elton.NewContext(httptest.NewRecorder(), req)
+		setCacheStatus(c, cache.StatusFetching)
+		c.Next = func() error {
+			return nil
+		}
+		return c
+	}
+
+	// 转发range请求，响应的部分数据不可缓存
+	location.Reset([]config.LocationConfig{
+		{
+			Name:     "range-test",
+			Upstream: "range-test",
+		},
+	})
+	c := newContext()
+	err = fn(c)
+	assert.Nil(err)
+	assert.Equal(http.StatusPartialContent, getHTTPResp(c).StatusCode)
+	assert.Equal(0, getHTTPCacheMaxAge(c))
+
+	// 获取完整的数据用于缓存
+	location.Reset([]config.LocationConfig{
+		{
+			Name:           "range-test",
+			Upstream:       "range-test",
+			RangeFetchFull: true,
+		},
+	})
+	c = newContext()
+	err = fn(c)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, getHTTPResp(c).StatusCode)
+	assert.Equal("Hello world!", string(getHTTPResp(c).RawBody))
+	assert.Equal(60, getHTTPCacheMaxAge(c))
+	assert.True(getHTTPResp(c).KeepRawBody)
+	assert.Equal("bytes=0-4", c.GetRequestHeader(headerRange))
+}
+
+func TestProxyMiddlewareNoTransform(t *testing.T) {
+	assert := assert.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.Nil(err)
+	defer ln.Close()
+
+	go func() {
+		e := elton.New()
+		e.GET("/cacheable", func(c *elton.Context) error {
+			c.SetHeader(elton.HeaderCacheControl, "public, max-age=600, no-transform")
+			c.SetHeader(elton.HeaderContentType, "text/plain")
+			c.BodyBuffer = bytes.NewBufferString(strings.Repeat("Hello world!", 1000))
+			return nil
+		})
+		e.GET("/uncacheable", func(c *elton.Context) error {
+			c.SetHeader(elton.HeaderCacheControl, "no-cache, no-transform")
+			c.BodyBuffer = bytes.NewBufferString("Hello world!")
+			return nil
+		})
+		_ = e.Serve(ln)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	name := "no-transform-test"
+	cache.ResetDispatchers([]config.CacheConfig{
+		{
+			Name: name,
+			Size: 100,
+		},
+	})
+	location.Reset([]config.LocationConfig{
+		{
+			Name:     name,
+			Upstream: name,
+		},
+	})
+	upstream.Reset([]config.UpstreamConfig{
+		{
+			Name: name,
+			Servers: []config.UpstreamServerConfig{
+				{
+					Addr: "http://" + ln.Addr().String(),
+				},
+			},
+		},
+	})
+	s := NewServer(ServerOption{
+		Locations: []string{
+			name,
+		},
+		Cache: name,
+	})
+	cacheFn := NewCache(s)
+	proxyFn := NewProxy(s)
+	responderFn := NewResponder(s)
+	doRequest := func(url string) *elton.Context {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set(elton.HeaderAcceptEncoding, "gzip, br")
+		c := elton.NewContext(httptest.NewRecorder(), req)
+		c.Next = func() error {
+			c.Next = func() error {
+				c.Next = func() error {
+					return nil
+				}
+				return proxyFn(c)
+			}
+			return cacheFn(c)
+		}
+		err := responderFn(c)
+		assert.Nil(err)
+		return c
+	}
+
+	// 可缓存的no-transform响应正常缓存，但不压缩
+	body := strings.Repeat("Hello world!", 1000)
+	c := doRequest("/cacheable")
+	assert.False(c.Committed)
+	assert.Equal(cache.StatusFetching, getCacheStatus(c))
+	assert.Empty(c.GetHeader(elton.HeaderContentEncoding))
+	assert.Equal(body, c.BodyBuffer.String())
+	c = doRequest("/cacheable")
+	assert.Equal(cache.StatusHit, getCacheStatus(c))
+	assert.Equal(body, string(getHTTPResp(c).RawBody))
+	assert.Empty(getHTTPResp(c).GzipBody)
+	assert.Empty(getHTTPResp(c).BrBody)
+	assert.Empty(c.GetHeader(elton.HeaderContentEncoding))
+	assert.Equal(body, c.BodyBuffer.String())
+
+	// 不可缓存的no-transform响应以流的方式转发
+	c = doRequest("/uncacheable")
+	assert.True(c.Committed)
+}
@@ -0,0 +1,67 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/vicanso/elton"
+	"github.com/vicanso/pike/ratelimit"
+)
+
+// internalContextKey 标记该请求为pike内部发起的请求（后台更新缓存或缓存预热）
+const internalContextKey contextKey = "internal"
+
+// isInternalRequest check the request is created by pike
+func isInternalRequest(req *http.Request) bool {
+	v, _ := req.Context().Value(internalContextKey).(bool)
+	return v
+}
+
+// NewRateLimit create rate limit middleware, the request is limited
+// by the limiter of its location, and 429 is returned if it is not allowed
+func NewRateLimit(s *server) elton.Handler {
+	return func(c *elton.Context) error {
+		if isInternalRequest(c.Request) {
+			return c.Next()
+		}
+		l := s.resolveLocation(c)
+		// location不存在由proxy中间件处理
+		if l == nil {
+			return c.Next()
+		}
+		limiter := ratelimit.Get(l.Name)
+		if limiter == nil {
+			return c.Next()
+		}
+		allowed, retryAfter := limiter.Allow(c)
+		if !allowed {
+			// Retry-After以秒为单位，向上取整
+			c.SetHeader(headerRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			return ErrTooManyRequests
+		}
+		return c.Next()
+	}
+}
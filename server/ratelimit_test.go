@@ -0,0 +1,88 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	"github.com/vicanso/pike/config"
+	"github.com/vicanso/pike/location"
+	"github.com/vicanso/pike/ratelimit"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	locations := []config.LocationConfig{
+		{
+			Name:      "testRateLimit",
+			Upstream:  "testRateLimit",
+			Prefixes:  []string{"/rate-limit"},
+			RateLimit: "1/m",
+		},
+	}
+	location.Reset(locations)
+	ratelimit.Reset(locations)
+	defer location.Reset(nil)
+	defer ratelimit.Reset(nil)
+
+	s := NewServer(ServerOption{
+		Locations: []string{"testRateLimit"},
+	})
+	fn := NewRateLimit(s)
+
+	newContext := func(url, ip string) *elton.Context {
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = ip + ":6001"
+		c := elton.NewContext(httptest.NewRecorder(), req)
+		c.Next = func() error {
+			return nil
+		}
+		return c
+	}
+
+	c := newContext("/rate-limit/users", "1.1.1.1")
+	assert.Nil(fn(c))
+
+	// 令牌已用完
+	c = newContext("/rate-limit/users", "1.1.1.1")
+	assert.Equal(ErrTooManyRequests, fn(c))
+	assert.Equal("60", c.GetHeader(headerRetryAfter))
+
+	// 不同的客户端IP
+	c = newContext("/rate-limit/users", "1.1.1.2")
+	assert.Nil(fn(c))
+
+	// 内部的请求不限流
+	c = newContext("/rate-limit/users", "1.1.1.1")
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), internalContextKey, true))
+	assert.Nil(fn(c))
+
+	// 未配置限流的location
+	c = newContext("/users", "1.1.1.1")
+	assert.Nil(fn(c))
+}
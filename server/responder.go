@@ -29,12 +29,16 @@ import (
 )
 
 // NewResponder create a responder middleware
-func NewResponder() elton.Handler {
+func NewResponder(s *server) elton.Handler {
 	return func(c *elton.Context) (err error) {
 		err = c.Next()
 		if err != nil {
 			return
 		}
+		// 响应已以流的方式转发至客户端
+		if c.Committed {
+			return
+		}
 		// 从context中读取http response，该数据由cache中间件设置或proxy中间件设置
 		httpResp := getHTTPResp(c)
 		if httpResp == nil {
@@ -54,6 +58,8 @@ func NewResponder() elton.Handler {
 		}
 
 		c.SetHeader(headerCacheStatus, getCacheStatus(c).String())
+		// 启用http/3时通过Alt-Svc告知客户端
+		s.setAltSvcHeader(c.Header())
 		return
 	}
 }
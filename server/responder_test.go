@@ -59,7 +59,7 @@ func TestResponderMiddleware(t *testing.T) {
 			body:      []byte("abcd"),
 		},
 	}
-	fn := NewResponder()
+	fn := NewResponder(NewServer(ServerOption{}))
 	for _, tt := range tests {
 		c := tt.create()
 		c.Next = func() error {
@@ -23,6 +23,8 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"regexp"
@@ -34,10 +36,13 @@ import (
 	"github.com/vicanso/elton/middleware"
 	"github.com/vicanso/pike/cache"
 	"github.com/vicanso/pike/config"
+	"github.com/vicanso/pike/location"
 	"github.com/vicanso/pike/log"
 	"github.com/vicanso/pike/util"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type (
@@ -53,14 +58,36 @@ type (
 		compress                  string
 		compressMinLength         int
 		compressContentTypeFilter *regexp.Regexp
+		certificates              *certificateSelector
+		certificateList           []Certificate
+		tlsMinVersion             uint16
+		tlsMaxVersion             uint16
+		tlsCipherSuites           []uint16
+		enableH2C                 bool
+		enableHTTP2               bool
+		enableHTTP3               bool
 		processing                atomic.Int32
 		ln                        net.Listener
-		e                         *elton.Elton
+		// 启动时是否以TLS监听，调整需要重启才生效
+		tlsEnabled bool
+		// http/3的服务，启用http/3时才创建
+		h3 http3Server
+		e  *elton.Elton
+	}
+	// http3Server the http/3 server, it is only available when pike is built with the http3 tag
+	http3Server interface {
+		Close() error
+		SetQUICHeaders(header http.Header) error
 	}
 	// servers pike server list
 	servers struct {
 		m *sync.Map
 	}
+	// nopResponseWriter the response writer discard all data
+	nopResponseWriter struct {
+		header     http.Header
+		statusCode int
+	}
 	ServerOption struct {
 		// 访问日志格式化
 		LogFormat string
@@ -76,6 +103,18 @@ type (
 		CompressMinLength int
 		// 压缩数据类型
 		CompressContentTypeFilter *regexp.Regexp
+		// TLS证书，有配置则使用https
+		Certificates []Certificate
+		// TLS版本与加密套件
+		TLSMinVersion   uint16
+		TLSMaxVersion   uint16
+		TLSCipherSuites []uint16
+		// 是否启用h2c(http/2 over tcp)
+		EnableH2C bool
+		// 是否启用http/2(需配置证书)
+		EnableHTTP2 bool
+		// 是否启用http/3(需配置证书)
+		EnableHTTP3 bool
 	}
 )
 
@@ -88,6 +127,14 @@ const (
 	httpRespAgeKey = "_httpRespAge"
 	// httpCacheMaxAgeKey 缓存有效期
 	httpCacheMaxAgeKey = "_httpCacheMaxAge"
+	// httpCacheStaleWhileRevalidateKey 缓存过期后可使用并后台更新的时长
+	httpCacheStaleWhileRevalidateKey = "_httpCacheStaleWhileRevalidate"
+	// httpCacheStaleIfErrorKey 缓存过期后出错时可使用的时长
+	httpCacheStaleIfErrorKey = "_httpCacheStaleIfError"
+	// httpCacheExpiredRespKey 已过期的缓存响应数据，用于向upstream发送条件请求
+	httpCacheExpiredRespKey = "_httpCacheExpiredResp"
+	// locationKey 请求对应的location，只匹配一次，后续中间件直接使用
+	locationKey = "_location"
 )
 
 const defaultCompressMinLength = 1024
@@ -97,6 +144,11 @@ var defaultServers = NewServers(nil)
 const (
 	headerAge         = "Age"
 	headerCacheStatus = "X-Status"
+	headerVary        = "Vary"
+	headerRange       = "Range"
+	headerIfRange     = "If-Range"
+	headerRetryAfter  = "Retry-After"
+	headerAltSvc      = "Alt-Svc"
 )
 
 var (
@@ -107,6 +159,10 @@ var (
 	ErrLocationNotFound = util.NewError("Available location not found", http.StatusServiceUnavailable)
 
 	ErrUpstreamNotFound = util.NewError("Available upstream not found", http.StatusBadGateway)
+
+	ErrRequestBodyTooLarge = util.NewError("Request Body Too Large", http.StatusRequestEntityTooLarge)
+
+	ErrTooManyRequests = util.NewError("Too Many Requests", http.StatusTooManyRequests)
 )
 
 func getCacheStatus(c *elton.Context) cache.Status {
@@ -116,6 +172,32 @@ func setCacheStatus(c *elton.Context, cacheStatus cache.Status) {
 	c.Set(statusKey, int(cacheStatus))
 }
 
+// resolveLocation get the location of request, the location is saved to context
+// after matched, so it will only be matched once for each request
+func (s *server) resolveLocation(c *elton.Context) *location.Location {
+	if l := getLocation(c); l != nil {
+		return l
+	}
+	l := location.Get(c.Request.Host, c.Request.RequestURI, s.GetLocations()...)
+	if l != nil {
+		c.Set(locationKey, l)
+	}
+	return l
+}
+
+// getLocation get the location which is resolved, nil will be returned if it's not resolved
+func getLocation(c *elton.Context) *location.Location {
+	value, exists := c.Get(locationKey)
+	if !exists {
+		return nil
+	}
+	l, ok := value.(*location.Location)
+	if !ok {
+		return nil
+	}
+	return l
+}
+
 func getHTTPResp(c *elton.Context) *cache.HTTPResponse {
 	value, exists := c.Get(httpRespKey)
 	if !exists {
@@ -145,6 +227,47 @@ func getHTTPCacheMaxAge(c *elton.Context) int {
 	return c.GetInt(httpCacheMaxAgeKey)
 }
 
+func setHTTPCacheStale(c *elton.Context, staleWhileRevalidate, staleIfError int) {
+	c.Set(httpCacheStaleWhileRevalidateKey, staleWhileRevalidate)
+	c.Set(httpCacheStaleIfErrorKey, staleIfError)
+}
+func getHTTPCacheStale(c *elton.Context) (staleWhileRevalidate, staleIfError int) {
+	return c.GetInt(httpCacheStaleWhileRevalidateKey), c.GetInt(httpCacheStaleIfErrorKey)
+}
+
+func setExpiredHTTPResp(c *elton.Context, resp *cache.HTTPResponse) {
+	c.Set(httpCacheExpiredRespKey, resp)
+}
+func getExpiredHTTPResp(c *elton.Context) *cache.HTTPResponse {
+	value, exists := c.Get(httpCacheExpiredRespKey)
+	if !exists {
+		return nil
+	}
+	resp, ok := value.(*cache.HTTPResponse)
+	if !ok {
+		return nil
+	}
+	return resp
+}
+
+// Header get the header of response
+func (w *nopResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write discard the data
+func (w *nopResponseWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return len(data), nil
+}
+
+// WriteHeader set the status code
+func (w *nopResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
 // NewServer create a new server
 func NewServer(opt ServerOption) *server {
 	minLength := opt.CompressMinLength
@@ -161,6 +284,14 @@ func NewServer(opt ServerOption) *server {
 		compress:                  opt.Compress,
 		compressMinLength:         minLength,
 		compressContentTypeFilter: opt.CompressContentTypeFilter,
+		certificates:              newCertificateSelector(opt.Certificates),
+		certificateList:           opt.Certificates,
+		tlsMinVersion:             opt.TLSMinVersion,
+		tlsMaxVersion:             opt.TLSMaxVersion,
+		tlsCipherSuites:           opt.TLSCipherSuites,
+		enableH2C:                 opt.EnableH2C,
+		enableHTTP2:               opt.EnableHTTP2,
+		enableHTTP3:               opt.EnableHTTP3,
 	}
 }
 
@@ -273,6 +404,36 @@ func (s *server) Update(opt ServerOption) {
 	s.compress = opt.Compress
 	s.compressMinLength = opt.CompressMinLength
 	s.compressContentTypeFilter = opt.CompressContentTypeFilter
+	// 证书在握手时读取，因此更新后新的连接即使用新证书，已有连接不受影响
+	certificates := newCertificateSelector(opt.Certificates)
+	switch {
+	case s.listening && s.tlsEnabled && certificates == nil:
+		// 证书被删除或全部加载失败时保留原有证书，避免所有握手失败
+		log.Default().Warn("no certificate is available, the previous certificates are kept, restart the server to disable tls",
+			zap.String("addr", s.addr),
+		)
+	case s.listening && !s.tlsEnabled && certificates != nil:
+		log.Default().Warn("tls is not enabled for the listening server, restart the server to enable it",
+			zap.String("addr", s.addr),
+		)
+		fallthrough
+	default:
+		s.certificates = certificates
+		s.certificateList = opt.Certificates
+	}
+	s.tlsMinVersion = opt.TLSMinVersion
+	s.tlsMaxVersion = opt.TLSMaxVersion
+	s.tlsCipherSuites = opt.TLSCipherSuites
+	s.enableH2C = opt.EnableH2C
+	s.enableHTTP2 = opt.EnableHTTP2
+	// http/3的监听在启动时创建，因此调整后需重启才生效
+	s.enableHTTP3 = opt.EnableHTTP3
+}
+
+func (s *server) isH2CEnabled() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.enableH2C
 }
 
 // GetCache get the cache of server
@@ -323,10 +484,13 @@ func (s *server) Start(useGoRoutine bool) (err error) {
 		defer s.processing.Dec()
 		return c.Next()
 	})
+	// 指标统计在出错中间件之前，可获取出错转换后的状态码
+	e.Use(NewMetrics(s))
 	// TODO 考虑是否自定义出错中间件，对于系统的error(category: "pike")触发告警
 	e.Use(middleware.NewDefaultError())
 	e.Use(middleware.NewDefaultFresh())
-	e.Use(NewResponder())
+	e.Use(NewResponder(s))
+	e.Use(NewRateLimit(s))
 	e.Use(NewCache(s))
 	e.Use(NewProxy(s))
 	e.ALL("/*", func(c *elton.Context) error {
@@ -336,13 +500,43 @@ func (s *server) Start(useGoRoutine bool) (err error) {
 	// 因此与客户端的各类超时由前置反向代理处理，
 	// 后续确认是否需要增加更多的参数设置，
 	// 如ReadTimeout ReadHeaderTimeout等
+	// h2c在每次请求时判断是否启用，因此可实时调整
+	h2cHandler := h2c.NewHandler(e, &http2.Server{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil && s.isH2CEnabled() {
+			h2cHandler.ServeHTTP(w, req)
+			return
+		}
+		e.ServeHTTP(w, req)
+	})
 	srv := &http.Server{
-		Handler: e,
+		Handler: handler,
+	}
+	// 添加http/2的处理，是否使用由TLS握手时的ALPN决定
+	err = http2.ConfigureServer(srv, &http2.Server{})
+	if err != nil {
+		return
 	}
 	ln, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return
 	}
+	// 如果有配置证书，则启用TLS
+	s.tlsEnabled = s.certificates != nil
+	if s.tlsEnabled {
+		ln = tls.NewListener(ln, &tls.Config{
+			GetConfigForClient: s.getTLSConfig,
+		})
+	}
+	// 启用http/3，使用与tcp相同端口的udp监听
+	if s.certificates != nil && s.enableHTTP3 {
+		h3, err := s.startHTTP3(ln.Addr().String(), handler)
+		if err != nil {
+			_ = ln.Close()
+			return err
+		}
+		s.h3 = h3
+	}
 	s.listening = true
 	s.e = e
 	s.ln = ln
@@ -372,9 +566,45 @@ func (s *server) Close() error {
 	if err != nil {
 		return err
 	}
+	if s.h3 != nil {
+		_ = s.h3.Close()
+		s.h3 = nil
+	}
 	return s.ln.Close()
 }
 
+// setAltSvcHeader set the Alt-Svc header to advertise http/3 if it is enabled
+func (s *server) setAltSvcHeader(header http.Header) {
+	s.mutex.RLock()
+	h3 := s.h3
+	s.mutex.RUnlock()
+	if h3 == nil {
+		return
+	}
+	// upstream的Alt-Svc对于客户端无意义，使用当前server的
+	header.Del(headerAltSvc)
+	_ = h3.SetQUICHeaders(header)
+}
+
+// fetch fetch the request through the handlers of server and discard the response,
+// it returns the status code of response
+func (s *server) fetch(req *http.Request) int {
+	s.mutex.RLock()
+	e := s.e
+	s.mutex.RUnlock()
+	// 服务未启动
+	if e == nil {
+		return 0
+	}
+	w := &nopResponseWriter{
+		header: make(http.Header),
+	}
+	// 标记为内部的请求，不受限流的影响
+	req = req.WithContext(context.WithValue(req.Context(), internalContextKey, true))
+	e.ServeHTTP(w, req)
+	return w.statusCode
+}
+
 // GetAddr get listen addr of server
 func (s *server) GetListenAddr() string {
 	return s.listenAddr
@@ -389,6 +619,37 @@ func convertConfig(configs []config.ServerConfig) []ServerOption {
 		if item.CompressContentTypeFilter != "" {
 			reg, _ = regexp.Compile(item.CompressContentTypeFilter)
 		}
+		certificates := make([]Certificate, 0, len(item.Certificates))
+		for _, certConfig := range item.Certificates {
+			var cert Certificate
+			var err error
+			// 从文件加载的证书记录文件路径，用于定时检测更新
+			if certConfig.Cert == "" || certConfig.Key == "" {
+				cert, err = loadCertificateFile(certConfig.Domains, certConfig.CertFile, certConfig.KeyFile)
+			} else {
+				cert.Domains = certConfig.Domains
+				cert.Certificate, err = certConfig.Load()
+			}
+			// 证书加载失败则忽略
+			if err != nil {
+				log.Default().Error("load certificate fail",
+					zap.String("addr", item.Addr),
+					zap.Strings("domains", certConfig.Domains),
+					zap.Error(err),
+				)
+				continue
+			}
+			certificates = append(certificates, cert)
+		}
+		tlsMinVersion, _ := util.ParseTLSVersion(item.TLSMinVersion)
+		tlsMaxVersion, _ := util.ParseTLSVersion(item.TLSMaxVersion)
+		var cipherSuites []uint16
+		for _, name := range item.TLSCipherSuites {
+			id, ok := util.ParseCipherSuite(name)
+			if ok {
+				cipherSuites = append(cipherSuites, id)
+			}
+		}
 		opts = append(opts, ServerOption{
 			LogFormat:                 item.LogFormat,
 			Addr:                      item.Addr,
@@ -397,6 +658,13 @@ func convertConfig(configs []config.ServerConfig) []ServerOption {
 			Compress:                  item.Compress,
 			CompressMinLength:         int(minLength),
 			CompressContentTypeFilter: reg,
+			Certificates:              certificates,
+			TLSMinVersion:             tlsMinVersion,
+			TLSMaxVersion:             tlsMaxVersion,
+			TLSCipherSuites:           cipherSuites,
+			EnableH2C:                 item.EnableH2C,
+			EnableHTTP2:               item.EnableHTTP2,
+			EnableHTTP3:               item.EnableHTTP3,
 		})
 	}
 	return opts
@@ -23,6 +23,9 @@
 package server
 
 import (
+	"crypto/tls"
+	"net"
+	"net/http"
 	"regexp"
 	"testing"
 
@@ -30,6 +33,7 @@ import (
 	"github.com/vicanso/elton"
 	"github.com/vicanso/pike/cache"
 	"github.com/vicanso/pike/config"
+	"golang.org/x/net/http2"
 )
 
 func TestGetSetCacheStatus(t *testing.T) {
@@ -49,6 +53,15 @@ func TestGetSetHTTPResp(t *testing.T) {
 	assert.Equal(httpResp, getHTTPResp(c))
 }
 
+func TestGetSetExpiredHTTPResp(t *testing.T) {
+	assert := assert.New(t)
+	c := elton.NewContext(nil, nil)
+	assert.Nil(getExpiredHTTPResp(c))
+	httpResp := &cache.HTTPResponse{}
+	setExpiredHTTPResp(c, httpResp)
+	assert.Equal(httpResp, getExpiredHTTPResp(c))
+}
+
 func TestGetSetHTTPRespAge(t *testing.T) {
 	assert := assert.New(t)
 	c := elton.NewContext(nil, nil)
@@ -67,6 +80,18 @@ func TestGetSetHTTPCacheMaxAge(t *testing.T) {
 	assert.Equal(10, getHTTPCacheMaxAge(c))
 }
 
+func TestGetSetHTTPCacheStale(t *testing.T) {
+	assert := assert.New(t)
+	c := elton.NewContext(nil, nil)
+	staleWhileRevalidate, staleIfError := getHTTPCacheStale(c)
+	assert.Equal(0, staleWhileRevalidate)
+	assert.Equal(0, staleIfError)
+	setHTTPCacheStale(c, 10, 20)
+	staleWhileRevalidate, staleIfError = getHTTPCacheStale(c)
+	assert.Equal(10, staleWhileRevalidate)
+	assert.Equal(20, staleIfError)
+}
+
 func TestServer(t *testing.T) {
 	assert := assert.New(t)
 
@@ -105,6 +130,36 @@ func TestServer(t *testing.T) {
 	assert.Equal(minLength, compressMinLength)
 }
 
+func TestH2CServer(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer(ServerOption{
+		Addr:      "127.0.0.1:",
+		EnableH2C: true,
+	})
+	defer s.Close()
+	err := s.Start(true)
+	assert.Nil(err)
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	resp, err := client.Get("http://" + s.GetListenAddr() + "/")
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(2, resp.ProtoMajor)
+
+	// 关闭h2c后，http/2请求失败
+	s.Update(ServerOption{})
+	client.CloseIdleConnections()
+	_, err = client.Get("http://" + s.GetListenAddr() + "/")
+	assert.NotNil(err)
+}
+
 func TestServers(t *testing.T) {
 	assert := assert.New(t)
 	locations := []string{
@@ -0,0 +1,250 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vicanso/pike/log"
+	"github.com/vicanso/pike/schedule"
+	"go.uber.org/zap"
+)
+
+var ErrCertificateNotFound = errors.New("certificate not found")
+
+type (
+	// Certificate the certificate of server
+	Certificate struct {
+		// 证书对应的域名，为空则使用证书中的域名
+		Domains     []string
+		Certificate tls.Certificate
+		// 证书与私钥的文件路径，从文件加载的证书会定时检测文件是否有更新
+		CertFile string
+		KeyFile  string
+		// 加载时文件的修改时间
+		modTime time.Time
+	}
+	// certificateSelector select the certificate by sni
+	certificateSelector struct {
+		// 默认证书（第一个证书），客户端未指定SNI或无匹配时使用
+		defaultCert *tls.Certificate
+		// 域名对应的证书，通配符域名以*.example.com的形式保存
+		certs map[string]*tls.Certificate
+	}
+)
+
+// certificateReloadInterval the interval of checking the certificate files
+const certificateReloadInterval = "@every 1m"
+
+func init() {
+	_, _ = schedule.Add(certificateReloadInterval, reloadCertificateFiles)
+}
+
+// reloadCertificateFiles reload the modified certificate files of default servers
+func reloadCertificateFiles() {
+	defaultServers.m.Range(func(_, value interface{}) bool {
+		s, _ := value.(*server)
+		if s != nil {
+			s.reloadCertificateFiles()
+		}
+		return true
+	})
+}
+
+// getCertificateFileModTime get the latest modified time of certificate and key file
+func getCertificateFileModTime(certFile, keyFile string) (modTime time.Time, err error) {
+	for _, file := range []string{
+		certFile,
+		keyFile,
+	} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return
+}
+
+// loadCertificateFile load the certificate from files
+func loadCertificateFile(domains []string, certFile, keyFile string) (cert Certificate, err error) {
+	// 先获取修改时间再加载，若加载期间文件有更新，下次检测时重新加载
+	modTime, err := getCertificateFileModTime(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	return Certificate{
+		Domains:     domains,
+		Certificate: tlsCert,
+		CertFile:    certFile,
+		KeyFile:     keyFile,
+		modTime:     modTime,
+	}, nil
+}
+
+func getCertificateDomains(cert *tls.Certificate) []string {
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil
+		}
+	}
+	domains := leaf.DNSNames
+	if len(domains) == 0 && leaf.Subject.CommonName != "" {
+		domains = []string{leaf.Subject.CommonName}
+	}
+	return domains
+}
+
+// newCertificateSelector create a new certificate selector
+func newCertificateSelector(certificates []Certificate) *certificateSelector {
+	if len(certificates) == 0 {
+		return nil
+	}
+	selector := &certificateSelector{
+		certs: make(map[string]*tls.Certificate),
+	}
+	for index := range certificates {
+		item := &certificates[index]
+		cert := &item.Certificate
+		if selector.defaultCert == nil {
+			selector.defaultCert = cert
+		}
+		domains := item.Domains
+		if len(domains) == 0 {
+			domains = getCertificateDomains(cert)
+		}
+		for _, domain := range domains {
+			domain = strings.ToLower(domain)
+			// 如果多个证书配置相同域名，使用先配置的
+			if _, exists := selector.certs[domain]; !exists {
+				selector.certs[domain] = cert
+			}
+		}
+	}
+	return selector
+}
+
+// Get get the certificate of server name, it will try the wildcard
+// domain if there is no certificate matches server name
+func (selector *certificateSelector) Get(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name != "" {
+		if cert, ok := selector.certs[name]; ok {
+			return cert
+		}
+		// 通配符只匹配一级子域名
+		index := strings.Index(name, ".")
+		if index > 0 {
+			if cert, ok := selector.certs["*"+name[index:]]; ok {
+				return cert
+			}
+		}
+	}
+	return selector.defaultCert
+}
+
+// getTLSConfig get the tls config for client hello, the certificates and
+// settings are read when handshaking, so they can be updated without
+// restarting the listener
+func (s *server) getTLSConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.certificates == nil {
+		return nil, ErrCertificateNotFound
+	}
+	cert := s.certificates.Get(hello.ServerName)
+	nextProtos := []string{
+		"http/1.1",
+	}
+	if s.enableHTTP2 {
+		nextProtos = []string{
+			"h2",
+			"http/1.1",
+		}
+	}
+	return &tls.Config{
+		NextProtos: nextProtos,
+		Certificates: []tls.Certificate{
+			*cert,
+		},
+		MinVersion:   s.tlsMinVersion,
+		MaxVersion:   s.tlsMaxVersion,
+		CipherSuites: s.tlsCipherSuites,
+	}, nil
+}
+
+// reloadCertificateFiles reload the certificates whose files are modified,
+// the previous certificate is kept if it fails to load
+func (s *server) reloadCertificateFiles() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var result []Certificate
+	for index, item := range s.certificateList {
+		if item.CertFile == "" {
+			continue
+		}
+		modTime, err := getCertificateFileModTime(item.CertFile, item.KeyFile)
+		if err != nil || !modTime.After(item.modTime) {
+			continue
+		}
+		cert, err := loadCertificateFile(item.Domains, item.CertFile, item.KeyFile)
+		if err != nil {
+			log.Default().Error("reload certificate fail",
+				zap.String("addr", s.addr),
+				zap.String("certFile", item.CertFile),
+				zap.Error(err),
+			)
+			continue
+		}
+		if result == nil {
+			result = append([]Certificate(nil), s.certificateList...)
+		}
+		result[index] = cert
+		log.Default().Info("certificate is reloaded",
+			zap.String("addr", s.addr),
+			zap.String("certFile", item.CertFile),
+		)
+	}
+	if result == nil {
+		return
+	}
+	s.certificateList = result
+	s.certificates = newCertificateSelector(result)
+}
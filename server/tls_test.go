@@ -0,0 +1,347 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/pike/config"
+)
+
+// generateCertificate generate a self-signed certificate for testing
+func generateCertificate(domains ...string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName: domains[0],
+		},
+		DNSNames:  domains,
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	})
+	keyPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyDER,
+	})
+	return
+}
+
+func newTestCertificate(domains ...string) (Certificate, error) {
+	certPEM, keyPEM, err := generateCertificate(domains...)
+	if err != nil {
+		return Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return Certificate{}, err
+	}
+	return Certificate{
+		Certificate: cert,
+	}, nil
+}
+
+// getPeerDomains dial the server and get the domains of peer certificate
+func getPeerDomains(addr, serverName string) ([]string, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].DNSNames, nil
+}
+
+func TestCertificateSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newCertificateSelector(nil))
+
+	defaultCert, err := newTestCertificate("test.com")
+	assert.Nil(err)
+	wildcardCert, err := newTestCertificate("*.example.com")
+	assert.Nil(err)
+	customCert, err := newTestCertificate("custom.com")
+	assert.Nil(err)
+	customCert.Domains = []string{
+		"api.test.com",
+	}
+
+	selector := newCertificateSelector([]Certificate{
+		defaultCert,
+		wildcardCert,
+		customCert,
+	})
+	assert.Equal(defaultCert.Certificate, *selector.Get("test.com"))
+	assert.Equal(defaultCert.Certificate, *selector.Get(""))
+	assert.Equal(defaultCert.Certificate, *selector.Get("unknown.com"))
+	assert.Equal(wildcardCert.Certificate, *selector.Get("www.example.com"))
+	assert.Equal(wildcardCert.Certificate, *selector.Get("WWW.Example.com"))
+	// 通配符只匹配一级子域名
+	assert.Equal(defaultCert.Certificate, *selector.Get("a.b.example.com"))
+	assert.Equal(customCert.Certificate, *selector.Get("api.test.com"))
+	// 指定域名后，不再使用证书中的域名
+	assert.Equal(defaultCert.Certificate, *selector.Get("custom.com"))
+}
+
+func TestTLSServer(t *testing.T) {
+	assert := assert.New(t)
+
+	defaultCert, err := newTestCertificate("test.com")
+	assert.Nil(err)
+	exampleCert, err := newTestCertificate("example.com")
+	assert.Nil(err)
+
+	s := NewServer(ServerOption{
+		Addr: "127.0.0.1:",
+		Certificates: []Certificate{
+			defaultCert,
+		},
+	})
+	defer s.Close()
+	err = s.Start(true)
+	assert.Nil(err)
+
+	domains, err := getPeerDomains(s.GetListenAddr(), "example.com")
+	assert.Nil(err)
+	assert.Equal([]string{"test.com"}, domains)
+
+	// 更新证书后，新的连接使用新证书
+	s.Update(ServerOption{
+		Certificates: []Certificate{
+			defaultCert,
+			exampleCert,
+		},
+		TLSMinVersion: tls.VersionTLS12,
+	})
+	domains, err = getPeerDomains(s.GetListenAddr(), "example.com")
+	assert.Nil(err)
+	assert.Equal([]string{"example.com"}, domains)
+
+	// 证书删除（或全部加载失败）时保留原有证书
+	s.Update(ServerOption{
+		TLSMinVersion: tls.VersionTLS12,
+	})
+	domains, err = getPeerDomains(s.GetListenAddr(), "example.com")
+	assert.Nil(err)
+	assert.Equal([]string{"example.com"}, domains)
+
+	// 客户端最高版本低于服务端最低版本
+	_, err = tls.Dial("tcp", s.GetListenAddr(), &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS11,
+	})
+	assert.NotNil(err)
+}
+
+func TestTLSServerEnableAfterStart(t *testing.T) {
+	assert := assert.New(t)
+
+	cert, err := newTestCertificate("test.com")
+	assert.Nil(err)
+	s := NewServer(ServerOption{
+		Addr: "127.0.0.1:",
+	})
+	defer s.Close()
+	err = s.Start(true)
+	assert.Nil(err)
+
+	// 启动后添加证书，需要重启才以TLS监听
+	s.Update(ServerOption{
+		Certificates: []Certificate{
+			cert,
+		},
+	})
+	assert.False(s.tlsEnabled)
+	assert.NotNil(s.certificates)
+	resp, err := http.Get("http://" + s.GetListenAddr() + "/")
+	assert.Nil(err)
+	resp.Body.Close()
+}
+
+func TestReloadCertificateFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "test.crt")
+	keyFile := filepath.Join(dir, "test.key")
+	writeCertificateFiles := func(modTime time.Time, domains ...string) {
+		certPEM, keyPEM, err := generateCertificate(domains...)
+		assert.Nil(err)
+		assert.Nil(ioutil.WriteFile(certFile, certPEM, 0600))
+		assert.Nil(ioutil.WriteFile(keyFile, keyPEM, 0600))
+		assert.Nil(os.Chtimes(certFile, modTime, modTime))
+		assert.Nil(os.Chtimes(keyFile, modTime, modTime))
+	}
+	now := time.Now()
+	writeCertificateFiles(now.Add(-time.Minute), "test.com")
+
+	opts := convertConfig([]config.ServerConfig{
+		{
+			Addr: "127.0.0.1:",
+			Certificates: []config.CertificateConfig{
+				{
+					CertFile: certFile,
+					KeyFile:  keyFile,
+				},
+			},
+		},
+	})
+	s := NewServer(opts[0])
+	defer s.Close()
+	err := s.Start(true)
+	assert.Nil(err)
+	domains, err := getPeerDomains(s.GetListenAddr(), "")
+	assert.Nil(err)
+	assert.Equal([]string{"test.com"}, domains)
+
+	// 文件未更新则不重新加载
+	s.reloadCertificateFiles()
+	domains, err = getPeerDomains(s.GetListenAddr(), "")
+	assert.Nil(err)
+	assert.Equal([]string{"test.com"}, domains)
+
+	// 文件更新后重新加载
+	writeCertificateFiles(now, "example.com")
+	s.reloadCertificateFiles()
+	domains, err = getPeerDomains(s.GetListenAddr(), "")
+	assert.Nil(err)
+	assert.Equal([]string{"example.com"}, domains)
+
+	// 加载失败则保留原有证书
+	later := now.Add(time.Minute)
+	assert.Nil(ioutil.WriteFile(certFile, []byte("invalid"), 0600))
+	assert.Nil(os.Chtimes(certFile, later, later))
+	s.reloadCertificateFiles()
+	domains, err = getPeerDomains(s.GetListenAddr(), "")
+	assert.Nil(err)
+	assert.Equal([]string{"example.com"}, domains)
+}
+
+func TestConvertTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	certPEM, keyPEM, err := generateCertificate("test.com")
+	assert.Nil(err)
+	opts := convertConfig([]config.ServerConfig{
+		{
+			Addr: ":3015",
+			Certificates: []config.CertificateConfig{
+				{
+					Cert: string(certPEM),
+					Key:  string(keyPEM),
+				},
+				// 加载失败的证书忽略
+				{
+					CertFile: "/not-exists.crt",
+					KeyFile:  "/not-exists.key",
+				},
+			},
+			TLSMinVersion: "1.2",
+			TLSMaxVersion: "1.3",
+			TLSCipherSuites: []string{
+				"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			},
+		},
+	})
+	assert.Equal(1, len(opts))
+	assert.Equal(1, len(opts[0].Certificates))
+	assert.Equal(uint16(tls.VersionTLS12), opts[0].TLSMinVersion)
+	assert.Equal(uint16(tls.VersionTLS13), opts[0].TLSMaxVersion)
+	assert.Equal([]uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	}, opts[0].TLSCipherSuites)
+}
+
+func TestTLSServerHTTP2(t *testing.T) {
+	assert := assert.New(t)
+
+	cert, err := newTestCertificate("test.com")
+	assert.Nil(err)
+	s := NewServer(ServerOption{
+		Addr: "127.0.0.1:",
+		Certificates: []Certificate{
+			cert,
+		},
+	})
+	defer s.Close()
+	err = s.Start(true)
+	assert.Nil(err)
+
+	getProto := func() string {
+		conn, err := tls.Dial("tcp", s.GetListenAddr(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos: []string{
+				"h2",
+				"http/1.1",
+			},
+		})
+		assert.Nil(err)
+		defer conn.Close()
+		return conn.ConnectionState().NegotiatedProtocol
+	}
+	assert.Equal("http/1.1", getProto())
+
+	s.Update(ServerOption{
+		Certificates: []Certificate{
+			cert,
+		},
+		EnableHTTP2: true,
+	})
+	assert.Equal("h2", getProto())
+}
@@ -0,0 +1,481 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 缓存预热，通过server的处理流程请求url列表，
+// 与客户端请求一致，可缓存的响应会保存至缓存中
+
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vicanso/pike/config"
+	"github.com/vicanso/pike/log"
+	"github.com/vicanso/pike/schedule"
+	"github.com/vicanso/pike/util"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultWarmupConcurrency 默认并发数
+	defaultWarmupConcurrency = 5
+	// maxWarmupFailures 最多记录的失败数量
+	maxWarmupFailures = 100
+	// warmupUserAgent 预热请求的user agent
+	warmupUserAgent = "pike-warmup"
+)
+
+type (
+	// WarmupOption warmup option
+	WarmupOption struct {
+		Name string
+		// 使用的server(addr)
+		Server string
+		// url列表
+		URLs []string
+		// sitemap或url列表文件的地址
+		Sitemap string
+		// 并发数
+		Concurrency int
+		// 添加的请求头
+		Header http.Header
+		// 定时执行的cron表达式
+		Schedule string
+	}
+	// WarmupFailure the failure of warmup
+	WarmupFailure struct {
+		URL     string `json:"url,omitempty"`
+		Status  int    `json:"status,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	// WarmupProgress the progress of warmup
+	WarmupProgress struct {
+		Name    string `json:"name,omitempty"`
+		Running bool   `json:"running"`
+		Total   int    `json:"total"`
+		Done    int    `json:"done"`
+		Failed  int    `json:"failed"`
+		// 失败记录，最多记录100个
+		Failures  []WarmupFailure `json:"failures,omitempty"`
+		StartedAt *time.Time      `json:"startedAt,omitempty"`
+		EndedAt   *time.Time      `json:"endedAt,omitempty"`
+	}
+	// warmup warmup job
+	warmup struct {
+		mu       *sync.RWMutex
+		opt      WarmupOption
+		progress WarmupProgress
+		// 定时任务的id，0表示无定时任务
+		scheduleID int
+	}
+	// warmups warmup job list
+	warmups struct {
+		mu *sync.RWMutex
+		m  map[string]*warmup
+	}
+)
+
+var defaultWarmups = newWarmups()
+
+var (
+	ErrWarmupNotFound = util.NewError("Warmup not found", http.StatusNotFound)
+	ErrWarmupRunning  = util.NewError("Warmup is running", http.StatusBadRequest)
+)
+
+// sitemap the url set of sitemap
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+}
+
+// parseWarmupURLs parse the urls from sitemap(xml) or url list(one url per line)
+func parseWarmupURLs(data []byte) ([]string, error) {
+	urls := make([]string, 0)
+	if bytes.Contains(data, []byte("<urlset")) {
+		sm := sitemap{}
+		err := xml.Unmarshal(data, &sm)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range sm.URLs {
+			loc := strings.TrimSpace(item.Loc)
+			if loc != "" {
+				urls = append(urls, loc)
+			}
+		}
+		return urls, nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		// 忽略空行与注释
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, nil
+}
+
+// loadWarmupURLs load the urls from sitemap, it supports http(s) url or local file
+func loadWarmupURLs(sitemap string) ([]string, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(sitemap, "http://") || strings.HasPrefix(sitemap, "https://") {
+		client := &http.Client{
+			Timeout: time.Minute,
+		}
+		resp, err := client.Get(sitemap)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return nil, util.NewError("get sitemap fail, status: "+http.StatusText(resp.StatusCode), resp.StatusCode)
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err = ioutil.ReadFile(sitemap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseWarmupURLs(data)
+}
+
+// newWarmupRequest create a request of warmup url
+func newWarmupRequest(rawURL string, header http.Header) (*http.Request, error) {
+	urlInfo, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 与server接收的请求保持一致
+	req.RequestURI = urlInfo.RequestURI()
+	req.Host = urlInfo.Host
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("User-Agent", warmupUserAgent)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	return req, nil
+}
+
+func newWarmup(opt WarmupOption) *warmup {
+	return &warmup{
+		mu:  &sync.RWMutex{},
+		opt: opt,
+		progress: WarmupProgress{
+			Name: opt.Name,
+		},
+	}
+}
+
+// GetProgress get the progress of warmup
+func (w *warmup) GetProgress() WarmupProgress {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	progress := w.progress
+	progress.Failures = append([]WarmupFailure(nil), w.progress.Failures...)
+	return progress
+}
+
+// Start start the warmup in background, it returns error if the warmup is running
+func (w *warmup) Start() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.progress.Running {
+		return ErrWarmupRunning
+	}
+	now := time.Now()
+	w.progress = WarmupProgress{
+		Name:      w.opt.Name,
+		Running:   true,
+		StartedAt: &now,
+	}
+	go w.run()
+	return nil
+}
+
+// addFailure add the failure of warmup
+func (w *warmup) addFailure(failure WarmupFailure) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.progress.Failed++
+	if len(w.progress.Failures) < maxWarmupFailures {
+		w.progress.Failures = append(w.progress.Failures, failure)
+	}
+}
+
+// run run the warmup, it should be called after the progress is set to running
+func (w *warmup) run() {
+	w.mu.RLock()
+	opt := w.opt
+	w.mu.RUnlock()
+
+	defer func() {
+		now := time.Now()
+		w.mu.Lock()
+		w.progress.Running = false
+		w.progress.EndedAt = &now
+		progress := w.progress
+		w.mu.Unlock()
+		log.Default().Info("warmup done",
+			zap.String("name", opt.Name),
+			zap.Int("total", progress.Total),
+			zap.Int("failed", progress.Failed),
+		)
+	}()
+
+	s := defaultServers.Get(opt.Server)
+	if s == nil {
+		w.addFailure(WarmupFailure{
+			Message: "server of warmup not found",
+		})
+		return
+	}
+	urls := append([]string(nil), opt.URLs...)
+	if opt.Sitemap != "" {
+		result, err := loadWarmupURLs(opt.Sitemap)
+		if err != nil {
+			w.addFailure(WarmupFailure{
+				URL:     opt.Sitemap,
+				Message: err.Error(),
+			})
+			return
+		}
+		urls = append(urls, result...)
+	}
+	w.mu.Lock()
+	w.progress.Total = len(urls)
+	w.mu.Unlock()
+
+	concurrency := opt.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultWarmupConcurrency
+	}
+	ch := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rawURL := range ch {
+				w.fetch(s, rawURL, opt.Header)
+			}
+		}()
+	}
+	for _, rawURL := range urls {
+		ch <- rawURL
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// fetch fetch the url through the server
+func (w *warmup) fetch(s *server, rawURL string, header http.Header) {
+	defer func() {
+		w.mu.Lock()
+		w.progress.Done++
+		w.mu.Unlock()
+	}()
+	req, err := newWarmupRequest(rawURL, header)
+	if err != nil {
+		w.addFailure(WarmupFailure{
+			URL:     rawURL,
+			Message: err.Error(),
+		})
+		return
+	}
+	status := s.fetch(req)
+	if status == 0 {
+		w.addFailure(WarmupFailure{
+			URL:     rawURL,
+			Message: "server isn't started",
+		})
+		return
+	}
+	if status >= http.StatusBadRequest {
+		w.addFailure(WarmupFailure{
+			URL:    rawURL,
+			Status: status,
+		})
+	}
+}
+
+func newWarmups() *warmups {
+	return &warmups{
+		mu: &sync.RWMutex{},
+		m:  make(map[string]*warmup),
+	}
+}
+
+// Get get warmup by name
+func (ws *warmups) Get(name string) *warmup {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	return ws.m[name]
+}
+
+// Add add the warmup, the warmup of the same name will be replaced
+func (ws *warmups) Add(opt WarmupOption) *warmup {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	w := ws.m[opt.Name]
+	if w != nil && w.scheduleID != 0 {
+		schedule.Remove(w.scheduleID)
+	}
+	// 如果已存在，则更新配置，保留执行进度
+	if w != nil {
+		w.mu.Lock()
+		w.opt = opt
+		w.scheduleID = 0
+		w.mu.Unlock()
+	} else {
+		w = newWarmup(opt)
+		ws.m[opt.Name] = w
+	}
+	if opt.Schedule == "" {
+		return w
+	}
+	id, err := schedule.Add(opt.Schedule, func() {
+		err := w.Start()
+		if err != nil {
+			log.Default().Error("start warmup fail",
+				zap.String("name", opt.Name),
+				zap.Error(err),
+			)
+		}
+	})
+	if err != nil {
+		log.Default().Error("add warmup schedule fail",
+			zap.String("name", opt.Name),
+			zap.String("schedule", opt.Schedule),
+			zap.Error(err),
+		)
+		return w
+	}
+	w.scheduleID = id
+	return w
+}
+
+// List list the progress of all warmups
+func (ws *warmups) List() []WarmupProgress {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	result := make([]WarmupProgress, 0, len(ws.m))
+	for _, w := range ws.m {
+		result = append(result, w.GetProgress())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Reset reset the warmups, the warmups which are not in opts will be removed
+func (ws *warmups) Reset(opts []WarmupOption) {
+	ws.mu.Lock()
+	for name, w := range ws.m {
+		exists := false
+		for _, opt := range opts {
+			if opt.Name == name {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+		// 删除的预热任务如果在执行中，不中断，执行完成后不再使用
+		if w.scheduleID != 0 {
+			schedule.Remove(w.scheduleID)
+		}
+		delete(ws.m, name)
+	}
+	ws.mu.Unlock()
+	for _, opt := range opts {
+		ws.Add(opt)
+	}
+}
+
+func convertWarmupConfigs(configs []config.WarmupConfig) []WarmupOption {
+	opts := make([]WarmupOption, 0)
+	for _, item := range configs {
+		opts = append(opts, convertWarmupConfig(item))
+	}
+	return opts
+}
+
+func convertWarmupConfig(item config.WarmupConfig) WarmupOption {
+	header := make(http.Header)
+	for _, value := range item.Headers {
+		arr := strings.SplitN(value, ":", 2)
+		if len(arr) != 2 {
+			continue
+		}
+		header.Add(strings.TrimSpace(arr[0]), strings.TrimSpace(arr[1]))
+	}
+	return WarmupOption{
+		Name:        item.Name,
+		Server:      item.Server,
+		URLs:        item.URLs,
+		Sitemap:     item.Sitemap,
+		Concurrency: item.Concurrency,
+		Header:      header,
+		Schedule:    item.Schedule,
+	}
+}
+
+// ResetWarmups reset the default warmups
+func ResetWarmups(configs []config.WarmupConfig) {
+	defaultWarmups.Reset(convertWarmupConfigs(configs))
+}
+
+// GetWarmup get the warmup from default warmups
+func GetWarmup(name string) *warmup {
+	return defaultWarmups.Get(name)
+}
+
+// AddWarmup add the warmup to default warmups
+func AddWarmup(item config.WarmupConfig) *warmup {
+	return defaultWarmups.Add(convertWarmupConfig(item))
+}
+
+// ListWarmupProgress list the progress of default warmups
+func ListWarmupProgress() []WarmupProgress {
+	return defaultWarmups.List()
+}
@@ -0,0 +1,200 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/pike/cache"
+	"github.com/vicanso/pike/config"
+	"github.com/vicanso/pike/location"
+	"github.com/vicanso/pike/upstream"
+)
+
+func TestParseWarmupURLs(t *testing.T) {
+	assert := assert.New(t)
+
+	urls, err := parseWarmupURLs([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url>
+		<loc>http://test.com/</loc>
+	</url>
+	<url>
+		<loc> http://test.com/products </loc>
+	</url>
+</urlset>`))
+	assert.Nil(err)
+	assert.Equal([]string{
+		"http://test.com/",
+		"http://test.com/products",
+	}, urls)
+
+	urls, err = parseWarmupURLs([]byte(`# products
+http://test.com/products
+
+http://test.com/users
+`))
+	assert.Nil(err)
+	assert.Equal([]string{
+		"http://test.com/products",
+		"http://test.com/users",
+	}, urls)
+}
+
+func TestLoadWarmupURLs(t *testing.T) {
+	assert := assert.New(t)
+	f, err := ioutil.TempFile("", "pike-warmup")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("http://test.com/products\n")
+	assert.Nil(err)
+	f.Close()
+
+	urls, err := loadWarmupURLs(f.Name())
+	assert.Nil(err)
+	assert.Equal([]string{
+		"http://test.com/products",
+	}, urls)
+
+	_, err = loadWarmupURLs(f.Name() + ".xml")
+	assert.NotNil(err)
+}
+
+func TestNewWarmupRequest(t *testing.T) {
+	assert := assert.New(t)
+	req, err := newWarmupRequest("http://test.com/products?type=1", http.Header{
+		"X-Token": []string{"abc"},
+	})
+	assert.Nil(err)
+	assert.Equal("test.com", req.Host)
+	assert.Equal("/products?type=1", req.RequestURI)
+	assert.Equal("abc", req.Header.Get("X-Token"))
+	assert.Equal(warmupUserAgent, req.Header.Get("User-Agent"))
+}
+
+func TestConvertWarmupConfig(t *testing.T) {
+	assert := assert.New(t)
+	opt := convertWarmupConfig(config.WarmupConfig{
+		Name:   "warmup-test",
+		Server: ":3015",
+		Headers: []string{
+			"X-Token:abc",
+		},
+	})
+	assert.Equal("warmup-test", opt.Name)
+	assert.Equal(":3015", opt.Server)
+	assert.Equal("abc", opt.Header.Get("X-Token"))
+}
+
+func TestWarmup(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("Hello world!"))
+	}))
+	defer backend.Close()
+
+	name := "warmup-test"
+	cache.ResetDispatchers([]config.CacheConfig{
+		{
+			Name: name,
+			Size: 100,
+		},
+	})
+	location.Reset([]config.LocationConfig{
+		{
+			Name:     name,
+			Upstream: name,
+		},
+	})
+	upstream.Reset([]config.UpstreamConfig{
+		{
+			Name: name,
+			Servers: []config.UpstreamServerConfig{
+				{
+					Addr: backend.URL,
+				},
+			},
+		},
+	})
+	addr := "127.0.0.1:0"
+	s := NewServer(ServerOption{
+		Addr:      addr,
+		Locations: []string{name},
+		Cache:     name,
+	})
+	err := s.Start(true)
+	assert.Nil(err)
+	defer s.Close()
+	defaultServers.m.Store(addr, s)
+	defer defaultServers.m.Delete(addr)
+
+	ws := newWarmups()
+	ws.Reset([]WarmupOption{
+		{
+			Name:   name,
+			Server: addr,
+			URLs: []string{
+				"http://test.com/products",
+				"http://test.com/users",
+				"http://test.com/error",
+			},
+			Concurrency: 2,
+		},
+	})
+	w := ws.Get(name)
+	assert.NotNil(w)
+	err = w.Start()
+	assert.Nil(err)
+	for i := 0; i < 100 && w.GetProgress().Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	progress := w.GetProgress()
+	assert.False(progress.Running)
+	assert.Equal(3, progress.Total)
+	assert.Equal(3, progress.Done)
+	assert.Equal(1, progress.Failed)
+	assert.Equal("http://test.com/error", progress.Failures[0].URL)
+	assert.Equal(http.StatusInternalServerError, progress.Failures[0].Status)
+	assert.NotNil(progress.EndedAt)
+
+	// 可缓存的请求已缓存
+	status, _ := cache.GetDispatcher(name).GetHTTPCache([]byte("GET test.com /products")).Get()
+	assert.Equal(cache.StatusHit, status)
+
+	// 删除预热任务
+	ws.Reset(nil)
+	assert.Nil(ws.Get(name))
+	assert.Empty(ws.List())
+}
@@ -0,0 +1,338 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 按location与upstream统计请求，以10秒为一个时间段，
+// 保存最近1小时的数据，可按1m、5m、1h等时间窗口汇总
+
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketSeconds 每个时间段的秒数
+	bucketSeconds = 10
+	// bucketCount 时间段的数量（1小时）
+	bucketCount = 3600 / bucketSeconds
+)
+
+// latencyBounds the upper bounds of latency histogram(ms)
+var latencyBounds = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+type (
+	// Sample the sample of request
+	Sample struct {
+		Status   int
+		BytesIn  int64
+		BytesOut int64
+		Latency  time.Duration
+		CacheHit bool
+	}
+	// bucket the stats of a period
+	bucket struct {
+		// 该时间段的开始时间（除以bucketSeconds）
+		period    int64
+		requests  int64
+		status2xx int64
+		status4xx int64
+		status5xx int64
+		bytesIn   int64
+		bytesOut  int64
+		cacheHit  int64
+		// 最大的耗时(ms)，用于超出最大bound时的分位数
+		maxLatency float64
+		// 各耗时区间的数量，最后一个为超出最大bound的数量
+		latencies []int64
+	}
+	// rollingCounter the rolling counter of an hour
+	rollingCounter struct {
+		mu      *sync.Mutex
+		buckets []*bucket
+	}
+	// Summary the summary of stats in window
+	Summary struct {
+		Requests  int64 `json:"requests"`
+		Status2xx int64 `json:"status2xx"`
+		Status4xx int64 `json:"status4xx"`
+		Status5xx int64 `json:"status5xx"`
+		BytesIn   int64 `json:"bytesIn"`
+		BytesOut  int64 `json:"bytesOut"`
+		// 耗时的分位数(ms)
+		P50 float64 `json:"p50"`
+		P95 float64 `json:"p95"`
+		P99 float64 `json:"p99"`
+		// 缓存命中率
+		CacheHitRatio float64 `json:"cacheHitRatio"`
+	}
+	// WindowSummary the summary of locations and upstreams in window
+	WindowSummary struct {
+		Locations map[string]*Summary `json:"locations"`
+		// upstream名称->upstream地址->统计
+		Upstreams map[string]map[string]*Summary `json:"upstreams"`
+	}
+	// Stats the stats of locations and upstreams
+	Stats struct {
+		mu        *sync.RWMutex
+		locations map[string]*rollingCounter
+		upstreams map[string]map[string]*rollingCounter
+	}
+)
+
+func newRollingCounter() *rollingCounter {
+	buckets := make([]*bucket, bucketCount)
+	for i := range buckets {
+		buckets[i] = &bucket{
+			latencies: make([]int64, len(latencyBounds)+1),
+		}
+	}
+	return &rollingCounter{
+		mu:      &sync.Mutex{},
+		buckets: buckets,
+	}
+}
+
+// reset reset the bucket for new period
+func (b *bucket) reset(period int64) {
+	b.period = period
+	b.requests = 0
+	b.status2xx = 0
+	b.status4xx = 0
+	b.status5xx = 0
+	b.bytesIn = 0
+	b.bytesOut = 0
+	b.cacheHit = 0
+	b.maxLatency = 0
+	for i := range b.latencies {
+		b.latencies[i] = 0
+	}
+}
+
+// add add the sample to bucket
+func (b *bucket) add(s Sample) {
+	b.requests++
+	switch {
+	case s.Status >= 500:
+		b.status5xx++
+	case s.Status >= 400:
+		b.status4xx++
+	case s.Status >= 200 && s.Status < 300:
+		b.status2xx++
+	}
+	b.bytesIn += s.BytesIn
+	b.bytesOut += s.BytesOut
+	if s.CacheHit {
+		b.cacheHit++
+	}
+	ms := float64(s.Latency) / float64(time.Millisecond)
+	if ms > b.maxLatency {
+		b.maxLatency = ms
+	}
+	index := sort.SearchFloat64s(latencyBounds, ms)
+	b.latencies[index]++
+}
+
+// Add add the sample
+func (rc *rollingCounter) Add(now time.Time, s Sample) {
+	period := now.Unix() / bucketSeconds
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	b := rc.buckets[period%bucketCount]
+	if b.period != period {
+		b.reset(period)
+	}
+	b.add(s)
+}
+
+// percentile get the percentile of latencies
+func percentile(latencies []int64, count int64, maxLatency, p float64) float64 {
+	if count == 0 {
+		return 0
+	}
+	target := int64(float64(count)*p + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var sum int64
+	for i, value := range latencies {
+		sum += value
+		if sum < target {
+			continue
+		}
+		// 超出最大的bound，则使用最大耗时
+		if i >= len(latencyBounds) {
+			return maxLatency
+		}
+		return latencyBounds[i]
+	}
+	return maxLatency
+}
+
+// Summary get the summary of window
+func (rc *rollingCounter) Summary(now time.Time, window time.Duration) *Summary {
+	period := now.Unix() / bucketSeconds
+	count := int64(window.Seconds()) / bucketSeconds
+	if count <= 0 {
+		count = 1
+	}
+	if count > bucketCount {
+		count = bucketCount
+	}
+	summary := &Summary{}
+	latencies := make([]int64, len(latencyBounds)+1)
+	var cacheHit int64
+	var maxLatency float64
+	rc.mu.Lock()
+	for _, b := range rc.buckets {
+		// 只统计时间窗口内的数据
+		if b.period > period || b.period <= period-count {
+			continue
+		}
+		summary.Requests += b.requests
+		summary.Status2xx += b.status2xx
+		summary.Status4xx += b.status4xx
+		summary.Status5xx += b.status5xx
+		summary.BytesIn += b.bytesIn
+		summary.BytesOut += b.bytesOut
+		cacheHit += b.cacheHit
+		if b.maxLatency > maxLatency {
+			maxLatency = b.maxLatency
+		}
+		for i, value := range b.latencies {
+			latencies[i] += value
+		}
+	}
+	rc.mu.Unlock()
+	if summary.Requests == 0 {
+		return summary
+	}
+	summary.P50 = percentile(latencies, summary.Requests, maxLatency, 0.5)
+	summary.P95 = percentile(latencies, summary.Requests, maxLatency, 0.95)
+	summary.P99 = percentile(latencies, summary.Requests, maxLatency, 0.99)
+	summary.CacheHitRatio = float64(cacheHit) / float64(summary.Requests)
+	return summary
+}
+
+// New create a stats
+func New() *Stats {
+	return &Stats{
+		mu:        &sync.RWMutex{},
+		locations: make(map[string]*rollingCounter),
+		upstreams: make(map[string]map[string]*rollingCounter),
+	}
+}
+
+// getLocation get the rolling counter of location, it will be created if not exists
+func (st *Stats) getLocation(name string) *rollingCounter {
+	st.mu.RLock()
+	rc, ok := st.locations[name]
+	st.mu.RUnlock()
+	if ok {
+		return rc
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rc, ok = st.locations[name]
+	if !ok {
+		rc = newRollingCounter()
+		st.locations[name] = rc
+	}
+	return rc
+}
+
+// getUpstream get the rolling counter of upstream target, it will be created if not exists
+func (st *Stats) getUpstream(name, target string) *rollingCounter {
+	st.mu.RLock()
+	rc, ok := st.upstreams[name][target]
+	st.mu.RUnlock()
+	if ok {
+		return rc
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	targets, ok := st.upstreams[name]
+	if !ok {
+		targets = make(map[string]*rollingCounter)
+		st.upstreams[name] = targets
+	}
+	rc, ok = targets[target]
+	if !ok {
+		rc = newRollingCounter()
+		targets[target] = rc
+	}
+	return rc
+}
+
+// Add add the sample of request, the location or target is empty will be ignored
+func (st *Stats) Add(location, upstream, target string, s Sample) {
+	now := time.Now()
+	if location != "" {
+		st.getLocation(location).Add(now, s)
+	}
+	if upstream != "" && target != "" {
+		st.getUpstream(upstream, target).Add(now, s)
+	}
+}
+
+// Summary get the summary of locations and upstreams in window,
+// the locations and upstreams which have no request in window will be ignored
+func (st *Stats) Summary(window time.Duration) *WindowSummary {
+	now := time.Now()
+	result := &WindowSummary{
+		Locations: make(map[string]*Summary),
+		Upstreams: make(map[string]map[string]*Summary),
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	for name, rc := range st.locations {
+		if summary := rc.Summary(now, window); summary.Requests != 0 {
+			result.Locations[name] = summary
+		}
+	}
+	for name, targets := range st.upstreams {
+		for target, rc := range targets {
+			summary := rc.Summary(now, window)
+			if summary.Requests == 0 {
+				continue
+			}
+			if result.Upstreams[name] == nil {
+				result.Upstreams[name] = make(map[string]*Summary)
+			}
+			result.Upstreams[name][target] = summary
+		}
+	}
+	return result
+}
+
+var defaultStats = New()
+
+// Add add the sample of request to default stats
+func Add(location, upstream, target string, s Sample) {
+	defaultStats.Add(location, upstream, target, s)
+}
+
+// GetSummary get the summary of window from default stats
+func GetSummary(window time.Duration) *WindowSummary {
+	return defaultStats.Summary(window)
+}
@@ -0,0 +1,129 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	assert := assert.New(t)
+	latencies := make([]int64, len(latencyBounds)+1)
+	assert.Equal(float64(0), percentile(latencies, 0, 0, 0.5))
+
+	// 1ms: 50, 100ms: 45, 超出最大bound: 5
+	latencies[0] = 50
+	latencies[6] = 45
+	latencies[len(latencyBounds)] = 5
+	assert.Equal(float64(1), percentile(latencies, 100, 30000, 0.5))
+	assert.Equal(float64(100), percentile(latencies, 100, 30000, 0.95))
+	assert.Equal(float64(30000), percentile(latencies, 100, 30000, 0.99))
+}
+
+func TestRollingCounter(t *testing.T) {
+	assert := assert.New(t)
+	rc := newRollingCounter()
+	now := time.Unix(1600000000, 0)
+
+	rc.Add(now.Add(-30*time.Minute), Sample{
+		Status:  200,
+		Latency: 3 * time.Millisecond,
+	})
+	rc.Add(now.Add(-2*time.Minute), Sample{
+		Status:   404,
+		BytesOut: 10,
+		Latency:  50 * time.Millisecond,
+	})
+	rc.Add(now, Sample{
+		Status:   200,
+		BytesIn:  5,
+		BytesOut: 100,
+		Latency:  time.Millisecond,
+		CacheHit: true,
+	})
+	rc.Add(now, Sample{
+		Status:   502,
+		BytesOut: 20,
+		Latency:  20 * time.Second,
+	})
+
+	summary := rc.Summary(now, time.Minute)
+	assert.Equal(&Summary{
+		Requests:      2,
+		Status2xx:     1,
+		Status5xx:     1,
+		BytesIn:       5,
+		BytesOut:      120,
+		P50:           1,
+		P95:           20000,
+		P99:           20000,
+		CacheHitRatio: 0.5,
+	}, summary)
+
+	summary = rc.Summary(now, 5*time.Minute)
+	assert.Equal(int64(3), summary.Requests)
+	assert.Equal(int64(1), summary.Status4xx)
+	assert.Equal(int64(130), summary.BytesOut)
+
+	summary = rc.Summary(now, time.Hour)
+	assert.Equal(int64(4), summary.Requests)
+	assert.Equal(int64(2), summary.Status2xx)
+
+	// 超过1小时的数据会被覆盖
+	rc.Add(now.Add(time.Hour), Sample{
+		Status: 200,
+	})
+	summary = rc.Summary(now.Add(time.Hour), time.Hour)
+	assert.Equal(int64(1), summary.Requests)
+}
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+	st := New()
+	st.Add("location-test", "upstream-test", "http://127.0.0.1:3000", Sample{
+		Status: 200,
+	})
+	// 未转发至upstream
+	st.Add("location-test", "upstream-test", "", Sample{
+		Status:   200,
+		CacheHit: true,
+	})
+	st.Add("", "", "", Sample{
+		Status: 404,
+	})
+
+	result := st.Summary(time.Minute)
+	assert.Equal(1, len(result.Locations))
+	assert.Equal(int64(2), result.Locations["location-test"].Requests)
+	assert.Equal(0.5, result.Locations["location-test"].CacheHitRatio)
+	assert.Equal(1, len(result.Upstreams))
+	assert.Equal(int64(1), result.Upstreams["upstream-test"]["http://127.0.0.1:3000"].Requests)
+
+	Add("location-test", "", "", Sample{
+		Status: 200,
+	})
+	assert.Equal(int64(1), GetSummary(time.Hour).Locations["location-test"].Requests)
+}
@@ -0,0 +1,291 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 负载均衡策略，除了upstream模块支持的first、random、roundRobin与leastconn，
+// 还支持按权重的平滑轮询（weightedRoundRobin）以及一致性哈希（consistentHash），
+// 一致性哈希可根据url、header、cookie或客户端IP选择服务，保证缓存的局部性以及会话保持
+
+package upstream
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vicanso/elton"
+	"github.com/vicanso/pike/config"
+	us "github.com/vicanso/upstream"
+	"go.uber.org/atomic"
+)
+
+const (
+	// PolicyWeightedRoundRobin weighted round robin policy
+	PolicyWeightedRoundRobin = config.PolicyWeightedRoundRobin
+	// PolicyConsistentHash consistent hash policy
+	PolicyConsistentHash = config.PolicyConsistentHash
+)
+
+const (
+	// HashKeyURL hash by url(host + uri)
+	HashKeyURL = "url"
+	// HashKeyIP hash by client ip
+	HashKeyIP = "ip"
+	// hashKeyHeaderPrefix hash by request header, e.g.: header:X-User
+	hashKeyHeaderPrefix = "header:"
+	// hashKeyCookiePrefix hash by cookie, e.g.: cookie:jt
+	hashKeyCookiePrefix = "cookie:"
+)
+
+// hashReplicas the virtual nodes of each weight in hash ring
+const hashReplicas = 100
+
+type (
+	// hashNode the virtual node of hash ring
+	hashNode struct {
+		hash     uint32
+		upstream *us.HTTPUpstream
+	}
+	// balancer the load balancer of upstream
+	balancer struct {
+		mu      *sync.Mutex
+		uh      *us.HTTP
+		policy  string
+		hashKey string
+		weights map[*us.HTTPUpstream]int
+		// 平滑加权轮询的当前权重
+		currentWeights map[*us.HTTPUpstream]int
+		// 一致性哈希的环，按hash排序
+		ring []hashNode
+		// 各target的熔断器，未启用则为空
+		breakers map[*us.HTTPUpstream]*circuitBreaker
+		// 重试时轮询选择的计数
+		roundRobin atomic.Uint32
+	}
+)
+
+// newBalancer create a balancer
+func newBalancer(opt UpstreamServerOption, uh *us.HTTP) *balancer {
+	weights := make(map[*us.HTTPUpstream]int)
+	for _, upstream := range uh.GetUpstreamList() {
+		weight := 1
+		for _, server := range opt.Servers {
+			if server.Addr == upstream.URL.String() && server.Weight > 0 {
+				weight = server.Weight
+				break
+			}
+		}
+		weights[upstream] = weight
+	}
+	b := &balancer{
+		mu:             &sync.Mutex{},
+		uh:             uh,
+		policy:         opt.Policy,
+		hashKey:        opt.HashKey,
+		weights:        weights,
+		currentWeights: make(map[*us.HTTPUpstream]int),
+	}
+	if b.policy == PolicyConsistentHash {
+		b.initRing()
+	}
+	if opt.CircuitBreaker.Enabled() {
+		b.breakers = make(map[*us.HTTPUpstream]*circuitBreaker)
+		for _, upstream := range uh.GetUpstreamList() {
+			b.breakers[upstream] = newCircuitBreaker(opt.CircuitBreaker)
+		}
+	}
+	return b
+}
+
+// initRing init the hash ring, the count of virtual nodes is decided by weight
+func (b *balancer) initRing() {
+	ring := make([]hashNode, 0)
+	for _, upstream := range b.uh.GetUpstreamList() {
+		addr := upstream.URL.String()
+		for i := 0; i < hashReplicas*b.weights[upstream]; i++ {
+			ring = append(ring, hashNode{
+				hash:     crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + addr)),
+				upstream: upstream,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	b.ring = ring
+}
+
+// getAvailableUpstreamList get the available upstream list which are not skipped,
+// the backup upstreams are used only if all preferred upstreams are unavailable
+func (b *balancer) getAvailableUpstreamList(skip func(*us.HTTPUpstream) bool) []*us.HTTPUpstream {
+	preferredList := make([]*us.HTTPUpstream, 0)
+	backupList := make([]*us.HTTPUpstream, 0)
+	for _, upstream := range b.uh.GetAvailableUpstreamList() {
+		if skip != nil && skip(upstream) {
+			continue
+		}
+		if upstream.Backup {
+			backupList = append(backupList, upstream)
+		} else {
+			preferredList = append(preferredList, upstream)
+		}
+	}
+	if len(preferredList) != 0 {
+		return preferredList
+	}
+	return backupList
+}
+
+// weightedRoundRobin get the upstream from list by smooth weighted round robin
+func (b *balancer) weightedRoundRobin(upstreamList []*us.HTTPUpstream) *us.HTTPUpstream {
+	if len(upstreamList) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := 0
+	var best *us.HTTPUpstream
+	for _, upstream := range upstreamList {
+		weight := b.weights[upstream]
+		b.currentWeights[upstream] += weight
+		total += weight
+		if best == nil || b.currentWeights[upstream] > b.currentWeights[best] {
+			best = upstream
+		}
+	}
+	b.currentWeights[best] -= total
+	return best
+}
+
+// getHashKey get the key for consistent hash
+func (b *balancer) getHashKey(c *elton.Context) string {
+	switch {
+	case b.hashKey == HashKeyIP:
+		return c.ClientIP()
+	case strings.HasPrefix(b.hashKey, hashKeyHeaderPrefix):
+		return c.GetRequestHeader(b.hashKey[len(hashKeyHeaderPrefix):])
+	case strings.HasPrefix(b.hashKey, hashKeyCookiePrefix):
+		cookie, err := c.Cookie(b.hashKey[len(hashKeyCookiePrefix):])
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	default:
+		return c.Request.Host + c.Request.RequestURI
+	}
+}
+
+// consistentHash get the upstream from list by consistent hash,
+// if the upstream is not in list, the next one in the ring will be used
+func (b *balancer) consistentHash(c *elton.Context, upstreamList []*us.HTTPUpstream) *us.HTTPUpstream {
+	if len(upstreamList) == 0 || len(b.ring) == 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE([]byte(b.getHashKey(c)))
+	index := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+	for i := 0; i < len(b.ring); i++ {
+		upstream := b.ring[(index+i)%len(b.ring)].upstream
+		for _, item := range upstreamList {
+			if item == upstream {
+				return upstream
+			}
+		}
+	}
+	return nil
+}
+
+// Next get the next upstream by policy
+func (b *balancer) Next(c *elton.Context) (*us.HTTPUpstream, us.Done) {
+	switch b.policy {
+	case PolicyWeightedRoundRobin:
+		return b.weightedRoundRobin(b.getAvailableUpstreamList(nil)), nil
+	case PolicyConsistentHash:
+		return b.consistentHash(c, b.getAvailableUpstreamList(nil)), nil
+	default:
+		return b.uh.Next()
+	}
+}
+
+// NextExcept get the next upstream by policy, the upstreams which are skipped will be excluded.
+// It is used for retrying and the circuit breaker is open, the weights, the hash ring
+// and the backup preference are still applied.
+func (b *balancer) NextExcept(c *elton.Context, skip func(*us.HTTPUpstream) bool) (*us.HTTPUpstream, us.Done) {
+	upstreamList := b.getAvailableUpstreamList(skip)
+	if len(upstreamList) == 0 {
+		return nil, nil
+	}
+	switch b.policy {
+	case PolicyWeightedRoundRobin:
+		return b.weightedRoundRobin(upstreamList), nil
+	case PolicyConsistentHash:
+		// 选择哈希环中的下一个服务
+		return b.consistentHash(c, upstreamList), nil
+	}
+	// upstream模块支持的策略
+	switch b.uh.Policy {
+	case us.PolicyFirst:
+		return upstreamList[0], nil
+	case us.PolicyRandom:
+		return upstreamList[rand.Intn(len(upstreamList))], nil
+	case us.PolicyLeastconn:
+		// 无法获取连接数，因此轮询选择，并记录连接数
+		upstream := upstreamList[b.roundRobin.Inc()%uint32(len(upstreamList))]
+		upstream.Inc()
+		return upstream, upstream.Dec
+	default:
+		return upstreamList[b.roundRobin.Inc()%uint32(len(upstreamList))], nil
+	}
+}
+
+// allow check the request to upstream is allowed by circuit breaker,
+// the probe of half open will be occupied if allowed
+func (b *balancer) allow(upstream *us.HTTPUpstream) bool {
+	cb := b.breakers[upstream]
+	return cb == nil || cb.Allow()
+}
+
+// available check the upstream is available by circuit breaker
+func (b *balancer) available(upstream *us.HTTPUpstream) bool {
+	cb := b.breakers[upstream]
+	return cb == nil || cb.Available()
+}
+
+// done record the result of request to circuit breaker
+func (b *balancer) done(upstream *us.HTTPUpstream, failed bool, latency time.Duration) {
+	if cb := b.breakers[upstream]; cb != nil {
+		cb.Done(failed, latency)
+	}
+}
+
+// getCircuitState get the state of circuit breaker, it returns empty string if circuit breaker is not enabled
+func (b *balancer) getCircuitState(upstream *us.HTTPUpstream) string {
+	cb := b.breakers[upstream]
+	if cb == nil {
+		return ""
+	}
+	return cb.State()
+}
@@ -0,0 +1,248 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package upstream
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	us "github.com/vicanso/upstream"
+)
+
+func newTestBalancer(t *testing.T, opt UpstreamServerOption) *balancer {
+	uh := &us.HTTP{
+		Policy: opt.Policy,
+	}
+	for _, server := range opt.Servers {
+		var err error
+		if server.Backup {
+			err = uh.AddBackup(server.Addr)
+		} else {
+			err = uh.Add(server.Addr)
+		}
+		assert.Nil(t, err)
+	}
+	for _, up := range uh.GetUpstreamList() {
+		up.Healthy()
+	}
+	return newBalancer(opt, uh)
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	assert := assert.New(t)
+	b := newTestBalancer(t, UpstreamServerOption{
+		Policy: PolicyWeightedRoundRobin,
+		Servers: []UpstreamServerConfig{
+			{
+				Addr:   "http://127.0.0.1:3001",
+				Weight: 5,
+			},
+			{
+				Addr: "http://127.0.0.1:3002",
+			},
+			{
+				Addr:   "http://127.0.0.1:3003",
+				Backup: true,
+			},
+		},
+	})
+	c := elton.NewContext(nil, httptest.NewRequest("GET", "/", nil))
+	counts := make(map[string]int)
+	for i := 0; i < 60; i++ {
+		upstream, done := b.Next(c)
+		assert.Nil(done)
+		counts[upstream.URL.String()]++
+	}
+	assert.Equal(map[string]int{
+		"http://127.0.0.1:3001": 50,
+		"http://127.0.0.1:3002": 10,
+	}, counts)
+
+	// 主服务均不可用时使用备用服务
+	for _, up := range b.uh.GetUpstreamList() {
+		if !up.Backup {
+			up.Sick()
+		}
+	}
+	upstream, _ := b.Next(c)
+	assert.Equal("http://127.0.0.1:3003", upstream.URL.String())
+}
+
+func TestConsistentHash(t *testing.T) {
+	assert := assert.New(t)
+	servers := []UpstreamServerConfig{
+		{
+			Addr: "http://127.0.0.1:3001",
+		},
+		{
+			Addr: "http://127.0.0.1:3002",
+		},
+		{
+			Addr: "http://127.0.0.1:3003",
+		},
+	}
+	b := newTestBalancer(t, UpstreamServerOption{
+		Policy:  PolicyConsistentHash,
+		HashKey: "header:X-User",
+		Servers: servers,
+	})
+	assert.Equal(3*hashReplicas, len(b.ring))
+
+	newContext := func(user string) *elton.Context {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", user)
+		return elton.NewContext(nil, req)
+	}
+	users := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	selected := make(map[string]*us.HTTPUpstream)
+	for _, user := range users {
+		upstream, _ := b.Next(newContext(user))
+		assert.NotNil(upstream)
+		selected[user] = upstream
+		// 相同的key选择相同的服务
+		for i := 0; i < 5; i++ {
+			item, _ := b.Next(newContext(user))
+			assert.Equal(upstream, item)
+		}
+	}
+
+	// 服务不可用时，只影响该服务的key
+	sick := selected["a"]
+	sick.Sick()
+	for _, user := range users {
+		upstream, _ := b.Next(newContext(user))
+		assert.NotEqual(sick, upstream)
+		if selected[user] != sick {
+			assert.Equal(selected[user], upstream)
+		}
+	}
+}
+
+func TestBalancerGetHashKey(t *testing.T) {
+	assert := assert.New(t)
+	req := httptest.NewRequest("GET", "/users?id=1", nil)
+	req.Host = "example.com"
+	req.Header.Set("X-User", "tree")
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header.Set("Cookie", "jt=abc")
+	c := elton.NewContext(nil, req)
+
+	b := &balancer{}
+	assert.Equal("example.com/users?id=1", b.getHashKey(c))
+	b.hashKey = HashKeyIP
+	assert.Equal("1.1.1.1", b.getHashKey(c))
+	b.hashKey = "header:X-User"
+	assert.Equal("tree", b.getHashKey(c))
+	b.hashKey = "cookie:jt"
+	assert.Equal("abc", b.getHashKey(c))
+	b.hashKey = "cookie:none"
+	assert.Equal("", b.getHashKey(c))
+}
+
+func TestBalancerNextExcept(t *testing.T) {
+	assert := assert.New(t)
+	servers := []UpstreamServerConfig{
+		{
+			Addr:   "http://127.0.0.1:3001",
+			Weight: 5,
+		},
+		{
+			Addr: "http://127.0.0.1:3002",
+		},
+		{
+			Addr: "http://127.0.0.1:3003",
+		},
+		{
+			Addr:   "http://127.0.0.1:3004",
+			Backup: true,
+		},
+	}
+	skipAddrs := func(addrs ...string) func(*us.HTTPUpstream) bool {
+		return func(upstream *us.HTTPUpstream) bool {
+			return containsString(addrs, upstream.URL.String())
+		}
+	}
+
+	// 按权重选择，备用服务只在主服务均跳过时使用
+	b := newTestBalancer(t, UpstreamServerOption{
+		Policy:  PolicyWeightedRoundRobin,
+		Servers: servers,
+	})
+	c := elton.NewContext(nil, httptest.NewRequest("GET", "/", nil))
+	counts := make(map[string]int)
+	for i := 0; i < 18; i++ {
+		upstream, _ := b.NextExcept(c, skipAddrs("http://127.0.0.1:3003"))
+		counts[upstream.URL.String()]++
+	}
+	assert.Equal(map[string]int{
+		"http://127.0.0.1:3001": 15,
+		"http://127.0.0.1:3002": 3,
+	}, counts)
+	upstream, _ := b.NextExcept(c, skipAddrs("http://127.0.0.1:3001", "http://127.0.0.1:3002", "http://127.0.0.1:3003"))
+	assert.Equal("http://127.0.0.1:3004", upstream.URL.String())
+	upstream, _ = b.NextExcept(c, skipAddrs("http://127.0.0.1:3001", "http://127.0.0.1:3002", "http://127.0.0.1:3003", "http://127.0.0.1:3004"))
+	assert.Nil(upstream)
+
+	// 一致性哈希选择哈希环中的下一个服务（与该服务不可用时的选择一致）
+	b = newTestBalancer(t, UpstreamServerOption{
+		Policy:  PolicyConsistentHash,
+		HashKey: "header:X-User",
+		Servers: servers,
+	})
+	for _, user := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", user)
+		c := elton.NewContext(nil, req)
+		first, _ := b.Next(c)
+		upstream, _ := b.NextExcept(c, skipAddrs(first.URL.String()))
+		first.Sick()
+		expected, _ := b.Next(c)
+		first.Healthy()
+		assert.NotEqual(first, upstream)
+		assert.Equal(expected, upstream)
+	}
+
+	// 其它策略则轮询选择未跳过的服务
+	b = newTestBalancer(t, UpstreamServerOption{
+		Policy:  us.PolicyFirst,
+		Servers: servers,
+	})
+	upstream, done := b.NextExcept(c, skipAddrs("http://127.0.0.1:3001"))
+	assert.Nil(done)
+	assert.Equal("http://127.0.0.1:3002", upstream.URL.String())
+	b = newTestBalancer(t, UpstreamServerOption{
+		Policy:  us.PolicyRoundRobin,
+		Servers: servers,
+	})
+	counts = make(map[string]int)
+	for i := 0; i < 10; i++ {
+		upstream, _ := b.NextExcept(c, skipAddrs("http://127.0.0.1:3001"))
+		counts[upstream.URL.String()]++
+	}
+	assert.Equal(map[string]int{
+		"http://127.0.0.1:3002": 5,
+		"http://127.0.0.1:3003": 5,
+	}, counts)
+}
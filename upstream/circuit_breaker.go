@@ -0,0 +1,223 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 每个upstream target的熔断器，在统计周期内出错率或慢请求比例超过阈值时打开（拒绝请求），
+// 打开一段时间后进入半开状态，允许少量请求探测，探测成功则关闭，失败则重新打开
+
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// CircuitClosed circuit breaker is closed, requests are allowed
+	CircuitClosed = "closed"
+	// CircuitOpen circuit breaker is open, requests are rejected
+	CircuitOpen = "open"
+	// CircuitHalfOpen circuit breaker is half open, a few requests are allowed to probe
+	CircuitHalfOpen = "halfOpen"
+)
+
+const (
+	defaultCircuitBreakerWindow           = 10 * time.Second
+	defaultCircuitBreakerMinRequests      = 20
+	defaultCircuitBreakerOpenTimeout      = 30 * time.Second
+	defaultCircuitBreakerHalfOpenRequests = 3
+)
+
+type (
+	// CircuitBreakerOption circuit breaker option
+	CircuitBreakerOption struct {
+		// 出错（5xx或连接失败）的百分比阈值，为0则不根据出错率熔断
+		ErrorRate int
+		// 慢请求的耗时与百分比阈值，为0则不根据慢请求熔断
+		SlowLatency time.Duration
+		SlowRate    int
+		// 统计周期内最少的请求数，达到才判断是否熔断
+		MinRequests int
+		// 统计周期
+		Window time.Duration
+		// 打开后进入半开状态的时长
+		OpenTimeout time.Duration
+		// 半开状态允许的探测请求数，均成功则关闭
+		HalfOpenRequests int
+	}
+	// circuitBreaker circuit breaker of upstream target
+	circuitBreaker struct {
+		mu    *sync.Mutex
+		opt   CircuitBreakerOption
+		state string
+		// 统计周期的结束时间以及请求、出错、统计耗时的请求与慢请求数
+		windowEnd time.Time
+		requests  int
+		failures  int
+		timed     int
+		slows     int
+		// 打开的时间
+		openedAt time.Time
+		// 半开状态处理中与成功的请求数
+		probing   int
+		successes int
+	}
+)
+
+// Enabled check the circuit breaker is enabled or not
+func (opt *CircuitBreakerOption) Enabled() bool {
+	return opt.ErrorRate > 0 || (opt.SlowLatency > 0 && opt.SlowRate > 0)
+}
+
+// newCircuitBreaker create a circuit breaker, the default values will be used if option is not set
+func newCircuitBreaker(opt CircuitBreakerOption) *circuitBreaker {
+	if opt.MinRequests <= 0 {
+		opt.MinRequests = defaultCircuitBreakerMinRequests
+	}
+	if opt.Window <= 0 {
+		opt.Window = defaultCircuitBreakerWindow
+	}
+	if opt.OpenTimeout <= 0 {
+		opt.OpenTimeout = defaultCircuitBreakerOpenTimeout
+	}
+	if opt.HalfOpenRequests <= 0 {
+		opt.HalfOpenRequests = defaultCircuitBreakerHalfOpenRequests
+	}
+	return &circuitBreaker{
+		mu:    &sync.Mutex{},
+		opt:   opt,
+		state: CircuitClosed,
+	}
+}
+
+// setState set the state of circuit breaker and reset the counts
+func (cb *circuitBreaker) setState(state string, now time.Time) {
+	cb.state = state
+	cb.requests = 0
+	cb.failures = 0
+	cb.timed = 0
+	cb.slows = 0
+	cb.windowEnd = now.Add(cb.opt.Window)
+	cb.probing = 0
+	cb.successes = 0
+	if state == CircuitOpen {
+		cb.openedAt = now
+	}
+}
+
+// refresh refresh the state, the open circuit breaker will be half open after timeout
+func (cb *circuitBreaker) refresh(now time.Time) {
+	if cb.state == CircuitOpen && now.Sub(cb.openedAt) >= cb.opt.OpenTimeout {
+		cb.setState(CircuitHalfOpen, now)
+	}
+}
+
+// State get the state of circuit breaker
+func (cb *circuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh(time.Now())
+	return cb.state
+}
+
+// Available check the request is allowed or not, it doesn't occupy the probe of half open
+func (cb *circuitBreaker) Available() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh(time.Now())
+	switch cb.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return cb.probing+cb.successes < cb.opt.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// Allow check the request is allowed or not, the probe of half open will be occupied if allowed
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.refresh(time.Now())
+	switch cb.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if cb.probing+cb.successes >= cb.opt.HalfOpenRequests {
+			return false
+		}
+		cb.probing++
+		return true
+	default:
+		return true
+	}
+}
+
+// Done record the result of request, the latency is the duration until the response
+// header is received, the negative latency(e.g.: upgrade or streamed response) isn't
+// counted in the slow rate
+func (cb *circuitBreaker) Done(failed bool, latency time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now()
+	timed := latency >= 0
+	slow := timed && cb.opt.SlowLatency > 0 && latency >= cb.opt.SlowLatency
+	switch cb.state {
+	case CircuitHalfOpen:
+		if cb.probing > 0 {
+			cb.probing--
+		}
+		// 探测失败则重新打开
+		if failed || slow {
+			cb.setState(CircuitOpen, now)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.opt.HalfOpenRequests {
+			cb.setState(CircuitClosed, now)
+		}
+	case CircuitClosed:
+		if now.After(cb.windowEnd) {
+			cb.setState(CircuitClosed, now)
+		}
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if timed {
+			cb.timed++
+		}
+		if slow {
+			cb.slows++
+		}
+		// 出错率与慢请求率分别在请求数达到最少请求数时才判断
+		errorTripped := cb.opt.ErrorRate > 0 &&
+			cb.requests >= cb.opt.MinRequests &&
+			cb.failures*100 >= cb.opt.ErrorRate*cb.requests
+		slowTripped := cb.opt.SlowRate > 0 &&
+			cb.timed >= cb.opt.MinRequests &&
+			cb.slows*100 >= cb.opt.SlowRate*cb.timed
+		if errorTripped || slowTripped {
+			cb.setState(CircuitOpen, now)
+		}
+	}
+}
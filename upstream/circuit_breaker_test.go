@@ -0,0 +1,208 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	us "github.com/vicanso/upstream"
+)
+
+func TestCircuitBreakerOptionEnabled(t *testing.T) {
+	assert := assert.New(t)
+	opt := CircuitBreakerOption{}
+	assert.False(opt.Enabled())
+	opt.SlowLatency = time.Second
+	assert.False(opt.Enabled())
+	opt.SlowRate = 50
+	assert.True(opt.Enabled())
+	assert.True((&CircuitBreakerOption{
+		ErrorRate: 50,
+	}).Enabled())
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	assert := assert.New(t)
+	cb := newCircuitBreaker(CircuitBreakerOption{
+		ErrorRate:        50,
+		MinRequests:      4,
+		OpenTimeout:      50 * time.Millisecond,
+		HalfOpenRequests: 2,
+	})
+	assert.Equal(CircuitClosed, cb.State())
+
+	// 请求数未达到最少请求数，不熔断
+	for i := 0; i < 3; i++ {
+		assert.True(cb.Allow())
+		cb.Done(true, time.Millisecond)
+	}
+	assert.Equal(CircuitClosed, cb.State())
+	assert.True(cb.Allow())
+	cb.Done(false, time.Millisecond)
+	assert.Equal(CircuitOpen, cb.State())
+	assert.False(cb.Available())
+	assert.False(cb.Allow())
+
+	// 超时后进入半开状态，只允许指定数量的探测请求
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(CircuitHalfOpen, cb.State())
+	assert.True(cb.Allow())
+	assert.True(cb.Allow())
+	assert.False(cb.Available())
+	assert.False(cb.Allow())
+	// 探测失败则重新打开
+	cb.Done(true, time.Millisecond)
+	assert.Equal(CircuitOpen, cb.State())
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(cb.Allow())
+	cb.Done(false, time.Millisecond)
+	assert.Equal(CircuitHalfOpen, cb.State())
+	assert.True(cb.Allow())
+	cb.Done(false, time.Millisecond)
+	// 探测均成功则关闭
+	assert.Equal(CircuitClosed, cb.State())
+	assert.True(cb.Available())
+}
+
+func TestCircuitBreakerSlowRate(t *testing.T) {
+	assert := assert.New(t)
+	cb := newCircuitBreaker(CircuitBreakerOption{
+		SlowLatency: 100 * time.Millisecond,
+		SlowRate:    50,
+		MinRequests: 2,
+	})
+	cb.Done(false, 10*time.Millisecond)
+	cb.Done(false, 200*time.Millisecond)
+	assert.Equal(CircuitOpen, cb.State())
+
+	// 未统计耗时的请求不计入慢请求率
+	cb = newCircuitBreaker(CircuitBreakerOption{
+		SlowLatency: 100 * time.Millisecond,
+		SlowRate:    50,
+		MinRequests: 2,
+	})
+	cb.Done(false, 200*time.Millisecond)
+	cb.Done(false, -1)
+	cb.Done(false, -1)
+	assert.Equal(CircuitClosed, cb.State())
+	cb.Done(false, 10*time.Millisecond)
+	assert.Equal(CircuitOpen, cb.State())
+}
+
+func TestCircuitBreakerLatencyUntilResponseHeader(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			// 流式转发的响应，响应头延时返回也不作为慢请求
+			time.Sleep(60 * time.Millisecond)
+			w.Header().Set(elton.HeaderContentType, "text/event-stream")
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// 响应头已返回，数据的读取时长不计入耗时
+		time.Sleep(60 * time.Millisecond)
+		_, _ = w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+
+	opt := UpstreamServerOption{
+		Policy: us.PolicyFirst,
+		CircuitBreaker: CircuitBreakerOption{
+			SlowLatency: 30 * time.Millisecond,
+			SlowRate:    50,
+			MinRequests: 1,
+		},
+		Servers: []UpstreamServerConfig{
+			{
+				Addr: server.URL,
+			},
+		},
+	}
+	b := newTestBalancer(t, opt)
+	fn := newProxyMid(opt, newTransport(opt), b, nil)
+	upstream := b.uh.GetUpstreamList()[0]
+	for _, url := range []string{"/", "/events"} {
+		c := elton.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+		c.Next = func() error {
+			return nil
+		}
+		assert.Nil(fn(c))
+		assert.Equal(CircuitClosed, b.getCircuitState(upstream))
+	}
+}
+
+func TestBalancerCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	b := newTestBalancer(t, UpstreamServerOption{
+		Policy: us.PolicyFirst,
+		CircuitBreaker: CircuitBreakerOption{
+			ErrorRate:   50,
+			MinRequests: 1,
+		},
+		Servers: []UpstreamServerConfig{
+			{
+				Addr: "http://127.0.0.1:3001",
+			},
+			{
+				Addr: "http://127.0.0.1:3002",
+			},
+		},
+	})
+	upstreamList := b.uh.GetUpstreamList()
+	c := elton.NewContext(nil, httptest.NewRequest("GET", "/", nil))
+
+	upstream, _, err := nextUpstream(c, b)
+	assert.Nil(err)
+	assert.Equal(upstreamList[0], upstream)
+	assert.Equal(CircuitClosed, b.getCircuitState(upstream))
+
+	// 第一个熔断后选择第二个
+	b.done(upstreamList[0], true, time.Millisecond)
+	assert.Equal(CircuitOpen, b.getCircuitState(upstreamList[0]))
+	upstream, done, err := nextUpstream(c, b)
+	assert.Nil(err)
+	assert.Equal(upstreamList[1], upstream)
+	assert.Nil(done)
+
+	// 全部熔断
+	b.done(upstreamList[1], true, time.Millisecond)
+	_, _, err = nextUpstream(c, b)
+	assert.Equal(ErrCircuitOpen, err)
+	assert.False(hasUntriedUpstream(b, nil))
+
+	// 未启用熔断
+	b = newTestBalancer(t, UpstreamServerOption{
+		Servers: []UpstreamServerConfig{
+			{
+				Addr: "http://127.0.0.1:3001",
+			},
+		},
+	})
+	assert.Empty(b.getCircuitState(b.uh.GetUpstreamList()[0]))
+}
@@ -0,0 +1,288 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// upstream的健康检查，主动检测定时请求health check的地址（未配置则检测端口），
+// 连续成功rise次设置为healthy，连续失败fall次设置为sick。
+// 被动检测则根据转发请求的结果，连续出错（5xx或连接失败）则设置为sick，
+// 在cool-down之后再重新启用
+
+package upstream
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	us "github.com/vicanso/upstream"
+	"go.uber.org/atomic"
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckTimeout  = 3 * time.Second
+	defaultHealthCheckRise     = 1
+	defaultHealthCheckFall     = 2
+	defaultPassiveCooldown     = 30 * time.Second
+
+	defaultHealthCheckStatusMin = http.StatusOK
+	defaultHealthCheckStatusMax = http.StatusBadRequest - 1
+)
+
+const userAgent = "pike/health-check"
+
+type (
+	// HealthCheckOption health check option
+	HealthCheckOption struct {
+		Interval time.Duration
+		Timeout  time.Duration
+		// 期望的状态码范围
+		StatusMin int
+		StatusMax int
+		// 连续成功的次数
+		Rise int
+		// 连续失败的次数
+		Fall int
+		// 被动检测连续出错的次数，为0则不启用
+		PassiveFailures int
+		// 被动检测设置为sick后重新启用的时长
+		PassiveCooldown time.Duration
+	}
+	// targetHealth the health status of target
+	targetHealth struct {
+		// 每个target使用单独的锁，避免被动检测时所有请求竞争同一个锁
+		mu       *sync.Mutex
+		upstream *us.HTTPUpstream
+		// 主动检测连续成功与失败的次数
+		successes int
+		failures  int
+		// 被动检测连续出错的次数
+		passiveFailures int
+		// 被动检测设置为sick的截止时间
+		cooldownUntil time.Time
+	}
+	// healthChecker health checker of upstream
+	healthChecker struct {
+		// 检测的url path，为空则检测端口
+		path    string
+		opt     HealthCheckOption
+		client  *http.Client
+		targets map[*us.HTTPUpstream]*targetHealth
+		// 状态变化时的回调
+		onStatus func(status int32, upstream *us.HTTPUpstream)
+		stopped  atomic.Bool
+	}
+)
+
+// newHealthChecker create a health checker, the default values will be used if option is not set
+func newHealthChecker(path string, opt HealthCheckOption, uh *us.HTTP, onStatus func(int32, *us.HTTPUpstream)) *healthChecker {
+	if opt.Interval <= 0 {
+		opt.Interval = defaultHealthCheckInterval
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultHealthCheckTimeout
+	}
+	if opt.StatusMin <= 0 || opt.StatusMax <= 0 {
+		opt.StatusMin = defaultHealthCheckStatusMin
+		opt.StatusMax = defaultHealthCheckStatusMax
+	}
+	if opt.Rise <= 0 {
+		opt.Rise = defaultHealthCheckRise
+	}
+	if opt.Fall <= 0 {
+		opt.Fall = defaultHealthCheckFall
+	}
+	if opt.PassiveCooldown <= 0 {
+		opt.PassiveCooldown = defaultPassiveCooldown
+	}
+	targets := make(map[*us.HTTPUpstream]*targetHealth)
+	for _, upstream := range uh.GetUpstreamList() {
+		targets[upstream] = &targetHealth{
+			mu:       &sync.Mutex{},
+			upstream: upstream,
+		}
+	}
+	return &healthChecker{
+		path: path,
+		opt:  opt,
+		client: &http.Client{
+			Timeout: opt.Timeout,
+		},
+		targets:  targets,
+		onStatus: onStatus,
+	}
+}
+
+// ping check the upstream is healthy or not
+func (hc *healthChecker) ping(upstream *us.HTTPUpstream) bool {
+	info := upstream.URL
+	// 如果没有配置path，则检测端口
+	if hc.path == "" {
+		port := info.Port()
+		if port == "" {
+			port = "80"
+			if info.Scheme == "https" {
+				port = "443"
+			}
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(info.Hostname(), port), hc.opt.Timeout)
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}
+	req, err := http.NewRequest(http.MethodGet, info.String()+hc.path, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode >= hc.opt.StatusMin && resp.StatusCode <= hc.opt.StatusMax
+}
+
+// setStatus set the status of upstream, the on status callback will be called if status is changed
+func (hc *healthChecker) setStatus(upstream *us.HTTPUpstream, status int32) {
+	if upstream.Status() == status {
+		return
+	}
+	switch status {
+	case us.UpstreamHealthy:
+		upstream.Healthy()
+	case us.UpstreamSick:
+		upstream.Sick()
+	}
+	if hc.onStatus != nil {
+		hc.onStatus(status, upstream)
+	}
+}
+
+// update update the status of target by the result of active check
+func (hc *healthChecker) update(th *targetHealth, healthy bool) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	status := th.upstream.Status()
+	if healthy {
+		th.successes++
+		th.failures = 0
+	} else {
+		th.failures++
+		th.successes = 0
+	}
+	switch {
+	// 首次检测直接根据结果设置状态
+	case status == us.UpstreamUnknown:
+		if healthy {
+			hc.setStatus(th.upstream, us.UpstreamHealthy)
+		} else {
+			hc.setStatus(th.upstream, us.UpstreamSick)
+		}
+	// 被动检测设置为sick的，在cool-down之前不重新启用
+	case healthy && th.successes >= hc.opt.Rise && time.Now().After(th.cooldownUntil):
+		hc.setStatus(th.upstream, us.UpstreamHealthy)
+	case !healthy && th.failures >= hc.opt.Fall:
+		hc.setStatus(th.upstream, us.UpstreamSick)
+	}
+}
+
+// Check do health check for all targets
+func (hc *healthChecker) Check() {
+	wg := sync.WaitGroup{}
+	for _, th := range hc.targets {
+		// ignore的不需要检测
+		if th.upstream.Status() == us.UpstreamIgnored {
+			continue
+		}
+		wg.Add(1)
+		go func(th *targetHealth) {
+			defer wg.Done()
+			hc.update(th, hc.ping(th.upstream))
+		}(th)
+	}
+	wg.Wait()
+}
+
+// Start start health check, it will check targets by interval until stop
+func (hc *healthChecker) Start() {
+	ticker := time.NewTicker(hc.opt.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if hc.stopped.Load() {
+			return
+		}
+		hc.Check()
+	}
+}
+
+// Stop stop health check
+func (hc *healthChecker) Stop() {
+	hc.stopped.Store(true)
+}
+
+// Observe observe the result of proxy request, it is used for passive health check.
+// The target will be set to sick if the count of consecutive failures reaches the threshold,
+// and it will be re-enabled after cool-down.
+func (hc *healthChecker) Observe(upstream *us.HTTPUpstream, failed bool) {
+	if hc.opt.PassiveFailures <= 0 {
+		return
+	}
+	// targets在创建后不再修改，因此不需要加锁
+	th, ok := hc.targets[upstream]
+	if !ok {
+		return
+	}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if !failed {
+		th.passiveFailures = 0
+		return
+	}
+	th.passiveFailures++
+	if th.passiveFailures < hc.opt.PassiveFailures || upstream.Status() != us.UpstreamHealthy {
+		return
+	}
+	th.passiveFailures = 0
+	th.cooldownUntil = time.Now().Add(hc.opt.PassiveCooldown)
+	hc.setStatus(upstream, us.UpstreamSick)
+	time.AfterFunc(hc.opt.PassiveCooldown, func() {
+		hc.recover(th)
+	})
+}
+
+// recover re-enable the target after cool-down, if the active check is still failed, it will be kept sick
+func (hc *healthChecker) recover(th *targetHealth) {
+	if hc.stopped.Load() {
+		return
+	}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.upstream.Status() != us.UpstreamSick ||
+		time.Now().Before(th.cooldownUntil) ||
+		th.failures >= hc.opt.Fall {
+		return
+	}
+	hc.setStatus(th.upstream, us.UpstreamHealthy)
+}
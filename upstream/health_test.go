@@ -0,0 +1,130 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	us "github.com/vicanso/upstream"
+	"go.uber.org/atomic"
+)
+
+func newTestHealthChecker(t *testing.T, addr string, opt HealthCheckOption) (*healthChecker, *us.HTTPUpstream, *[]int32) {
+	uh := &us.HTTP{}
+	err := uh.Add(addr)
+	assert.Nil(t, err)
+	statusList := make([]int32, 0)
+	hc := newHealthChecker("/ping", opt, uh, func(status int32, _ *us.HTTPUpstream) {
+		statusList = append(statusList, status)
+	})
+	return hc, uh.GetUpstreamList()[0], &statusList
+}
+
+func TestHealthCheckerActive(t *testing.T) {
+	assert := assert.New(t)
+	healthy := atomic.NewBool(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if healthy.Load() {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	hc, upstream, statusList := newTestHealthChecker(t, ts.URL, HealthCheckOption{
+		StatusMin: 200,
+		StatusMax: 299,
+		Rise:      2,
+		Fall:      2,
+	})
+	// 首次检测直接设置状态
+	hc.Check()
+	assert.Equal(us.UpstreamHealthy, upstream.Status())
+
+	// 连续失败2次才设置为sick
+	healthy.Store(false)
+	hc.Check()
+	assert.Equal(us.UpstreamHealthy, upstream.Status())
+	hc.Check()
+	assert.Equal(us.UpstreamSick, upstream.Status())
+
+	// 连续成功2次才设置为healthy
+	healthy.Store(true)
+	hc.Check()
+	assert.Equal(us.UpstreamSick, upstream.Status())
+	hc.Check()
+	assert.Equal(us.UpstreamHealthy, upstream.Status())
+
+	assert.Equal([]int32{
+		us.UpstreamHealthy,
+		us.UpstreamSick,
+		us.UpstreamHealthy,
+	}, *statusList)
+}
+
+func TestHealthCheckerPassive(t *testing.T) {
+	assert := assert.New(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	hc, upstream, _ := newTestHealthChecker(t, ts.URL, HealthCheckOption{
+		PassiveFailures: 2,
+		PassiveCooldown: 50 * time.Millisecond,
+	})
+	defer hc.Stop()
+	hc.Check()
+	assert.Equal(us.UpstreamHealthy, upstream.Status())
+
+	// 成功的请求重置出错次数
+	hc.Observe(upstream, true)
+	hc.Observe(upstream, false)
+	hc.Observe(upstream, true)
+	assert.Equal(us.UpstreamHealthy, upstream.Status())
+	hc.Observe(upstream, true)
+	assert.Equal(us.UpstreamSick, upstream.Status())
+
+	// cool-down之前主动检测成功也不启用
+	hc.Check()
+	assert.Equal(us.UpstreamSick, upstream.Status())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(us.UpstreamHealthy, upstream.Status())
+}
+
+func TestIsProxyFailed(t *testing.T) {
+	assert := assert.New(t)
+	c := elton.NewContext(nil, httptest.NewRequest("GET", "/", nil))
+	assert.True(isProxyFailed(c))
+	c.StatusCode = http.StatusBadGateway
+	assert.True(isProxyFailed(c))
+	c.StatusCode = http.StatusNotFound
+	assert.False(isProxyFailed(c))
+}
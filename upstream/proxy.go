@@ -0,0 +1,375 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 转发请求至upstream，响应数据默认保存至context中（用于缓存与压缩），
+// 对于不可缓存或数据过大的响应，则以流的方式直接转发至客户端，避免占用过多内存
+
+package upstream
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vicanso/elton"
+	"github.com/vicanso/elton/middleware"
+	"github.com/vicanso/hes"
+	"github.com/vicanso/pike/util"
+)
+
+const (
+	// proxyStreamOptionKey the key of stream option in context
+	proxyStreamOptionKey = "_proxyStreamOption"
+	// proxyResponseHeaderAtKey the key of the time when the response header is received in context
+	proxyResponseHeaderAtKey = "_proxyResponseHeaderAt"
+	// ProxyStreamedSizeKey the key of the size of streamed response in context
+	ProxyStreamedSizeKey = "proxyStreamedSize"
+)
+
+var (
+	// ErrResponseTooLarge the response body of upstream is larger than the max size
+	ErrResponseTooLarge = util.NewError("Response Body Too Large", http.StatusBadGateway)
+	// ErrHijackNotSupported the response writer does not support hijack
+	ErrHijackNotSupported = errors.New("hijack is not supported")
+)
+
+type (
+	// StreamOption the option of streaming response
+	StreamOption struct {
+		// 是否直接以流的方式转发响应
+		Enabled bool
+		// 响应数据超过此尺寸时以流的方式转发，为0则不启用
+		Threshold int
+		// 非流式转发时响应数据的最大尺寸，超出则返回502，为0则不限制
+		MaxBodySize int
+		// 开始以流的方式转发时（写响应头之前）的回调，用于添加响应头
+		OnStream func(header http.Header)
+		// upgrade的连接（如websocket）的空闲超时，为0则不限制
+		UpgradeIdleTimeout time.Duration
+	}
+	// proxyResponseWriter the response writer of proxy, the response is saved to context
+	// unless it should be streamed to client
+	proxyResponseWriter struct {
+		c   *elton.Context
+		opt StreamOption
+		// 是否以流的方式转发
+		streaming bool
+		// 响应数据是否超出最大尺寸
+		exceeded bool
+		// 流式转发的数据长度
+		written int
+		// 实时推送的响应（如server-sent events），每次写入均flush
+		flushImmediately bool
+	}
+	// proxyResponseBody the response body of upstream, it is stopped reading if
+	// the response is larger than the max size
+	proxyResponseBody struct {
+		io.ReadCloser
+		w *proxyResponseWriter
+	}
+	// idleTimeoutConn the connection which is closed if there is no data
+	// read or written during the idle timeout
+	idleTimeoutConn struct {
+		net.Conn
+		timeout time.Duration
+	}
+	// bufferPool the buffer pool for copying response
+	bufferPool struct {
+		pool sync.Pool
+	}
+)
+
+// SetStreamOption set the stream option of proxy request
+func SetStreamOption(c *elton.Context, opt StreamOption) {
+	c.Set(proxyStreamOptionKey, &opt)
+}
+
+func getStreamOption(c *elton.Context) StreamOption {
+	value, exists := c.Get(proxyStreamOptionKey)
+	if !exists {
+		return StreamOption{}
+	}
+	opt, ok := value.(*StreamOption)
+	if !ok {
+		return StreamOption{}
+	}
+	return *opt
+}
+
+// Read read data and extend the deadline
+func (conn *idleTimeoutConn) Read(p []byte) (int, error) {
+	_ = conn.SetDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Read(p)
+}
+
+// Write write data and extend the deadline
+func (conn *idleTimeoutConn) Write(p []byte) (int, error) {
+	_ = conn.SetDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Write(p)
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Get get buffer from pool
+func (bp *bufferPool) Get() []byte {
+	p, _ := bp.pool.Get().(*[]byte)
+	return *p
+}
+
+// Put put buffer to pool
+func (bp *bufferPool) Put(data []byte) {
+	bp.pool.Put(&data)
+}
+
+// Read read data from response body, return EOF if the response is larger than the max size
+func (body *proxyResponseBody) Read(p []byte) (int, error) {
+	if body.w.exceeded {
+		return 0, io.EOF
+	}
+	return body.ReadCloser.Read(p)
+}
+
+// modifyResponse check the response should be streamed or not by content length
+func (w *proxyResponseWriter) modifyResponse(resp *http.Response) error {
+	// 已接收到响应头，停止超时的计时并记录时间
+	stopResponseHeaderTimer(resp.Request)
+	w.c.Set(proxyResponseHeaderAtKey, time.Now())
+	// upgrade的响应由reverse proxy转发，body需要保持原有的io.ReadWriteCloser
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+	// 实时推送的响应，直接以流的方式转发
+	if isStreamingResponse(resp.Header) {
+		w.streaming = true
+		w.flushImmediately = true
+		return nil
+	}
+	opt := w.opt
+	if opt.Enabled ||
+		(opt.Threshold > 0 && resp.ContentLength > int64(opt.Threshold)) {
+		w.streaming = true
+		return nil
+	}
+	if opt.MaxBodySize > 0 {
+		if resp.ContentLength > int64(opt.MaxBodySize) {
+			// 设置状态码，避免被认为upstream出错
+			w.c.StatusCode = resp.StatusCode
+			return ErrResponseTooLarge
+		}
+		// 未知长度的响应，超出最大尺寸则停止读取
+		resp.Body = &proxyResponseBody{
+			ReadCloser: resp.Body,
+			w:          w,
+		}
+	}
+	return nil
+}
+
+// isStreamingResponse check the response should be flushed to client
+// incrementally, e.g.: server-sent events or the uncacheable response
+// with Cache-Control: no-transform
+func isStreamingResponse(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get(elton.HeaderContentType))
+	if mediaType == "text/event-stream" {
+		return true
+	}
+	noTransform := false
+	hasMaxAge := false
+	uncacheable := false
+	for _, value := range header.Values(elton.HeaderCacheControl) {
+		for _, item := range strings.Split(value, ",") {
+			directive := strings.ToLower(strings.TrimSpace(item))
+			if index := strings.Index(directive, "="); index != -1 {
+				directive = strings.TrimSpace(directive[:index])
+			}
+			switch directive {
+			case "no-transform":
+				noTransform = true
+			case "max-age", "s-maxage":
+				hasMaxAge = true
+			case "private", "no-store", "no-cache":
+				uncacheable = true
+			}
+		}
+	}
+	// 可缓存的no-transform响应仍需缓存（缓存时不压缩），不以流的方式转发
+	return noTransform && (!hasMaxAge || uncacheable)
+}
+
+// Header get the header of response
+func (w *proxyResponseWriter) Header() http.Header {
+	return w.c.Header()
+}
+
+// WriteHeader set the status code, the header is written to client if streaming
+func (w *proxyResponseWriter) WriteHeader(statusCode int) {
+	w.c.StatusCode = statusCode
+	if w.streaming {
+		w.commit()
+	}
+}
+
+// commit write the header and the buffered data to client
+func (w *proxyResponseWriter) commit() {
+	c := w.c
+	if c.Committed {
+		return
+	}
+	w.streaming = true
+	if w.opt.OnStream != nil {
+		w.opt.OnStream(c.Header())
+	}
+	c.Committed = true
+	c.Response.WriteHeader(c.StatusCode)
+	if c.BodyBuffer != nil {
+		buf := c.BodyBuffer.Bytes()
+		c.BodyBuffer = nil
+		_, _ = w.Write(buf)
+	}
+}
+
+// Write write data to context or client(streaming)
+func (w *proxyResponseWriter) Write(data []byte) (int, error) {
+	c := w.c
+	if c.Committed {
+		n, err := c.Response.Write(data)
+		w.written += n
+		if err == nil && w.flushImmediately {
+			w.Flush()
+		}
+		return n, err
+	}
+	// 超出最大尺寸的数据直接丢弃
+	if w.exceeded {
+		return len(data), nil
+	}
+	size := len(data)
+	if c.BodyBuffer != nil {
+		size += c.BodyBuffer.Len()
+	}
+	// 超过尺寸则以流的方式转发
+	if w.opt.Threshold > 0 && size > w.opt.Threshold {
+		w.commit()
+		return w.Write(data)
+	}
+	if w.opt.MaxBodySize > 0 && size > w.opt.MaxBodySize {
+		w.exceeded = true
+		return len(data), nil
+	}
+	return c.Write(data)
+}
+
+// Flush flush the data to client if streaming
+func (w *proxyResponseWriter) Flush() {
+	if !w.c.Committed {
+		return
+	}
+	if f, ok := w.c.Response.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijack the connection of client for upgrade request,
+// the data is transferred between client and upstream directly
+func (w *proxyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.c.Response.(http.Hijacker)
+	if !ok {
+		return nil, nil, ErrHijackNotSupported
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// 响应已由reverse proxy直接写入连接
+	w.c.Committed = true
+	w.c.StatusCode = http.StatusSwitchingProtocols
+	if w.opt.UpgradeIdleTimeout > 0 {
+		conn = &idleTimeoutConn{
+			Conn:    conn,
+			timeout: w.opt.UpgradeIdleTimeout,
+		}
+	}
+	return conn, brw, nil
+}
+
+// newProxy create a proxy middleware
+func newProxy(transport http.RoundTripper, targetPicker middleware.ProxyTargetPicker) elton.Handler {
+	// 默认使用32KB的buffer
+	bufPool := newBufferPool(32 * 1024)
+	return func(c *elton.Context) (err error) {
+		target, done, err := targetPicker(c)
+		if err != nil {
+			return
+		}
+		if done != nil {
+			defer done(c)
+		}
+		c.Set(middleware.ProxyTargetKey, target.String())
+		// 重置上一次尝试的响应头接收时间
+		c.Set(proxyResponseHeaderAtKey, time.Time{})
+		w := &proxyResponseWriter{
+			c:   c,
+			opt: getStreamOption(c),
+		}
+		p := httputil.NewSingleHostReverseProxy(target)
+		p.Transport = transport
+		p.BufferPool = bufPool
+		p.ModifyResponse = w.modifyResponse
+		p.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, e error) {
+			if e == ErrResponseTooLarge {
+				err = e
+				return
+			}
+			he := hes.NewWithError(e)
+			he.Category = middleware.ErrProxyCategory
+			he.Exception = true
+			err = he
+		}
+		p.ServeHTTP(w, c.Request)
+		if w.streaming {
+			c.Set(ProxyStreamedSizeKey, w.written)
+		}
+		if err == nil && w.exceeded {
+			err = ErrResponseTooLarge
+		}
+		if err != nil {
+			// 清除已读取的响应数据
+			c.BodyBuffer = nil
+			return
+		}
+		return c.Next()
+	}
+}
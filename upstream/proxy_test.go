@@ -0,0 +1,297 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package upstream
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	"github.com/vicanso/elton/middleware"
+	"github.com/vicanso/pike/util"
+)
+
+func TestProxyStream(t *testing.T) {
+	assert := assert.New(t)
+
+	data := strings.Repeat("a", 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// 未知长度的响应
+		if req.URL.Path == "/chunked" {
+			for i := 0; i < 10; i++ {
+				_, _ = w.Write([]byte(data[:10]))
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		_, _ = w.Write([]byte(data))
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	proxy := newProxy(newTransport(UpstreamServerOption{}), func(_ *elton.Context) (*url.URL, middleware.ProxyDone, error) {
+		return target, nil, nil
+	})
+
+	tests := []struct {
+		path      string
+		opt       StreamOption
+		err       error
+		committed bool
+	}{
+		// 默认保存至context
+		{
+			path: "/",
+		},
+		// 直接以流的方式转发
+		{
+			path: "/",
+			opt: StreamOption{
+				Enabled: true,
+			},
+			committed: true,
+		},
+		// 数据长度超过阈值
+		{
+			path: "/",
+			opt: StreamOption{
+				Threshold: 50,
+			},
+			committed: true,
+		},
+		// 未知长度的数据在转发过程中超过阈值
+		{
+			path: "/chunked",
+			opt: StreamOption{
+				Threshold: 50,
+			},
+			committed: true,
+		},
+		// 数据长度超过最大尺寸
+		{
+			path: "/",
+			opt: StreamOption{
+				MaxBodySize: 50,
+			},
+			err: ErrResponseTooLarge,
+		},
+		// 未知长度的数据超过最大尺寸
+		{
+			path: "/chunked",
+			opt: StreamOption{
+				MaxBodySize: 50,
+			},
+			err: ErrResponseTooLarge,
+		},
+		// 以流的方式转发则不限制尺寸
+		{
+			path: "/chunked",
+			opt: StreamOption{
+				Threshold:   20,
+				MaxBodySize: 50,
+			},
+			committed: true,
+		},
+	}
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		c := elton.NewContext(resp, httptest.NewRequest("GET", tt.path, nil))
+		c.Next = func() error {
+			return nil
+		}
+		streamed := false
+		tt.opt.OnStream = func(header http.Header) {
+			streamed = true
+			header.Set("X-Stream", "1")
+		}
+		SetStreamOption(c, tt.opt)
+		err := proxy(c)
+		assert.Equal(tt.err, err)
+		assert.Equal(tt.committed, c.Committed)
+		assert.Equal(tt.committed, streamed)
+		if err != nil {
+			assert.Nil(c.BodyBuffer)
+			continue
+		}
+		if tt.committed {
+			assert.Nil(c.BodyBuffer)
+			assert.Equal("1", resp.Header().Get("X-Stream"))
+			assert.Equal(data, resp.Body.String())
+			assert.Equal(len(data), c.GetInt(ProxyStreamedSizeKey))
+		} else {
+			assert.Equal(data, c.BodyBuffer.String())
+			assert.Empty(resp.Body.String())
+		}
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	assert := assert.New(t)
+
+	// upstream将数据原样返回
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !util.IsUpgradeRequest(req) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	proxy := newProxy(newTransport(UpstreamServerOption{}), func(_ *elton.Context) (*url.URL, middleware.ProxyDone, error) {
+		return target, nil, nil
+	})
+
+	done := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := elton.NewContext(w, req)
+		c.Next = func() error {
+			return nil
+		}
+		SetStreamOption(c, StreamOption{
+			UpgradeIdleTimeout: 100 * time.Millisecond,
+		})
+		err := proxy(c)
+		if err == nil && !c.Committed {
+			err = ErrHijackNotSupported
+		}
+		done <- err
+	}))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	assert.Nil(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+	assert.Nil(err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.Nil(err)
+	assert.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(reader, buf)
+	assert.Nil(err)
+	assert.Equal("hello", string(buf))
+
+	// 空闲超时后连接关闭
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadByte()
+	assert.Equal(io.EOF, err)
+	select {
+	case err = <-done:
+		assert.Nil(err)
+	case <-time.After(2 * time.Second):
+		assert.Fail("proxy of upgrade request should be done")
+	}
+}
+
+func TestIsStreamingResponse(t *testing.T) {
+	assert := assert.New(t)
+	assert.False(isStreamingResponse(http.Header{}))
+	assert.True(isStreamingResponse(http.Header{
+		"Content-Type": []string{"text/event-stream; charset=utf-8"},
+	}))
+	assert.True(isStreamingResponse(http.Header{
+		"Cache-Control": []string{"no-cache, No-Transform"},
+	}))
+	assert.True(isStreamingResponse(http.Header{
+		"Cache-Control": []string{"no-transform"},
+	}))
+	assert.True(isStreamingResponse(http.Header{
+		"Cache-Control": []string{"private, max-age=600, no-transform"},
+	}))
+	// 可缓存的no-transform响应
+	assert.False(isStreamingResponse(http.Header{
+		"Cache-Control": []string{"public, max-age=600, no-transform"},
+	}))
+	assert.False(isStreamingResponse(http.Header{
+		"Cache-Control": []string{"s-maxage = 600", "no-transform"},
+	}))
+	assert.False(isStreamingResponse(http.Header{
+		"Content-Type":  []string{"text/html"},
+		"Cache-Control": []string{"no-cache"},
+	}))
+}
+
+func TestProxyEventStream(t *testing.T) {
+	assert := assert.New(t)
+
+	// 客户端收到第一个事件后，upstream才发送第二个事件
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-next:
+			_, _ = w.Write([]byte("data: 2\n\n"))
+		case <-time.After(2 * time.Second):
+			_, _ = w.Write([]byte("data: timeout\n\n"))
+		}
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	proxy := newProxy(newTransport(UpstreamServerOption{}), func(_ *elton.Context) (*url.URL, middleware.ProxyDone, error) {
+		return target, nil, nil
+	})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := elton.NewContext(w, req)
+		c.Next = func() error {
+			return nil
+		}
+		_ = proxy(c)
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	assert.Nil(err)
+	defer resp.Body.Close()
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.Nil(err)
+	assert.Equal("data: 1\n", line)
+	close(next)
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(err)
+	assert.Equal("\ndata: 2\n\n", string(data))
+}
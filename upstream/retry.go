@@ -0,0 +1,371 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// 转发失败时的重试处理，仅针对幂等的GET与HEAD请求，
+// 重试时通过target picker选择未尝试过的target，
+// 并以retry budget限制重试的比例，避免upstream异常时重试导致请求量放大
+
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vicanso/elton"
+	"github.com/vicanso/elton/middleware"
+	"github.com/vicanso/hes"
+	us "github.com/vicanso/upstream"
+	"go.uber.org/atomic"
+)
+
+const (
+	// RetryOnError 连接失败或超时
+	RetryOnError = "error"
+	// RetryOn5xx 响应状态码为5xx
+	RetryOn5xx = "5xx"
+)
+
+const (
+	// ProxyTargetsKey the key of tried targets in context, it can be used in access log, e.g.: {:proxyTargets}
+	ProxyTargetsKey = "proxyTargets"
+	// ProxyAttemptsKey the key of proxy attempts([]ProxyAttempt) in context
+	ProxyAttemptsKey = "proxyAttempts"
+	// proxyTriedTargetsKey the key of tried target list in context
+	proxyTriedTargetsKey = "proxyTriedTargets"
+)
+
+type contextKey string
+
+// ProxyAttempt the result of proxying to the target, each retry is an attempt
+type ProxyAttempt struct {
+	Target  string
+	Status  int
+	Latency time.Duration
+}
+
+// headerTimeoutContextKey the key of header timeout context
+const headerTimeoutContextKey contextKey = "headerTimeout"
+
+const (
+	// retryBudgetWindow 重试比例的统计周期
+	retryBudgetWindow = 10 * time.Second
+	// retryBudgetMinRetries 每个统计周期最少允许的重试次数，避免请求量少时无法重试
+	retryBudgetMinRetries = 10
+)
+
+type (
+	// RetryOption retry option
+	RetryOption struct {
+		// 最多尝试的次数（包括首次），小于等于1则不重试
+		Attempts int
+		// 重试的条件，error、5xx或指定状态码，默认为error
+		On []string
+		// 每次尝试等待响应头的超时（响应数据的读取不受此限制）
+		Timeout time.Duration
+		// 重试次数占请求数的最大百分比，为0则不限制
+		Budget int
+	}
+	// retryBudget the budget of retry
+	retryBudget struct {
+		mu       *sync.Mutex
+		percent  int
+		requests int
+		retries  int
+		resetAt  time.Time
+	}
+)
+
+// newRetryBudget create a retry budget
+func newRetryBudget(percent int) *retryBudget {
+	return &retryBudget{
+		mu:      &sync.Mutex{},
+		percent: percent,
+	}
+}
+
+// reset reset the count if the window is expired
+func (rb *retryBudget) reset(now time.Time) {
+	if now.Before(rb.resetAt) {
+		return
+	}
+	rb.requests = 0
+	rb.retries = 0
+	rb.resetAt = now.Add(retryBudgetWindow)
+}
+
+// AddRequest add the count of request
+func (rb *retryBudget) AddRequest() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.reset(time.Now())
+	rb.requests++
+}
+
+// Allow check whether retry is allowed, the count of retry will be added if allowed
+func (rb *retryBudget) Allow() bool {
+	if rb.percent <= 0 {
+		return true
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.reset(time.Now())
+	max := rb.requests * rb.percent / 100
+	if max < retryBudgetMinRetries {
+		max = retryBudgetMinRetries
+	}
+	if rb.retries >= max {
+		return false
+	}
+	rb.retries++
+	return true
+}
+
+// isRetryable check the result of proxy is retryable or not
+func (opt *RetryOption) isRetryable(err error, statusCode int) bool {
+	on := opt.On
+	if len(on) == 0 {
+		on = []string{
+			RetryOnError,
+		}
+	}
+	for _, item := range on {
+		switch item {
+		case RetryOnError:
+			// 响应数据过大，重试也无法成功
+			if err != nil && err != ErrResponseTooLarge {
+				return true
+			}
+		case RetryOn5xx:
+			if err == nil && statusCode >= http.StatusInternalServerError {
+				return true
+			}
+		default:
+			if err == nil && strconv.Itoa(statusCode) == item {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getTriedTargets get the tried targets from context
+func getTriedTargets(c *elton.Context) []string {
+	return c.GetStringSlice(proxyTriedTargetsKey)
+}
+
+// nextUpstream get the next upstream by balancer, the tried targets and the targets
+// which circuit breaker is open will be skipped
+func nextUpstream(c *elton.Context, b *balancer) (*us.HTTPUpstream, us.Done, error) {
+	httpUpstream, done := b.Next(c)
+	if httpUpstream == nil {
+		return nil, nil, ErrUpstreamNotFound
+	}
+	tried := getTriedTargets(c)
+	if !containsString(tried, httpUpstream.URL.String()) && b.allow(httpUpstream) {
+		return httpUpstream, done, nil
+	}
+	// 已尝试过或已熔断的target，则释放后通过balancer选择其它的
+	if done != nil {
+		done()
+	}
+	opened := make(map[*us.HTTPUpstream]bool)
+	if !containsString(tried, httpUpstream.URL.String()) {
+		opened[httpUpstream] = true
+	}
+	skip := func(item *us.HTTPUpstream) bool {
+		return opened[item] || containsString(tried, item.URL.String())
+	}
+	for {
+		item, done := b.NextExcept(c, skip)
+		if item == nil {
+			break
+		}
+		if b.allow(item) {
+			return item, done, nil
+		}
+		if done != nil {
+			done()
+		}
+		opened[item] = true
+	}
+	if len(opened) != 0 {
+		return nil, nil, ErrCircuitOpen
+	}
+	return nil, nil, ErrUpstreamNotFound
+}
+
+// hasUntriedUpstream check whether there is an available upstream which is not tried
+func hasUntriedUpstream(b *balancer, tried []string) bool {
+	for _, item := range b.uh.GetAvailableUpstreamList() {
+		if !containsString(tried, item.URL.String()) && b.available(item) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(arr []string, value string) bool {
+	for _, item := range arr {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdempotent check the request method is GET or HEAD
+func isIdempotent(c *elton.Context) bool {
+	method := c.Request.Method
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// headerTimeoutContext the context of proxy request which is canceled if the response
+// header isn't received before timeout, the error of context is deadline exceeded after timeout
+type headerTimeoutContext struct {
+	context.Context
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+// Err get the error of context, it returns deadline exceeded if the timer is fired
+func (ctx *headerTimeoutContext) Err() error {
+	if ctx.timedOut.Load() {
+		return context.DeadlineExceeded
+	}
+	return ctx.Context.Err()
+}
+
+// Value get the value of context, the header timeout context itself is returned for headerTimeoutContextKey
+func (ctx *headerTimeoutContext) Value(key interface{}) interface{} {
+	if key == headerTimeoutContextKey {
+		return ctx
+	}
+	return ctx.Context.Value(key)
+}
+
+// stopResponseHeaderTimer stop the timer of header timeout,
+// it should be called when the response header is received
+func stopResponseHeaderTimer(req *http.Request) {
+	if req == nil {
+		return
+	}
+	if ctx, ok := req.Context().Value(headerTimeoutContextKey).(*headerTimeoutContext); ok {
+		ctx.timer.Stop()
+	}
+}
+
+// proxyOnce proxy the request with timeout, the timeout is only applied until the response
+// header is received, so the streaming response (e.g.: large download or server-sent events) isn't cut off
+func proxyOnce(c *elton.Context, proxy elton.Handler, timeout time.Duration) error {
+	if timeout <= 0 {
+		return proxy(c)
+	}
+	req := c.Request
+	cancelCtx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	ctx := &headerTimeoutContext{
+		Context: cancelCtx,
+	}
+	ctx.timer = time.AfterFunc(timeout, func() {
+		ctx.timedOut.Store(true)
+		cancel()
+	})
+	defer ctx.timer.Stop()
+	c.WithContext(ctx)
+	err := proxy(c)
+	// 恢复原有的请求（context）
+	c.Request = req
+	if err != nil && ctx.timedOut.Load() {
+		err = ErrTimeout
+	}
+	return err
+}
+
+// getAttemptStatus get the status of proxy attempt, it is 502 if no response is received(e.g.: connection error)
+func getAttemptStatus(c *elton.Context, err error) int {
+	if err == nil {
+		if c.StatusCode == 0 {
+			return http.StatusOK
+		}
+		return c.StatusCode
+	}
+	if he, ok := err.(*hes.Error); ok && he.StatusCode >= http.StatusInternalServerError {
+		return he.StatusCode
+	}
+	if c.StatusCode != 0 {
+		return c.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+// newRetryProxy create a proxy middleware with retry
+func newRetryProxy(opt RetryOption, b *balancer, proxy elton.Handler) elton.Handler {
+	budget := newRetryBudget(opt.Budget)
+	return func(c *elton.Context) (err error) {
+		budget.AddRequest()
+		tried := make([]string, 0, 1)
+		attempts := make([]ProxyAttempt, 0, 1)
+		defer func() {
+			c.Set(ProxyTargetsKey, strings.Join(tried, ","))
+			c.Set(ProxyAttemptsKey, attempts)
+		}()
+		retryable := opt.Attempts > 1 && isIdempotent(c)
+		for attempt := 1; ; attempt++ {
+			c.Set(proxyTriedTargetsKey, tried)
+			c.Set(middleware.ProxyTargetKey, "")
+			startedAt := time.Now()
+			err = proxyOnce(c, proxy, opt.Timeout)
+			target := c.GetString(middleware.ProxyTargetKey)
+			// 无可用的upstream或已熔断
+			if target == "" {
+				return
+			}
+			tried = append(tried, target)
+			// 记录每次转发的结果，用于统计各target的请求
+			attempts = append(attempts, ProxyAttempt{
+				Target:  target,
+				Status:  getAttemptStatus(c, err),
+				Latency: time.Since(startedAt),
+			})
+			if !retryable ||
+				// 响应已以流的方式转发至客户端
+				c.Committed ||
+				attempt >= opt.Attempts ||
+				!opt.isRetryable(err, c.StatusCode) ||
+				// 请求已被取消或整体超时
+				c.Request.Context().Err() != nil ||
+				!hasUntriedUpstream(b, tried) ||
+				!budget.Allow() {
+				return
+			}
+			// 重置响应数据再重试
+			err = nil
+			c.StatusCode = 0
+			c.BodyBuffer = nil
+			c.ResetHeader()
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vicanso/elton"
+	us "github.com/vicanso/upstream"
+)
+
+func TestRetryBudget(t *testing.T) {
+	assert := assert.New(t)
+	rb := newRetryBudget(10)
+	for i := 0; i < 200; i++ {
+		rb.AddRequest()
+	}
+	// 200个请求，10%则为20次
+	for i := 0; i < 20; i++ {
+		assert.True(rb.Allow())
+	}
+	assert.False(rb.Allow())
+
+	// 请求量少时，最少允许的重试次数
+	rb = newRetryBudget(10)
+	for i := 0; i < retryBudgetMinRetries; i++ {
+		assert.True(rb.Allow())
+	}
+	assert.False(rb.Allow())
+
+	assert.True(newRetryBudget(0).Allow())
+}
+
+func TestRetryOptionIsRetryable(t *testing.T) {
+	assert := assert.New(t)
+	opt := RetryOption{}
+	assert.True(opt.isRetryable(errors.New("abc"), 0))
+	assert.False(opt.isRetryable(nil, 502))
+
+	opt.On = []string{
+		RetryOn5xx,
+		"404",
+	}
+	assert.False(opt.isRetryable(errors.New("abc"), 0))
+	assert.True(opt.isRetryable(nil, 502))
+	assert.True(opt.isRetryable(nil, 404))
+	assert.False(opt.isRetryable(nil, 400))
+}
+
+func TestRetryProxy(t *testing.T) {
+	assert := assert.New(t)
+	badServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("bad gateway"))
+	}))
+	defer badServer.Close()
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer slowServer.Close()
+	goodServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Server", "good")
+		_, _ = w.Write([]byte("hello world"))
+	}))
+	defer goodServer.Close()
+
+	uh := &us.HTTP{
+		Policy: us.PolicyFirst,
+	}
+	for _, addr := range []string{
+		badServer.URL,
+		slowServer.URL,
+		goodServer.URL,
+	} {
+		assert.Nil(uh.Add(addr))
+	}
+	for _, up := range uh.GetUpstreamList() {
+		up.Healthy()
+	}
+
+	newContext := func(method string) *elton.Context {
+		c := elton.NewContext(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil))
+		c.Next = func() error {
+			return nil
+		}
+		return c
+	}
+
+	opt := UpstreamServerOption{
+		Retry: RetryOption{
+			Attempts: 3,
+			On: []string{
+				RetryOnError,
+				RetryOn5xx,
+			},
+			Timeout: 50 * time.Millisecond,
+		},
+	}
+	fn := newProxyMid(opt, newTransport(opt), newBalancer(opt, uh), nil)
+
+	// 502与超时的target均重试，最终由正常的target响应
+	c := newContext("GET")
+	err := fn(c)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, c.StatusCode)
+	assert.Equal("good", c.GetHeader("X-Server"))
+	assert.Equal("hello world", c.BodyBuffer.String())
+	assert.Equal(strings.Join([]string{
+		badServer.URL,
+		slowServer.URL,
+		goodServer.URL,
+	}, ","), c.GetString(ProxyTargetsKey))
+	attempts, _ := c.Get(ProxyAttemptsKey)
+	proxyAttempts := attempts.([]ProxyAttempt)
+	assert.Equal(3, len(proxyAttempts))
+	assert.Equal(badServer.URL, proxyAttempts[0].Target)
+	assert.Equal(http.StatusBadGateway, proxyAttempts[0].Status)
+	assert.Equal(slowServer.URL, proxyAttempts[1].Target)
+	assert.True(proxyAttempts[1].Status >= http.StatusInternalServerError)
+	assert.Equal(goodServer.URL, proxyAttempts[2].Target)
+	assert.Equal(http.StatusOK, proxyAttempts[2].Status)
+
+	// POST请求不重试
+	c = newContext("POST")
+	err = fn(c)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadGateway, c.StatusCode)
+	assert.Equal(badServer.URL, c.GetString(ProxyTargetsKey))
+
+	// 尝试次数用完，返回最后一次的结果
+	opt.Retry.Attempts = 2
+	fn = newProxyMid(opt, newTransport(opt), newBalancer(opt, uh), nil)
+	c = newContext("GET")
+	err = fn(c)
+	assert.NotNil(err)
+	assert.Equal(badServer.URL+","+slowServer.URL, c.GetString(ProxyTargetsKey))
+}
+
+func TestRetryTimeoutUntilResponseHeader(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set(elton.HeaderContentType, "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// 响应头已返回，数据的读取不受超时限制
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = w.Write([]byte("data: hello\n\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	uh := &us.HTTP{
+		Policy: us.PolicyFirst,
+	}
+	assert.Nil(uh.Add(server.URL))
+	for _, up := range uh.GetUpstreamList() {
+		up.Healthy()
+	}
+	opt := UpstreamServerOption{
+		Retry: RetryOption{
+			Attempts: 2,
+			Timeout:  30 * time.Millisecond,
+		},
+	}
+	fn := newProxyMid(opt, newTransport(opt), newBalancer(opt, uh), nil)
+
+	resp := httptest.NewRecorder()
+	// 请求头未指定Accept: text/event-stream
+	c := elton.NewContext(resp, httptest.NewRequest("GET", "/", nil))
+	c.Next = func() error {
+		return nil
+	}
+	err := fn(c)
+	assert.Nil(err)
+	assert.Equal(strings.Repeat("data: hello\n\n", 3), resp.Body.String())
+}
@@ -0,0 +1,132 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package upstream
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	// ProtocolHTTP1 only use http/1.1
+	ProtocolHTTP1 = "http1"
+	// ProtocolHTTP2 try to use http/2 for https upstream(default)
+	ProtocolHTTP2 = "http2"
+)
+
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConns        = 500
+	defaultMaxIdleConnsPerHost = 50
+)
+
+type (
+	// TransportOption transport option of upstream, the default values will be used if not set
+	TransportOption struct {
+		// 连接超时，默认为30s
+		DialTimeout time.Duration
+		// TCP keep-alive的间隔，默认为30s
+		KeepAlive time.Duration
+		// 禁用连接复用
+		DisableKeepAlives bool
+		// 等待响应头的超时，默认不限制
+		ResponseHeaderTimeout time.Duration
+		// 空闲连接的超时，默认为90s
+		IdleConnTimeout time.Duration
+		// 最大的空闲连接数，默认为500
+		MaxIdleConns int
+		// 每个host最大的空闲连接数，默认为50
+		MaxIdleConnsPerHost int
+		// 每个host最大的连接数，默认不限制
+		MaxConnsPerHost int
+		// 使用的协议，http1或http2（默认）
+		Protocol string
+	}
+)
+
+func (opt *TransportOption) fillDefault() {
+	if opt.DialTimeout <= 0 {
+		opt.DialTimeout = defaultDialTimeout
+	}
+	if opt.KeepAlive <= 0 {
+		opt.KeepAlive = defaultKeepAlive
+	}
+	if opt.IdleConnTimeout <= 0 {
+		opt.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if opt.MaxIdleConns <= 0 {
+		opt.MaxIdleConns = defaultMaxIdleConns
+	}
+	if opt.MaxIdleConnsPerHost <= 0 {
+		opt.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+}
+
+// newTransport new a transport for http
+func newTransport(opt UpstreamServerOption) http.RoundTripper {
+	transportOpt := opt.Transport
+	transportOpt.fillDefault()
+	dialer := &net.Dialer{
+		Timeout:   transportOpt.DialTimeout,
+		KeepAlive: transportOpt.KeepAlive,
+		DualStack: true,
+	}
+	if opt.EnableH2C {
+		return &http2.Transport{
+			// 允许使用http的方式
+			AllowHTTP: true,
+			// tls的dial覆盖
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		}
+	}
+	transport := &http.Transport{
+		// TODO 暂时不配置proxy，后续再确认是否需要
+		// Proxy: http.ProxyFromEnvironment,
+		DialContext:       dialer.DialContext,
+		ForceAttemptHTTP2: true,
+		DisableKeepAlives: transportOpt.DisableKeepAlives,
+		MaxIdleConns:      transportOpt.MaxIdleConns,
+		// 调整默认的每个host的最大连接因为缓存服务与backend可能会突发性的大量调用
+		MaxIdleConnsPerHost:   transportOpt.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       transportOpt.MaxConnsPerHost,
+		IdleConnTimeout:       transportOpt.IdleConnTimeout,
+		ResponseHeaderTimeout: transportOpt.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       opt.TLSConfig,
+	}
+	// 只使用http/1.1，TLSNextProto设置为非nil的空map则禁用http/2
+	if transportOpt.Protocol == ProtocolHTTP1 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
@@ -0,0 +1,67 @@
+// MIT License
+
+// Copyright (c) 2020 Tree Xie
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package upstream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportOption(t *testing.T) {
+	assert := assert.New(t)
+
+	transport, ok := newTransport(UpstreamServerOption{}).(*http.Transport)
+	assert.True(ok)
+	assert.Equal(defaultMaxIdleConns, transport.MaxIdleConns)
+	assert.Equal(defaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.Equal(defaultIdleConnTimeout, transport.IdleConnTimeout)
+	assert.Empty(transport.MaxConnsPerHost)
+	assert.Empty(transport.ResponseHeaderTimeout)
+	assert.Nil(transport.TLSNextProto)
+
+	transport, ok = newTransport(UpstreamServerOption{
+		Transport: TransportOption{
+			DisableKeepAlives:     true,
+			ResponseHeaderTimeout: time.Second,
+			IdleConnTimeout:       time.Minute,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   10,
+			MaxConnsPerHost:       20,
+			Protocol:              ProtocolHTTP1,
+		},
+	}).(*http.Transport)
+	assert.True(ok)
+	assert.True(transport.DisableKeepAlives)
+	assert.Equal(time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(time.Minute, transport.IdleConnTimeout)
+	assert.Equal(100, transport.MaxIdleConns)
+	assert.Equal(10, transport.MaxIdleConnsPerHost)
+	assert.Equal(20, transport.MaxConnsPerHost)
+	// 只使用http/1.1
+	assert.False(transport.ForceAttemptHTTP2)
+	assert.NotNil(transport.TLSNextProto)
+	assert.Empty(transport.TLSNextProto)
+}
@@ -25,8 +25,8 @@
 package upstream
 
 import (
+	"context"
 	"crypto/tls"
-	"net"
 	"net/http"
 	"net/url"
 	"sync"
@@ -40,7 +40,6 @@ import (
 	"github.com/vicanso/pike/util"
 	us "github.com/vicanso/upstream"
 	"go.uber.org/zap"
-	"golang.org/x/net/http2"
 )
 
 type (
@@ -49,17 +48,33 @@ type (
 		Addr string
 		// 是否备用
 		Backup bool
+		// 权重，用于weightedRoundRobin与consistentHash，默认为1
+		Weight int
 	}
 	UpstreamServerStatus struct {
 		Addr    string
 		Healthy bool
+		// 熔断器的状态，未启用则为空
+		Circuit string
 	}
 	UpstreamServerOption struct {
 		Name        string
 		HealthCheck string
-		Policy      string
+		// 健康检查的配置
+		Health HealthCheckOption
+		// 转发失败时的重试配置
+		Retry RetryOption
+		// 熔断配置
+		CircuitBreaker CircuitBreakerOption
+		Policy         string
+		// 一致性哈希的key，url、ip、header:name或cookie:name
+		HashKey string
 		// 是否启用h2c(http/2 over tcp)
 		EnableH2C bool
+		// 转发至https服务时的TLS配置，为空则使用默认配置
+		TLSConfig *tls.Config
+		// 连接与连接池的配置
+		Transport TransportOption
 		// 设置可接受的编码
 		AcceptEncoding string
 		// OnStatus on status
@@ -71,6 +86,9 @@ type (
 		Proxy        elton.Handler
 		HTTPUpstream *us.HTTP
 		Option       *UpstreamServerOption
+		health       *healthChecker
+		balancer     *balancer
+		transport    http.RoundTripper
 	}
 	upstreamServers struct {
 		m *sync.Map
@@ -90,69 +108,67 @@ var (
 		StatusCode: http.StatusServiceUnavailable,
 		Message:    "Available Upstream Not Found",
 	}
+	// ErrCircuitOpen the circuit breakers of all available upstreams are open
+	ErrCircuitOpen = util.NewError("Circuit Breaker Is Open", http.StatusServiceUnavailable)
+	// ErrTimeout the response header isn't received before the timeout of retry
+	ErrTimeout = util.NewError("Timeout", http.StatusGatewayTimeout)
 )
 
-// newTransport new a transport for http
-func newTransport(h2c bool) http.RoundTripper {
-	if h2c {
-		return &http2.Transport{
-			// 允许使用http的方式
-			AllowHTTP: true,
-			// tls的dial覆盖
-			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-				return net.Dial(network, addr)
-			},
-		}
-	}
-	return &http.Transport{
-		// TODO 暂时不配置proxy，后续再确认是否需要
-		// Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		ForceAttemptHTTP2: true,
-		MaxIdleConns:      500,
-		// 调整默认的每个host的最大连接因为缓存服务与backend可能会突发性的大量调用
-		MaxIdleConnsPerHost:   50,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+// isProxyFailed check the proxy request is failed or not(5xx or connection error),
+// the request which is canceled by client is not treated as failure
+func isProxyFailed(c *elton.Context) bool {
+	if c.Request != nil && c.Request.Context().Err() == context.Canceled {
+		return false
 	}
+	// 连接失败时无响应状态码
+	return c.StatusCode == 0 || c.StatusCode >= http.StatusInternalServerError
 }
 
 // newTargetPicker create a target pick function
-func newTargetPicker(uh *us.HTTP) middleware.ProxyTargetPicker {
+func newTargetPicker(b *balancer, hc *healthChecker) middleware.ProxyTargetPicker {
 	return func(c *elton.Context) (*url.URL, middleware.ProxyDone, error) {
-		httpUpstream, done := uh.Next()
-		if httpUpstream == nil {
-			return nil, nil, ErrUpstreamNotFound
+		// 重试时跳过已尝试过的target
+		httpUpstream, done, err := nextUpstream(c, b)
+		if err != nil {
+			return nil, nil, err
 		}
-		var proxyDone middleware.ProxyDone
-		// 返回了done（如最少连接数的策略）
-		if done != nil {
-			proxyDone = func(_ *elton.Context) {
+		startedAt := time.Now()
+		proxyDone := func(c *elton.Context) {
+			// 返回了done（如最少连接数的策略）
+			if done != nil {
 				done()
 			}
+			failed := isProxyFailed(c)
+			// 被动健康检查
+			if hc != nil {
+				hc.Observe(httpUpstream, failed)
+			}
+			// 耗时为接收到响应头的时长，未接收到响应头（如连接失败）则为至今的时长
+			latency := time.Since(startedAt)
+			if headerAt := c.GetTime(proxyResponseHeaderAtKey); !headerAt.IsZero() {
+				latency = headerAt.Sub(startedAt)
+			}
+			// upgrade与流式转发（如server-sent events）的响应不作为慢请求统计
+			_, streamed := c.Get(ProxyStreamedSizeKey)
+			if streamed || c.StatusCode == http.StatusSwitchingProtocols {
+				latency = -1
+			}
+			b.done(httpUpstream, failed, latency)
 		}
 		return httpUpstream.URL, proxyDone, nil
 	}
 }
 
 // newProxyMid new a proxy middleware
-func newProxyMid(opt UpstreamServerOption, uh *us.HTTP) elton.Handler {
-	return middleware.NewProxy(middleware.ProxyConfig{
-		Transport:    newTransport(opt.EnableH2C),
-		TargetPicker: newTargetPicker(uh),
-	})
+func newProxyMid(opt UpstreamServerOption, transport http.RoundTripper, b *balancer, hc *healthChecker) elton.Handler {
+	proxy := newProxy(transport, newTargetPicker(b, hc))
+	return newRetryProxy(opt.Retry, b, proxy)
 }
 
 // NewUpstreamServer new an upstream server
 func NewUpstreamServer(opt UpstreamServerOption) *upstreamServer {
 	uh := &us.HTTP{
 		Policy: opt.Policy,
-		Ping:   opt.HealthCheck,
 	}
 	for _, server := range opt.Servers {
 		// 添加失败的则忽略(地址配置有误则会添加失败)
@@ -162,25 +178,34 @@ func NewUpstreamServer(opt UpstreamServerOption) *upstreamServer {
 			_ = uh.Add(server.Addr)
 		}
 	}
+	var onStatus func(int32, *us.HTTPUpstream)
 	// 如果有添加on status事件
 	if opt.OnStatus != nil {
-		uh.OnStatus(func(status int32, upstream *us.HTTPUpstream) {
+		onStatus = func(status int32, upstream *us.HTTPUpstream) {
 			opt.OnStatus(StatusInfo{
 				Name:   opt.Name,
 				URL:    upstream.URL.String(),
 				Status: us.ConvertStatusToString(status),
 			})
-		})
+		}
 	}
+	transport := newTransport(opt)
+	hc := newHealthChecker(opt.HealthCheck, opt.Health, uh, onStatus)
+	// 健康检查与转发使用相同的transport（TLS配置）
+	hc.client.Transport = transport
 	// 先执行一次health check，获取当前可用服务列表
-	uh.DoHealthCheck()
+	hc.Check()
 	// 后续需要定时检测upstream是否可用
-	go uh.StartHealthCheck()
+	go hc.Start()
+	b := newBalancer(opt, uh)
 	return &upstreamServer{
 		servers:      opt.Servers,
 		HTTPUpstream: uh,
 		Option:       &opt,
-		Proxy:        newProxyMid(opt, uh),
+		Proxy:        newProxyMid(opt, transport, b, hc),
+		health:       hc,
+		balancer:     b,
+		transport:    transport,
 	}
 }
 
@@ -244,7 +269,11 @@ func (us *upstreamServers) Get(name string) *upstreamServer {
 // Destroy destory the upstream server
 func (u *upstreamServer) Destroy() {
 	// 停止定时检测
-	u.HTTPUpstream.StopHealthCheck()
+	u.health.Stop()
+	// 关闭空闲连接，正在使用的连接不受影响
+	if t, ok := u.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
 }
 
 // GetServerStatusList get sever status list
@@ -258,9 +287,16 @@ func (u *upstreamServer) GetServerStatusList() []UpstreamServerStatus {
 				healthy = true
 			}
 		}
+		circuit := ""
+		for _, upstream := range u.HTTPUpstream.GetUpstreamList() {
+			if upstream.URL.String() == item.Addr {
+				circuit = u.balancer.getCircuitState(upstream)
+			}
+		}
 		statusList = append(statusList, UpstreamServerStatus{
 			Addr:    item.Addr,
 			Healthy: healthy,
+			Circuit: circuit,
 		})
 	}
 
@@ -288,13 +324,66 @@ func convertConfigs(configs []config.UpstreamConfig, fn OnStatus) []UpstreamServ
 			servers = append(servers, UpstreamServerConfig{
 				Addr:   server.Addr,
 				Backup: server.Backup,
+				Weight: server.Weight,
 			})
 		}
+		health := HealthCheckOption{
+			Rise:            item.HealthCheckRise,
+			Fall:            item.HealthCheckFall,
+			PassiveFailures: item.PassiveFailures,
+		}
+		// 配置已校验，因此忽略出错
+		health.Interval, _ = time.ParseDuration(item.HealthCheckInterval)
+		health.Timeout, _ = time.ParseDuration(item.HealthCheckTimeout)
+		health.PassiveCooldown, _ = time.ParseDuration(item.PassiveCooldown)
+		if item.HealthCheckStatus != "" {
+			health.StatusMin, health.StatusMax, _ = util.ParseStatusRange(item.HealthCheckStatus)
+		}
+		retry := RetryOption{
+			Attempts: item.RetryAttempts,
+			On:       item.RetryOn,
+			Budget:   item.RetryBudget,
+		}
+		retry.Timeout, _ = time.ParseDuration(item.RetryTimeout)
+		circuitBreaker := CircuitBreakerOption{
+			ErrorRate:        item.BreakerErrorRate,
+			SlowRate:         item.BreakerSlowRate,
+			MinRequests:      item.BreakerMinRequests,
+			HalfOpenRequests: item.BreakerHalfOpenRequests,
+		}
+		circuitBreaker.SlowLatency, _ = time.ParseDuration(item.BreakerSlowLatency)
+		circuitBreaker.Window, _ = time.ParseDuration(item.BreakerWindow)
+		circuitBreaker.OpenTimeout, _ = time.ParseDuration(item.BreakerOpenTimeout)
+		transport := TransportOption{
+			DisableKeepAlives:   item.DisableKeepAlives,
+			MaxIdleConns:        item.MaxIdleConns,
+			MaxIdleConnsPerHost: item.MaxIdleConnsPerHost,
+			MaxConnsPerHost:     item.MaxConnsPerHost,
+			Protocol:            item.Protocol,
+		}
+		transport.DialTimeout, _ = time.ParseDuration(item.DialTimeout)
+		transport.KeepAlive, _ = time.ParseDuration(item.KeepAlive)
+		transport.ResponseHeaderTimeout, _ = time.ParseDuration(item.ResponseHeaderTimeout)
+		transport.IdleConnTimeout, _ = time.ParseDuration(item.IdleConnTimeout)
+		tlsConfig, err := item.TLSConfig()
+		// TLS配置加载失败则使用默认配置
+		if err != nil {
+			log.Default().Error("load tls config of upstream fail",
+				zap.String("name", item.Name),
+				zap.Error(err),
+			)
+		}
 		opts = append(opts, UpstreamServerOption{
 			Name:           item.Name,
 			HealthCheck:    item.HealthCheck,
+			Health:         health,
+			Retry:          retry,
+			CircuitBreaker: circuitBreaker,
 			Policy:         item.Policy,
+			HashKey:        item.HashKey,
 			EnableH2C:      item.EnableH2C,
+			TLSConfig:      tlsConfig,
+			Transport:      transport,
 			AcceptEncoding: item.AcceptEncoding,
 			Servers:        servers,
 			OnStatus:       fn,
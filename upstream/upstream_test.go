@@ -1,8 +1,11 @@
 package upstream
 
 import (
+	"encoding/pem"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/vicanso/elton"
@@ -14,19 +17,69 @@ import (
 func TestNewTransport(t *testing.T) {
 	assert := assert.New(t)
 
-	transport := newTransport(true)
+	transport := newTransport(UpstreamServerOption{
+		EnableH2C: true,
+	})
 
 	h2Transport, ok := transport.(*http2.Transport)
 	assert.True(ok)
 	assert.True(h2Transport.AllowHTTP)
 
-	transport = newTransport(false)
+	transport = newTransport(UpstreamServerOption{})
 
 	hTransport, ok := transport.(*http.Transport)
 	assert.True(ok)
 	assert.True(hTransport.ForceAttemptHTTP2)
 }
 
+func TestNewTransportTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	// 默认的transport无法校验自签名证书
+	client := &http.Client{
+		Transport: newTransport(UpstreamServerOption{}),
+	}
+	_, err := client.Get(ts.URL)
+	assert.NotNil(err)
+
+	// 指定CA与校验的域名
+	c := config.UpstreamConfig{
+		TLSCA: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: ts.Certificate().Raw,
+		})),
+		TLSServerName: "example.com",
+	}
+	tlsConfig, err := c.TLSConfig()
+	assert.Nil(err)
+	client = &http.Client{
+		Transport: newTransport(UpstreamServerOption{
+			TLSConfig: tlsConfig,
+		}),
+	}
+	resp, err := client.Get(ts.URL)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+
+	// 域名不匹配
+	c.TLSServerName = "test.com"
+	tlsConfig, err = c.TLSConfig()
+	assert.Nil(err)
+	client = &http.Client{
+		Transport: newTransport(UpstreamServerOption{
+			TLSConfig: tlsConfig,
+		}),
+	}
+	_, err = client.Get(ts.URL)
+	assert.NotNil(err)
+}
+
 func TestNewTargetPicker(t *testing.T) {
 	assert := assert.New(t)
 
@@ -38,7 +91,9 @@ func TestNewTargetPicker(t *testing.T) {
 	for _, up := range uh.GetUpstreamList() {
 		up.Healthy()
 	}
-	fn := newTargetPicker(uh)
+	fn := newTargetPicker(newBalancer(UpstreamServerOption{
+		Policy: us.PolicyLeastconn,
+	}, uh), nil)
 	c := elton.NewContext(nil, nil)
 	url, done, err := fn(c)
 	assert.Nil(err)
@@ -128,15 +183,34 @@ func TestConvertConfig(t *testing.T) {
 
 	configs := []config.UpstreamConfig{
 		{
-			Name:           name,
-			HealthCheck:    healthCheck,
-			Policy:         policy,
-			EnableH2C:      enableH2C,
-			AcceptEncoding: acceptEncoding,
+			Name:                  name,
+			HealthCheck:           healthCheck,
+			Policy:                policy,
+			EnableH2C:             enableH2C,
+			AcceptEncoding:        acceptEncoding,
+			HashKey:               "ip",
+			HealthCheckInterval:   "10s",
+			HealthCheckStatus:     "200-299",
+			HealthCheckRise:       2,
+			PassiveFailures:       3,
+			PassiveCooldown:       "1m",
+			RetryAttempts:         3,
+			RetryOn:               []string{"error", "502"},
+			RetryTimeout:          "2s",
+			RetryBudget:           20,
+			BreakerErrorRate:      50,
+			BreakerSlowLatency:    "3s",
+			BreakerSlowRate:       80,
+			BreakerOpenTimeout:    "1m",
+			DialTimeout:           "5s",
+			ResponseHeaderTimeout: "10s",
+			MaxConnsPerHost:       100,
+			Protocol:              "http1",
 			Servers: []config.UpstreamServerConfig{
 				{
 					Addr:   addr,
 					Backup: backup,
+					Weight: 2,
 				},
 			},
 		},
@@ -148,9 +222,37 @@ func TestConvertConfig(t *testing.T) {
 	assert.Equal(policy, opts[0].Policy)
 	assert.Equal(enableH2C, opts[0].EnableH2C)
 	assert.Equal(acceptEncoding, opts[0].AcceptEncoding)
+	assert.Equal(HealthCheckOption{
+		Interval:        10 * time.Second,
+		StatusMin:       200,
+		StatusMax:       299,
+		Rise:            2,
+		PassiveFailures: 3,
+		PassiveCooldown: time.Minute,
+	}, opts[0].Health)
+	assert.Equal(RetryOption{
+		Attempts: 3,
+		On:       []string{"error", "502"},
+		Timeout:  2 * time.Second,
+		Budget:   20,
+	}, opts[0].Retry)
+	assert.Equal(CircuitBreakerOption{
+		ErrorRate:   50,
+		SlowLatency: 3 * time.Second,
+		SlowRate:    80,
+		OpenTimeout: time.Minute,
+	}, opts[0].CircuitBreaker)
+	assert.Equal(TransportOption{
+		DialTimeout:           5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxConnsPerHost:       100,
+		Protocol:              ProtocolHTTP1,
+	}, opts[0].Transport)
 	assert.Equal(1, len(opts[0].Servers))
 	assert.Equal(addr, opts[0].Servers[0].Addr)
 	assert.True(opts[0].Servers[0].Backup)
+	assert.Equal(2, opts[0].Servers[0].Weight)
+	assert.Equal("ip", opts[0].HashKey)
 }
 
 func TestDefaultUpstreamServers(t *testing.T) {
@@ -23,6 +23,11 @@
 package util
 
 import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/vicanso/hes"
@@ -32,6 +37,10 @@ const errCategory = "pike"
 
 type DeleteMatch func(string) bool
 
+var ErrStatusRangeInvalid = errors.New("status range is invalid")
+
+var ErrRateInvalid = errors.New("rate is invalid")
+
 // MapDelete delete item form sync map
 func MapDelete(m *sync.Map, match DeleteMatch) []interface{} {
 	result := make([]interface{}, 0)
@@ -64,3 +73,101 @@ func NewError(message string, statusCode int) error {
 		Category:   errCategory,
 	}
 }
+
+// ParseStatusRange parse the status range, e.g.: 200-399 or 200
+func ParseStatusRange(value string) (min, max int, err error) {
+	arr := strings.SplitN(value, "-", 2)
+	min, err = strconv.Atoi(strings.TrimSpace(arr[0]))
+	if err != nil {
+		return
+	}
+	max = min
+	if len(arr) == 2 {
+		max, err = strconv.Atoi(strings.TrimSpace(arr[1]))
+		if err != nil {
+			return
+		}
+	}
+	// 状态码需在100-599之间
+	if min < 100 || max > 599 || min > max {
+		err = ErrStatusRangeInvalid
+		return
+	}
+	return
+}
+
+var rateUnits = map[string]float64{
+	"s": 1,
+	"m": 60,
+	"h": 3600,
+}
+
+// ParseRate parse the rate to the count per second, e.g.: 10/s, 100/m or 1000/h
+func ParseRate(value string) (rate float64, err error) {
+	arr := strings.SplitN(value, "/", 2)
+	if len(arr) != 2 {
+		err = ErrRateInvalid
+		return
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(arr[0]))
+	if err != nil {
+		return
+	}
+	seconds, ok := rateUnits[strings.TrimSpace(arr[1])]
+	if !ok || count <= 0 {
+		err = ErrRateInvalid
+		return
+	}
+	rate = float64(count) / seconds
+	return
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parse the tls version, e.g.: 1.2
+func ParseTLSVersion(value string) (uint16, bool) {
+	version, ok := tlsVersions[value]
+	return version, ok
+}
+
+// ParseCipherSuite parse the cipher suite by name, e.g.: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func ParseCipherSuite(name string) (uint16, bool) {
+	for _, list := range [][]*tls.CipherSuite{
+		tls.CipherSuites(),
+		tls.InsecureCipherSuites(),
+	} {
+		for _, item := range list {
+			if item.Name == name {
+				return item.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// IsUpgradeRequest check the request is upgrade request(e.g.: websocket),
+// the header Connection should contain upgrade
+func IsUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsEventStreamRequest check the request is server-sent events request,
+// the header Accept should contain text/event-stream
+func IsEventStreamRequest(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
@@ -23,6 +23,8 @@
 package util
 
 import (
+	"crypto/tls"
+	"net/http/httptest"
 	"sync"
 	"testing"
 
@@ -62,3 +64,78 @@ func TestNewError(t *testing.T) {
 	assert.Equal(message, he.Message)
 	assert.Equal(errCategory, he.Category)
 }
+
+func TestParseStatusRange(t *testing.T) {
+	assert := assert.New(t)
+	min, max, err := ParseStatusRange("200-399")
+	assert.Nil(err)
+	assert.Equal(200, min)
+	assert.Equal(399, max)
+
+	min, max, err = ParseStatusRange("204")
+	assert.Nil(err)
+	assert.Equal(204, min)
+	assert.Equal(204, max)
+
+	_, _, err = ParseStatusRange("399-200")
+	assert.Equal(ErrStatusRangeInvalid, err)
+
+	_, _, err = ParseStatusRange("abc")
+	assert.NotNil(err)
+}
+
+func TestParseRate(t *testing.T) {
+	assert := assert.New(t)
+	rate, err := ParseRate("10/s")
+	assert.Nil(err)
+	assert.Equal(float64(10), rate)
+
+	rate, err = ParseRate("120/m")
+	assert.Nil(err)
+	assert.Equal(float64(2), rate)
+
+	_, err = ParseRate("10")
+	assert.Equal(ErrRateInvalid, err)
+
+	_, err = ParseRate("0/s")
+	assert.Equal(ErrRateInvalid, err)
+
+	_, err = ParseRate("10/d")
+	assert.Equal(ErrRateInvalid, err)
+}
+
+func TestParseTLS(t *testing.T) {
+	assert := assert.New(t)
+	version, ok := ParseTLSVersion("1.2")
+	assert.True(ok)
+	assert.Equal(uint16(tls.VersionTLS12), version)
+	_, ok = ParseTLSVersion("2.0")
+	assert.False(ok)
+
+	id, ok := ParseCipherSuite("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	assert.True(ok)
+	assert.Equal(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, id)
+	_, ok = ParseCipherSuite("abc")
+	assert.False(ok)
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	assert := assert.New(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.False(IsUpgradeRequest(req))
+
+	req.Header.Set("Upgrade", "websocket")
+	assert.False(IsUpgradeRequest(req))
+
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	assert.True(IsUpgradeRequest(req))
+}
+
+func TestIsEventStreamRequest(t *testing.T) {
+	assert := assert.New(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.False(IsEventStreamRequest(req))
+
+	req.Header.Set("Accept", "text/event-stream")
+	assert.True(IsEventStreamRequest(req))
+}